@@ -15,6 +15,9 @@ type parser struct {
 	end			int				// buffer length-1
 	i			int				// index into the file
 	n			int				// line number
+	filename	string			// name of the file being parsed
+	line		int				// line number of the statement being parsed
+	col			int				//   and its column (from 1)
 
 	abWidth		int 			// A16 for lowest code address @<$FFFF or A24 @>=10000
 
@@ -24,6 +27,9 @@ type parser struct {
 	global		*vrbl			// linked list of constants
 	lastGlobal	*vrbl
 
+	reg			*rgstr			// linked list of (top-level) named registers
+	lastReg		*rgstr
+
 	code		*codeBlock		// linked list of subroutine blocks
 	lastCode	*codeBlock
 	currentCode	*codeBlock		// current block being parsed/generated
@@ -34,10 +40,48 @@ type parser struct {
 
 	data		*dataBlock		// linked list of data items
 	lastData	*dataBlock
+	vectors		*dataBlock		// the VECTORS (if any)
 
 	codeSize	int
 	dataSize	int
 	fillerSize	int
+
+	optimize	bool			// run the peephole optimizer (-O)
+	noopt		bool			// inside a #pragma noopt region
+	peepCount	[]int			// how many times each peephole rule was applied
+	peepBytes	[]int			//   and how many bytes that saved
+	widen		bool			// widen instructions that would truncate a register (-widen)
+	verify		bool			// decode every instruction again to check its bytes (-verify)
+	verifyTable	map[int]disasmOpcode	//   and the opcodes to decode them with
+
+	regBase		int				// zero page address of %R0 (#registers)
+	regCount	int				//   and how many registers
+	regSet		bool			//   set by #registers
+	regUsed		bool			//   a %R register has been used
+	paramBase	int				// address of %%0 (#params)
+	paramStride	int				//   and the bytes per parameter
+	paramSet	bool			//   set by #params
+	paramUsed	bool			//   a %% parameter has been used
+
+	threadCount	int				// how many THREAD blocks (i.e. the last thread ID)
+	constructs	int				// how many IF, LOOP, FOR, DO, etc. (to name each one)
+	spawns		[]*spawn		// every SPAWN, resolved after parsing
+
+	cpu			int				// target CPU (set by -cpu or #cpu)
+
+	quiet		bool			// don't print PARSE or any warnings (the first pass of -prune)
+	keep		[]keepName		// the #keep names (lowercase), in the order they appear
+	pruned		[]prunedBlock	// the SUB and DATA blocks dropped by -prune
+
+	warnOn		[]bool			// each class of warning is on (-W)
+	warnError	[]bool			//   and is an error (-W error)
+	warnErrors	int				// how many warnings were errors
+	warnOff		[]warnRegion	// where #pragma warning off silences them
+	warnings	[]warningMessage	// the warnings not printed (when quiet)
+
+	includePaths	[]string		// the -I folders, searched after the folder of the file
+	includes	[]includeFrame	// the #include lines that led to the file being parsed
+	once		map[string]bool	// the files with a #once (by absolute path)
 }
 
 // Linked list of constants
@@ -46,6 +90,9 @@ type cnst struct {
 	name		string
 	nameLC		string
 	value		int
+	used		bool			// read by an instruction or another CONST
+	filename	string			// where it was defined
+	line		int
 }
 
 // Linked list of global variables
@@ -55,6 +102,27 @@ type vrbl struct {
 	nameLC		string
 	address		int
 	size		int
+	used		bool			// touched by an instruction (only for GLOBALs)
+	filename	string			// where it was defined
+	line		int
+}
+
+// Linked list of named registers, e.g. REG count = %R4.w
+type rgstr struct {
+	next		*rgstr			// next in the linked list
+	name		string
+	nameLC		string
+	n			int				// register number, e.g. 4 for %R4
+	address		int				// zero page address
+	size		int				// R08, R16, or R24
+	line		int				// line of the REG
+}
+
+// A named register used in a SUB
+type rgstrUse struct {
+	r			*rgstr
+	filename	string			// where it is first used
+	line		int
 }
 
 // Linked list of code blocks
@@ -66,11 +134,22 @@ type codeBlock struct {
 	endAddr		int
 	name		string
 	nameLC		string
+	kind		int				// SUB, ISR, NMI, or THREAD (only for the top-level blocks)
+	thread		int				// thread ID (only for THREAD blocks)
+	stack		int				//   and the address of its stack page
 	isLoop		bool
+	placed		bool			// at an @address (only for the top-level blocks)
+	filename	string			// where it was defined (only for the top-level blocks)
+	line		int				//   from the line of its name
+	endLine		int				//   to the line of its }
 
 	vrbl		*vrbl			// linked list of local-to-the-block variables
 	lastVrbl	*vrbl
 
+	reg			*rgstr			// linked list of local-to-the-block named registers
+	lastReg		*rgstr
+	regsUsed	[]rgstrUse		// named registers used in the SUB (only for the top-level blocks)
+
 	instr		*instruction	// linked list of instructions (parsed but not yet encoded)
 	lastInstr	*instruction
 }
@@ -88,16 +167,31 @@ type instruction struct {
 	prefix		int
 	opcode		int
 	value		int
+	zeroPage	int				// the zero page address of BBRn/BBSn (with the branch in value)
 	len			int
 	address		int
+	line		int				// line number in the source file
+	column		int				//   and the column (from 1)
+	filename	string			//   and the source file
 	// optional comment
 	comment		*comment
 	// optional expression
 	expr		*expression
 	// optional block from keyword
 	subBlock	*subBlock
+	// inside a #pragma noopt region
+	noopt		bool
+	// a mnemonic or label written in the source (not generated by a keyword)
+	source		bool
 }
 
+const (
+	BLK_SUB = iota
+	BLK_ISR
+	BLK_NMI
+	BLK_THREAD
+)
+
 const (
 	KW_IF = iota
 	KW_ELSE
@@ -105,6 +199,7 @@ const (
 	KW_FOR
 	KW_DO
 	KW_WHILE
+	KW_TIMED
 )
 
 // Sub-block created by a keyword
@@ -113,6 +208,7 @@ type subBlock struct {
 	upDown		bool
 	startAddr	int
 	endAddr		int
+	cycles		int				// the cycles every path through a TIMED block takes
 
 	block		*codeBlock
 }
@@ -146,6 +242,9 @@ type dataBlock struct {
 	endAddr		int
 	name		string
 	nameLC		string
+	placed		bool			// at an @address
+	filename	string			// where it was defined
+	line		int
 
 	data		*data			// linked list of data entries
 	lastData	*data
@@ -160,8 +259,15 @@ type data struct {
 	string		string
 	len			int
 	address		int
+	symbol		string		// name of a subroutine or data block resolved after parsing
+	count		int			// how many times the value is repeated, e.g. [256] 0
+	label		string		// name of the address of the next entry
+	line		int			//   and where it was defined
+	bytes		[]uint8		// contents of an #incbin file
 }
 const DSTRING = -1 // size of data when the value is a string
+const DLABEL = -2 // size of data when the entry is only a label
+const DBINARY = -3 // size of data when the value is from #incbin (the string is the filename)
 
 
 /*
@@ -170,9 +276,38 @@ const DSTRING = -1 // size of data when the value is a string
  *  -flags input1[ input2 ... inputN]
  */
 func Assemble() {
+	// aCCemble disasm ... runs the disassembler instead
+	if (len(os.Args) > 1) && (os.Args[1] == "disasm") {
+		disassembleCommand(os.Args[2:])
+		return
+	}
+
+	// aCCemble fmt ... formats the source instead
+	if (len(os.Args) > 1) && (os.Args[1] == "fmt") {
+		formatCommand(os.Args[2:])
+		return
+	}
+
+	// aCCemble lsp ... runs the language server instead
+	if (len(os.Args) > 1) && (os.Args[1] == "lsp") {
+		lspCommand(os.Args[2:])
+		return
+	}
+
 	// Parse the flags
 	oflag := flag.String("o", "", "filename of the compiled code")
 	lflag := flag.String("l", "", "filename of the compiled listing")
+	sflag := flag.String("s", "", "filename of the symbol file (none if not specified)")
+	gflag := flag.String("g", "", "filename of the debug info, as JSON, or as ca65 if it ends in .dbg (none if not specified)")
+	optFlag := flag.Bool("O", false, "run the peephole optimizer")
+	widenFlag := flag.Bool("widen", false, "widen instructions that would truncate a register, instead of warning")
+	cpuFlag := flag.String("cpu", "65c24t8", "target CPU (6502, 65c02, w65c02, 65c2402, or 65c24t8)")
+	verifyFlag := flag.Bool("verify", false, "decode every instruction again and fail on any mismatch")
+	pruneFlag := flag.Bool("prune", false, "drop the SUBs and DATA that can't be reached")
+	var warnFlags warningFlags
+	flag.Var(&warnFlags, "W", "turn a warning on (name), off (no-name), or into an error (error=name), or all, or error")
+	var includeDirs includeFlags
+	flag.Var(&includeDirs, "I", "a folder to search for #include and #incbin files (after the folder of the file)")
 
 	flag.Parse()
 
@@ -183,6 +318,25 @@ func Assemble() {
 		return
 	}
 
+	// The target CPU
+	cpu, err := lookupCPU(*cpuFlag)
+	if (err != nil) {
+		fmt.Printf("ERROR: %v\n", err);
+		return
+	}
+
+	// The parser, with the -W flags checked before any file is created
+	p := newParser(cpu)
+	p.optimize = *optFlag
+	p.widen = *widenFlag
+	p.verify = *verifyFlag
+	p.includePaths = includeDirs
+	err = p.setWarnings(warnFlags)
+	if err != nil {
+		fmt.Printf("ERROR: %v\n", err);
+		return
+	}
+
 	// Generate the output name from the first filename (if not specified)
 	outname := *oflag
 	if outname == "" {
@@ -235,9 +389,34 @@ func Assemble() {
 		return
 	}
 
+	// -prune parses every file once to find what can't be reached, then again without it
+	var pruned []prunedBlock
+	if (*pruneFlag) {
+		first := newParser(cpu)
+		first.optimize = *optFlag
+		first.widen = *widenFlag
+		first.quiet = true
+		first.includePaths = includeDirs
+		for i := range files {
+			err = first.parseFile(filenames[i], files[i])
+			if err != nil {
+				break		// the error is printed when parsed again, without -prune
+			}
+		}
+		if (err == nil) {
+			pruned, err = first.findUnreachable()
+			if err != nil {
+				printSourceError(err)
+				return
+			}
+		}
+		if (pruned == nil) {
+			pruned = []prunedBlock{}
+		}
+	}
+
 	// Parse each file
-	var p parser
-	p.abWidth = A24				// default is 24-bit addresses
+	p.pruned = pruned
 	for i := range files { 
 		err := p.parseFile(filenames[i], files[i])
 		if err != nil {
@@ -248,15 +427,57 @@ func Assemble() {
 	// Output the machine code and listing
 	err = p.generateCode(out, listing)
 	if err != nil {
-		fmt.Printf("ERROR: %v\n", err);
+		printSourceError(err)
 		return
 	}
 
+	// Output the symbols
+	if (*sflag != "") {
+		fmt.Printf("CREATE %s\n", *sflag)
+		symbols, err := os.Create(*sflag)
+		if err != nil {
+			fmt.Printf("ERROR: %v\n", err);
+			return
+		}
+		p.outputSymbols(symbols)
+		symbols.Close()
+	}
+
+	// Output the debug info
+	if (*gflag != "") {
+		fmt.Printf("CREATE %s\n", *gflag)
+		debug, err := os.Create(*gflag)
+		if err != nil {
+			fmt.Printf("ERROR: %v\n", err);
+			return
+		}
+		if (strings.HasSuffix(strings.ToLower(*gflag), ".dbg")) {
+			p.outputDebugCA65(debug, outname)
+		} else {
+			p.outputDebugJSON(debug, outname)
+		}
+		debug.Close()
+	}
+
 	fmt.Printf("ASSEMBLY COMPLETE\n")
 	defer listing.Close()
 	defer out.Close()
 }
 
+/*
+ *  A parser with the default settings
+ */
+func newParser(cpu int) *parser {
+	p := new(parser)
+	p.abWidth = A24				// default is 24-bit addresses
+	p.cpu = cpu
+	p.regBase = REGISTER_BASE
+	p.regCount = REGISTER_COUNT
+	p.paramBase = PARAM_BASE
+	p.paramStride = PARAM_STRIDE
+	return p
+}
+
 /*
  *  Read the whole file into memory
  */
@@ -0,0 +1,212 @@
+package aCCembler
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Target CPUs (each one a superset of the one before, except that the 65C2402
+// doesn't have the WDC bit instructions, as their opcodes are its prefix codes)
+const (
+	CPU_6502 = iota
+	CPU_65C02
+	CPU_W65C02
+	CPU_65C2402
+	CPU_65C24T8
+)
+
+// Names of the target CPUs, for -cpu and #cpu
+var cpuNames = []string {
+	"6502",
+	"65c02",
+	"w65c02",
+	"65c2402",
+	"65c24t8",
+}
+
+// Mnemonics added on the 65C02
+var cpuMnemonics65C02 = map[string]bool {
+	"bra": true, "phx": true, "phy": true, "plx": true, "ply": true,
+	"stz": true, "trb": true, "tsb": true,
+}
+
+// Mnemonics added on the WDC W65C02S (and Rockwell R65C02)
+var cpuMnemonicsW65C02 = map[string]bool {
+	"rmb0": true, "rmb1": true, "rmb2": true, "rmb3": true, "rmb4": true, "rmb5": true, "rmb6": true, "rmb7": true,
+	"smb0": true, "smb1": true, "smb2": true, "smb3": true, "smb4": true, "smb5": true, "smb6": true, "smb7": true,
+	"bbr0": true, "bbr1": true, "bbr2": true, "bbr3": true, "bbr4": true, "bbr5": true, "bbr6": true, "bbr7": true,
+	"bbs0": true, "bbs1": true, "bbs2": true, "bbs3": true, "bbs4": true, "bbs5": true, "bbs6": true, "bbs7": true,
+	"wai": true, "stp": true,
+}
+
+// Mnemonics added on the 65C2402
+var cpuMnemonics65C2402 = map[string]bool {
+	"cpu": true, "a24": true, "r16": true, "r24": true, "w16": true, "w24": true,
+	"sws": true, "sl8": true, "sr8": true, "adx": true, "ady": true, "axy": true,
+	"xsl": true, "ysl": true,
+}
+
+// Mnemonics added on the 65C24T8
+var cpuMnemonics65C24T8 = map[string]bool {
+	"thr": true, "thw": true, "thy": true, "thi": true,
+	"tta": true, "tat": true, "tts": true, "tst": true,
+}
+
+
+/*
+ *  Lookup the target CPU by name, e.g. 65c02
+ */
+func lookupCPU(name string) (int, error) {
+	nameLC := strings.ToLower(name)
+	for cpu := range cpuNames {
+		if (nameLC == cpuNames[cpu]) {
+			return cpu, nil
+		}
+	}
+
+	return 0, fmt.Errorf("unknown CPU '%s', must be one of %s", name, strings.Join(cpuNames, ", "))
+}
+
+/*
+ *  Explain the CPU in a string
+ */
+func cpuStr(cpu int) string {
+	return strings.ToUpper(cpuNames[cpu])
+}
+
+/*
+ *  Parse the #cpu directive, e.g. #cpu 65c02
+ *  (from then on, the opcodes are checked against that CPU)
+ */
+func (p *parser) parseCPU() error {
+	// The name starts with a digit, e.g. 6502, so isn't an AZ_az_09 token
+	p.skipWhitespace()
+	start := p.i
+	for (p.i < p.end) && (((p.b[p.i] >= '0') && (p.b[p.i] <= '9')) ||
+			((p.b[p.i] >= 'A') && (p.b[p.i] <= 'Z')) || ((p.b[p.i] >= 'a') && (p.b[p.i] <= 'z'))) {
+		p.i += 1
+	}
+	name := string(p.b[start:p.i])
+	if (name == "") {
+		return fmt.Errorf("#cpu is missing the name of the CPU, e.g. #cpu 65c02")
+	}
+
+	cpu, err := lookupCPU(name)
+	if (err != nil) {
+		return err
+	}
+	p.cpu = cpu
+
+	p.skipWhitespaceAndEOL()
+	return nil
+}
+
+/*
+ *  The oldest CPU that has the opcode
+ */
+func opcodeCPU(name string, addressMode int, prefix int) int {
+	if (cpuMnemonics65C24T8[name]) {
+		return CPU_65C24T8
+	}
+	if (cpuMnemonicsW65C02[name]) {
+		return CPU_W65C02
+	}
+	if (cpuMnemonics65C2402[name]) || (prefix != A16) {
+		return CPU_65C2402
+	}
+	switch (addressMode) {
+	case modeX, modeXY:
+		return CPU_65C2402
+	case modeIndirectZeroPage, modeIndirect:
+		if (name == "jsr") {
+			return CPU_65C2402
+		}
+	}
+
+	if (cpuMnemonics65C02[name]) {
+		return CPU_65C02
+	}
+	switch (addressMode) {
+	case modeIndirectZeroPage, modeAbsoluteIndexedIndirectX:
+		return CPU_65C02
+	case modeImplicit:
+		if (name == "inc") || (name == "dec") {
+			return CPU_65C02
+		}
+	case modeImmediate, modeZeroPageX, modeAbsoluteX:
+		if (name == "bit") {
+			return CPU_65C02
+		}
+	}
+
+	return CPU_6502
+}
+
+/*
+ *  Check that the target CPU has the opcode of the instruction
+ */
+func (p *parser) checkInstructionCPU(i *instruction) error {
+	name := mnemonics[i.mnemonic].name
+	cpu := opcodeCPU(name, i.addressMode, i.prefix)
+	if (cpu == CPU_W65C02) && (p.cpu != CPU_W65C02) {
+		return fmt.Errorf("%s needs the %s, but the target CPU is the %s", strings.ToUpper(name), cpuStr(cpu), cpuStr(p.cpu))
+	} else if (cpu <= p.cpu) {
+		return nil
+	}
+
+	if (cpu == CPU_65C2402) && (i.prefix != A16) && !cpuMnemonics65C2402[name] {
+		return fmt.Errorf("%s %s needs the %s prefix code $%02X, but the target CPU is the %s",
+			strings.ToUpper(name), widthStr(i.prefix), cpuStr(cpu), i.prefix, cpuStr(p.cpu))
+	} else if (cpuMnemonics65C02[name]) || (cpuMnemonics65C2402[name]) || (cpuMnemonics65C24T8[name]) {
+		return fmt.Errorf("%s needs the %s, but the target CPU is the %s", strings.ToUpper(name), cpuStr(cpu), cpuStr(p.cpu))
+	}
+	return fmt.Errorf("%s %s needs the %s, but the target CPU is the %s",
+		strings.ToUpper(name), strings.Replace(addressModeStr(i.addressMode), "mmm ", "", 1), cpuStr(cpu), cpuStr(p.cpu))
+}
+
+/*
+ *  Check every instruction in the block (and any sub-blocks) against the target CPU
+ *  (catching any generated code that the target doesn't have)
+ */
+func (p *parser) checkBlockCPU(b *codeBlock) error {
+	for i := b.instr; i != nil; i = i.next {
+		if (i.subBlock != nil) {
+			err := p.checkBlockCPU(i.subBlock.block)
+			if (err != nil) {
+				return err
+			}
+			continue
+		}
+		if (i.mnemonic == 0) || (i.comment != nil) {
+			continue
+		}
+
+		err := p.checkInstructionCPU(i)
+		if (err != nil) {
+			return &sourceError{i.filename, i.line, err}
+		}
+	}
+
+	return nil
+}
+
+/*
+ *  Check that the target CPU has a feature, e.g. THREAD needs the 65C24T8
+ */
+func (p *parser) requireCPU(cpu int, feature string) error {
+	if (cpu > p.cpu) {
+		return fmt.Errorf("%s needs the %s, but the target CPU is the %s", feature, cpuStr(cpu), cpuStr(p.cpu))
+	}
+	return nil
+}
+
+/*
+ *  Branch always, as BRA on the 65C02 and later, else as JMP
+ *  (relaxBranches widens the JMP if the label is past $FFFF)
+ */
+func (p *parser) addBranchAlways(label string) *instruction {
+	if (p.cpu >= CPU_65C02) {
+		return p.addExprInstructionWithSymbol("bra", modeRelative, A16, 0, label, false)
+	}
+	return p.addExprInstructionWithSymbol("jmp", modeAbsolute, A16, 0, label, false)
+}
@@ -0,0 +1,336 @@
+package aCCembler
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Base cycles of each 65C02 opcode (a branch is 2 when not taken, plus 1 when taken)
+var opcodeCycles = [256]int {
+//	 x0 x1 x2 x3 x4 x5 x6 x7 x8 x9 xA xB xC xD xE xF
+	 7, 6, 0, 0, 5, 3, 5, 5, 3, 2, 2, 0, 6, 4, 6, 5, // 0x
+	 2, 5, 5, 0, 5, 4, 6, 5, 2, 4, 2, 0, 6, 4, 6, 5, // 1x
+	 6, 6, 0, 0, 3, 3, 5, 5, 4, 2, 2, 0, 4, 4, 6, 5, // 2x
+	 2, 5, 5, 0, 4, 4, 6, 5, 2, 4, 2, 0, 4, 4, 6, 5, // 3x
+	 6, 6, 0, 0, 0, 3, 5, 5, 3, 2, 2, 0, 3, 4, 6, 5, // 4x
+	 2, 5, 5, 0, 0, 4, 6, 5, 2, 4, 3, 0, 0, 4, 6, 5, // 5x
+	 6, 6, 0, 0, 3, 3, 5, 5, 4, 2, 2, 0, 6, 4, 6, 5, // 6x
+	 2, 5, 5, 0, 4, 4, 6, 5, 2, 4, 4, 0, 6, 4, 6, 5, // 7x
+	 2, 6, 0, 0, 3, 3, 3, 5, 2, 2, 2, 0, 4, 4, 4, 5, // 8x
+	 2, 6, 5, 0, 4, 4, 4, 5, 2, 5, 2, 0, 4, 5, 5, 5, // 9x
+	 2, 6, 2, 0, 3, 3, 3, 5, 2, 2, 2, 0, 4, 4, 4, 5, // Ax
+	 2, 5, 5, 0, 4, 4, 4, 5, 2, 4, 2, 0, 4, 4, 4, 5, // Bx
+	 2, 6, 0, 0, 3, 3, 5, 5, 2, 2, 2, 3, 4, 4, 6, 5, // Cx
+	 2, 5, 5, 0, 0, 4, 6, 5, 2, 4, 3, 3, 0, 4, 7, 5, // Dx
+	 2, 6, 0, 0, 3, 3, 5, 5, 2, 2, 2, 0, 4, 4, 6, 5, // Ex
+	 2, 5, 5, 0, 0, 4, 6, 5, 2, 4, 4, 0, 0, 4, 7, 5, // Fx
+}
+
+// Instructions that only write memory, and that read, modify, then write it
+var cycleStores = map[string]bool {
+	"sta": true, "stx": true, "sty": true, "stz": true,
+}
+var cycleReadModifyWrites = map[string]bool {
+	"asl": true, "lsr": true, "rol": true, "ror": true, "inc": true, "dec": true, "trb": true, "tsb": true,
+}
+
+// The cycles an instruction takes
+type cycles struct {
+	min			int				// the fewest cycles
+	max			int				//   and the most (e.g. when an index crosses a page)
+	taken		int				// the cycles when a branch is taken (0 when it isn't a branch)
+}
+
+// The cycles through a block
+type pathCycles struct {
+	min			int				// the fewest cycles, on any path to the end
+	max			int				//   and the most
+	loops		bool			// a loop was counted once
+	ends		bool			// some path reaches the end
+}
+
+
+/*
+ *  Count the cycles of an instruction (once its address and value are final)
+ */
+func (p *parser) instructionCycles(i *instruction) cycles {
+	name := mnemonics[i.mnemonic].name
+	base := opcodeCycles[i.opcode & 0xFF]
+
+	// The 65C2402 and 65C24T8 extras (timed like their closest 65C02 instruction)
+	switch {
+	case cpuMnemonics65C2402[name], cpuMnemonics65C24T8[name]:
+		base = 2
+		if (name == "thi") {
+			base = opcodeCycles[0x4C] // like JMP
+		}
+	case (i.addressMode == modeX) || (i.addressMode == modeXY):
+		// The address is in the register(s), so like the absolute address mode
+		if o, found := lookupOpcode(i.mnemonic, modeAbsolute, A16); found {
+			base = opcodeCycles[o.opcode]
+		}
+	case (name == "jsr") && (i.addressMode != modeAbsolute):
+		base = opcodeCycles[0x6C] + 3 // JMP (abs) plus pushing the return address
+	}
+
+	// The 6502 is a cycle faster for JMP (abs), but always takes the extra cycle for the shifts of abs,X
+	if (p.cpu == CPU_6502) {
+		if (name == "jmp") && (i.addressMode == modeIndirect) {
+			base = 5
+		} else if (i.addressMode == modeAbsoluteX) && cycleReadModifyWrites[name] && (name != "trb") && (name != "tsb") {
+			base = 7
+		}
+	}
+
+	// The prefix code, the third byte of a 24-bit address, and the bytes of a wider register
+	if (i.prefix != A16) {
+		base += 1
+		if (i.prefix & A48 == A24) && (i.addressMode != modeImplicit) && (i.addressMode != modeImmediate) {
+			base += 1
+			switch (i.addressMode) {
+			case modeIndirect, modeIndexedIndirectX, modeIndirectIndexedY, modeIndirectZeroPage, modeAbsoluteIndexedIndirectX:
+				base += 1 // and the third byte of the pointer
+			}
+		}
+		extra := prefixToWidth(i.prefix)/8 - 1
+		switch {
+		case (i.addressMode == modeImplicit) && ((name == "pha") || (name == "phx") || (name == "phy") ||
+				(name == "pla") || (name == "plx") || (name == "ply")):
+			base += extra
+		case (i.addressMode == modeImplicit) && ((name == "rts") || (name == "rti")) && (i.prefix & A48 == A24):
+			base += 1 // pulling the third byte of the address
+		case (name == "jsr") && (i.prefix & A48 == A24):
+			base += 1 // pushing the third byte of the address
+		case (i.addressMode == modeImplicit), (i.addressMode == modeRelative), (name == "jmp"), (name == "jsr"):
+		case cycleReadModifyWrites[name]:
+			base += 2 * extra
+		default:
+			base += extra
+		}
+	}
+
+	c := cycles{base, base, 0}
+
+	// Reading through an index takes a cycle more when it crosses a page
+	switch (i.addressMode) {
+	case modeAbsoluteX, modeAbsoluteY, modeIndirectIndexedY:
+		if (!cycleStores[name]) && (!cycleReadModifyWrites[name]) && (name != "jmp") {
+			c.max += 1
+		} else if (p.cpu != CPU_6502) && (i.addressMode == modeAbsoluteX) &&
+				((name == "asl") || (name == "lsr") || (name == "rol") || (name == "ror")) {
+			c.max += 1
+		}
+	}
+
+	// A branch takes a cycle more when taken, and another when it lands in a different page
+	if (i.addressMode == modeRelative) || (i.addressMode == modeZeroPageRelative) {
+		c.taken = c.min + 1
+		if (branchCrossesPage(i)) {
+			c.taken += 1
+		}
+		if (name == "bra") {
+			c.min, c.max = c.taken, c.taken // always taken
+		}
+	}
+
+	return c
+}
+
+/*
+ *  Does the branch land in a different page than the instruction after it?
+ */
+func branchCrossesPage(i *instruction) bool {
+	next := i.address + i.len
+	return ((next + i.value) >> 8) != (next >> 8)
+}
+
+/*
+ *  Explain the cycles in a string, e.g. 4, 4-5 (crossing a page), or 2/3 (a branch not taken/taken)
+ */
+func (c cycles) String() string {
+	if (c.taken != 0) && (c.taken != c.min) {
+		return fmt.Sprintf("%d/%d", c.min, c.taken)
+	} else if (c.min != c.max) {
+		return fmt.Sprintf("%d-%d", c.min, c.max)
+	}
+	return fmt.Sprintf("%d", c.min)
+}
+func (pc pathCycles) String() string {
+	if (pc.min != pc.max) {
+		return fmt.Sprintf("%d-%d", pc.min, pc.max)
+	}
+	return fmt.Sprintf("%d", pc.min)
+}
+
+
+/*
+ *  Count the fewest and most cycles through the instructions, from the first one to the end
+ *  (a TIMED block has to end at endAddr, without looping, calling anything without a fixed time,
+ *  or leaving, else it is an error; otherwise each loop is counted once, and not the JSRs)
+ */
+func (p *parser) countCycles(items []peepItem, endAddr int, timed string) (pathCycles, error) {
+	n := len(items)
+	index := make(map[int]int)
+	for k := n-1; k >= 0; k-- {
+		index[items[k].i.address] = k
+	}
+
+	// Where an address is in the instructions (n is the end), else -1
+	target := func(address int) int {
+		if to, found := index[address]; found {
+			return to
+		} else if (address == endAddr) {
+			return n
+		}
+		return -1
+	}
+
+	// The fewest and most cycles to reach each instruction (n is the end), in order, as loops aren't followed
+	reached := make([]bool, n+1)
+	minAt := make([]int, n+1)
+	maxAt := make([]int, n+1)
+	reached[0] = true
+	var pc pathCycles
+
+	end := func(lo int, hi int) {
+		if (!pc.ends) || (lo < pc.min) {
+			pc.min = lo
+		}
+		if (!pc.ends) || (hi > pc.max) {
+			pc.max = hi
+		}
+		pc.ends = true
+	}
+	edge := func(k int, to int, lo int, hi int) error {
+		i := items[k].i
+		if (to < 0) {
+			if (timed != "") {
+				return i.errorf("TIMED %s can't be timed, as %s leaves the block", timed, strings.ToUpper(mnemonics[i.mnemonic].name))
+			}
+			end(minAt[k] + lo, maxAt[k] + hi)
+			return nil
+		}
+		if (to <= k) {
+			if (timed != "") {
+				return i.errorf("TIMED %s can't be timed, as it loops", timed)
+			}
+			pc.loops = true
+			return nil
+		}
+		if (!reached[to]) || (minAt[k] + lo < minAt[to]) {
+			minAt[to] = minAt[k] + lo
+		}
+		if (!reached[to]) || (maxAt[k] + hi > maxAt[to]) {
+			maxAt[to] = maxAt[k] + hi
+		}
+		reached[to] = true
+		return nil
+	}
+
+	for k := 0; k < n; k++ {
+		i := items[k].i
+		if (!reached[k]) {
+			continue
+		}
+		if (i.mnemonic == 0) {
+			edge(k, k+1, 0, 0)
+			continue
+		}
+
+		c := p.instructionCycles(i)
+		name := mnemonics[i.mnemonic].name
+		var err error
+		switch {
+		case (i.addressMode == modeRelative) || (i.addressMode == modeZeroPageRelative):
+			if (timed != "") && (branchCrossesPage(i)) {
+				p.warning(WARN_TIMING, i.line, fmt.Sprintf("%s in TIMED %s crosses a page, so it takes %d cycles when taken", strings.ToUpper(name), timed, c.taken))
+			}
+			err = edge(k, target(i.address + i.len + i.value), c.taken, c.taken)
+			if (err == nil) && (name != "bra") {
+				err = edge(k, k+1, c.min, c.max)
+			}
+		case (name == "jmp") && (i.addressMode == modeAbsolute):
+			err = edge(k, target(i.value), c.min, c.max)
+		case (name == "jsr") && (timed != ""):
+			// Calling a SUB with a fixed time
+			callee := p.lookupSubroutineAt(i.value)
+			if (callee == nil) || (i.addressMode != modeAbsolute) {
+				return pc, i.errorf("TIMED %s can't be timed, as the JSR isn't to a SUB", timed)
+			}
+			called, _ := p.countCycles(flattenCodeBlock(callee, nil), callee.endAddr, "")
+			if (!called.ends) || (called.loops) || (called.min != called.max) {
+				return pc, i.errorf("TIMED %s can't be timed, as SUB %s doesn't take a fixed time", timed, callee.name)
+			}
+			err = edge(k, k+1, c.min + called.min, c.max + called.max)
+		case (name == "rts"), (name == "rti"), (name == "brk"), (name == "stp"), (name == "thr"), (name == "jmp"):
+			err = edge(k, -1, c.min, c.max)
+		default:
+			err = edge(k, k+1, c.min, c.max)
+		}
+		if (err != nil) {
+			return pc, err
+		}
+	}
+	if (reached[n]) {
+		end(minAt[n], maxAt[n])
+	}
+
+	return pc, nil
+}
+
+/*
+ *  Lookup the top-level block that starts at the address
+ */
+func (p *parser) lookupSubroutineAt(address int) *codeBlock {
+	for b := p.code; b != nil; b = b.next {
+		if (b.startAddr == address) {
+			return b
+		}
+	}
+	return nil
+}
+
+/*
+ *  Check that every path through each TIMED block takes exactly its cycles
+ */
+func (p *parser) checkTimedBlocks(b *codeBlock) error {
+	for i := b.instr; i != nil; i = i.next {
+		if (i.subBlock == nil) {
+			continue
+		}
+		sub := i.subBlock
+		if (sub.keyword == KW_TIMED) {
+			pc, err := p.countCycles(flattenCodeBlock(sub.block, nil), sub.block.endAddr, sub.block.name)
+			if (err != nil) {
+				return err
+			} else if (!pc.ends) {
+				return i.errorf("TIMED %s never reaches its end", sub.block.name)
+			} else if (pc.min != sub.cycles) || (pc.max != sub.cycles) {
+				return i.errorf("TIMED %s takes %s cycles, not %d", sub.block.name, pc, sub.cycles)
+			}
+		}
+		err := p.checkTimedBlocks(sub.block)
+		if (err != nil) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+/*
+ *  List the fewest and most cycles through a SUB, ISR, NMI, or THREAD
+ */
+func (p *parser) outputBlockCycles(b *codeBlock, listing *os.File) {
+	pc, _ := p.countCycles(flattenCodeBlock(b, nil), b.endAddr, "")
+	line := fmt.Sprintf("%06x ; %s %s takes %s cycles", b.endAddr, strings.ToUpper(blockKindStr(b.kind)), b.name, pc)
+	if (!pc.ends) {
+		line = fmt.Sprintf("%06x ; %s %s never ends", b.endAddr, strings.ToUpper(blockKindStr(b.kind)), b.name)
+	} else if (pc.loops) {
+		line += " (going around each loop once, not counting JSRs)"
+	} else {
+		line += " (not counting JSRs)"
+	}
+	listing.WriteString(line + "\n")
+}
@@ -0,0 +1,244 @@
+package aCCembler
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// The debug info, written by -g as JSON
+type debugInfo struct {
+	Version		int				`json:"version"`
+	CPU			string			`json:"cpu"`
+	Output		string			`json:"output"`		// the file of machine code
+	Base		int				`json:"base"`		//   and the address of its first byte
+	Files		[]string		`json:"files"`
+	Blocks		[]debugBlock	`json:"blocks"`
+	Lines		[]debugLine		`json:"lines"`
+	Symbols		[]debugSymbol	`json:"symbols"`
+}
+
+// A SUB, ISR, NMI, THREAD, or DATA block
+type debugBlock struct {
+	Kind		string			`json:"kind"`
+	Name		string			`json:"name"`
+	Start		int				`json:"start"`
+	End			int				`json:"end"`			// the address after its last byte
+	File		int				`json:"file"`		// index into files
+	Line		int				`json:"line"`
+}
+
+// Where the bytes of an instruction came from (the line of the keyword for the code it generates)
+type debugLine struct {
+	Address		int				`json:"address"`
+	Size		int				`json:"size"`
+	File		int				`json:"file"`		// index into files
+	Line		int				`json:"line"`		// from 1
+	Column		int				`json:"column"`		// from 1
+}
+
+// A CONST, GLOBAL, REG, SUB, ISR, NMI, THREAD, DATA, or label
+type debugSymbol struct {
+	Name		string			`json:"name"`
+	Kind		string			`json:"kind"`
+	Value		int				`json:"value"`		// the address (or the value of a CONST)
+}
+
+const DEBUG_VERSION = 1
+
+
+/*
+ *  Collect the debug info of the code, then the data
+ */
+func (p *parser) collectDebugInfo(outname string) *debugInfo {
+	info := &debugInfo{DEBUG_VERSION, cpuStr(p.cpu), outname, 0, []string{}, []debugBlock{}, []debugLine{}, []debugSymbol{}}
+	files := make(map[string]int)
+	file := func(filename string) int {
+		k, ok := files[filename]
+		if (!ok) {
+			k = len(info.Files)
+			files[filename] = k
+			info.Files = append(info.Files, filename)
+		}
+		return k
+	}
+
+	// The output starts at the first block of code (or of data if there is no code)
+	if (p.code != nil) {
+		info.Base = p.code.startAddr
+	} else if (p.data != nil) {
+		info.Base = p.data.startAddr
+	}
+
+	for b := p.code; b != nil; b = b.next {
+		kind := strings.ToUpper(blockKindStr(b.kind))
+		info.Blocks = append(info.Blocks, debugBlock{kind, b.name, b.startAddr, b.endAddr, file(b.filename), b.line})
+		info.Symbols = append(info.Symbols, debugSymbol{b.name, kind, b.startAddr})
+		for _, it := range flattenCodeBlock(b, nil) {
+			i := it.i
+			if (i.mnemonic == 0) {
+				if (i.source) {
+					info.Symbols = append(info.Symbols, debugSymbol{i.symbol, "LABEL", i.address})
+				}
+				continue
+			}
+			if (i.len == 0) {
+				continue
+			}
+			info.Lines = append(info.Lines, debugLine{i.address, i.len, file(i.filename), i.line, i.column})
+		}
+	}
+	for d := p.data; d != nil; d = d.next {
+		info.Blocks = append(info.Blocks, debugBlock{"DATA", d.name, d.startAddr, d.endAddr, file(d.filename), d.line})
+		info.Symbols = append(info.Symbols, debugSymbol{d.name, "DATA", d.startAddr})
+		for e := d.data; e != nil; e = e.next {
+			if (e.size == DLABEL) {
+				info.Symbols = append(info.Symbols, debugSymbol{e.label, "LABEL", e.address})
+			}
+		}
+	}
+	for c := p.cnst; c != nil; c = c.next {
+		info.Symbols = append(info.Symbols, debugSymbol{c.name, "CONST", c.value})
+	}
+	for v := p.global; v != nil; v = v.next {
+		info.Symbols = append(info.Symbols, debugSymbol{v.name, "GLOBAL", v.address})
+	}
+	for r := p.reg; r != nil; r = r.next {
+		info.Symbols = append(info.Symbols, debugSymbol{r.name, "REG", r.address})
+	}
+
+	return info
+}
+
+/*
+ *  Write the debug info as JSON, with one line, block, or symbol per line of the file
+ */
+func (p *parser) outputDebugJSON(debug *os.File, outname string) {
+	info := p.collectDebugInfo(outname)
+
+	header, _ := json.Marshal(info.Files)
+	debug.WriteString(fmt.Sprintf("{\n\"version\": %d,\n\"cpu\": \"%s\",\n\"output\": %q,\n\"base\": %d,\n\"files\": %s,\n",
+		info.Version, info.CPU, info.Output, info.Base, header))
+
+	writeArray := func(name string, n int, entry func(k int) interface{}, last bool) {
+		debug.WriteString(fmt.Sprintf("\"%s\": [", name))
+		for k := 0; k < n; k++ {
+			e, _ := json.Marshal(entry(k))
+			if (k > 0) {
+				debug.WriteString(",")
+			}
+			debug.WriteString("\n  " + string(e))
+		}
+		if (last) {
+			debug.WriteString("\n]\n")
+		} else {
+			debug.WriteString("\n],\n")
+		}
+	}
+	writeArray("blocks", len(info.Blocks), func(k int) interface{} { return info.Blocks[k] }, false)
+	writeArray("lines", len(info.Lines), func(k int) interface{} { return info.Lines[k] }, false)
+	writeArray("symbols", len(info.Symbols), func(k int) interface{} { return info.Symbols[k] }, true)
+	debug.WriteString("}\n")
+}
+
+/*
+ *  Write the debug info in the format of the ca65 .dbg file (version 2.0), i.e. one segment
+ *  per block, one span and line per instruction (and per DATA block), and a label per SUB, DATA, and label
+ */
+func (p *parser) outputDebugCA65(debug *os.File, outname string) {
+	info := p.collectDebugInfo(outname)
+
+	// A DATA block is one span, on the line of its name
+	lines := info.Lines
+	for _, b := range info.Blocks {
+		if (b.Kind == "DATA") {
+			lines = append(lines, debugLine{b.Start, b.End - b.Start, b.File, b.Line, 1})
+		}
+	}
+
+	// The symbols with an address (not CONSTs, GLOBALs, or REGs)
+	labels := []debugSymbol{}
+	for _, s := range info.Symbols {
+		if (s.Kind != "CONST") && (s.Kind != "GLOBAL") && (s.Kind != "REG") {
+			labels = append(labels, s)
+		}
+	}
+
+	size := 0
+	for _, b := range info.Blocks {
+		size += b.End - b.Start
+	}
+	module := outname
+	if (len(info.Files) > 0) {
+		module = info.Files[0]
+	}
+
+	debug.WriteString("version\tmajor=2,minor=0\n")
+	debug.WriteString(fmt.Sprintf("info\tcsym=0,file=%d,lib=0,line=%d,mod=1,scope=1,seg=%d,span=%d,sym=%d,type=0\n",
+		len(info.Files), len(lines), len(info.Blocks), len(lines), len(labels)))
+	for k, f := range info.Files {
+		fileSize, mtime := int64(0), int64(0)
+		if stat, err := os.Stat(f); (err == nil) {
+			fileSize, mtime = stat.Size(), stat.ModTime().Unix()
+		}
+		debug.WriteString(fmt.Sprintf("file\tid=%d,name=%q,size=%d,mtime=0x%08X,mod=0\n", k, f, fileSize, mtime))
+	}
+	for k, l := range lines {
+		debug.WriteString(fmt.Sprintf("line\tid=%d,file=%d,line=%d,span=%d\n", k, l.File, l.Line, k))
+	}
+	debug.WriteString(fmt.Sprintf("mod\tid=0,name=%q,file=0\n", module))
+	for k, b := range info.Blocks {
+		debug.WriteString(fmt.Sprintf("seg\tid=%d,name=%q,start=0x%06X,size=0x%04X,addrsize=%s,type=rw,oname=%q,ooffs=%d\n",
+			k, b.Name, b.Start, b.End - b.Start, debugAddrSize(b.Start), outname, b.Start - info.Base))
+	}
+	for k, l := range lines {
+		s := debugBlockAt(info, l.Address)
+		debug.WriteString(fmt.Sprintf("span\tid=%d,seg=%d,start=%d,size=%d\n", k, s, l.Address - info.Blocks[s].Start, l.Size))
+	}
+	debug.WriteString(fmt.Sprintf("scope\tid=0,name=\"\",mod=0,size=%d\n", size))
+	for k, s := range labels {
+		debug.WriteString(fmt.Sprintf("sym\tid=%d,name=%q,addrsize=%s,scope=0,def=%d,val=0x%06X,seg=%d,type=lab\n",
+			k, s.Name, debugAddrSize(s.Value), debugLineAt(lines, s.Value), s.Value, debugBlockAt(info, s.Value)))
+	}
+}
+
+/*
+ *  The index of the block holding the address
+ */
+func debugBlockAt(info *debugInfo, address int) int {
+	for k, b := range info.Blocks {
+		if (address >= b.Start) && (address < b.End) {
+			return k
+		}
+	}
+	return 0
+}
+
+/*
+ *  The id of the line holding the address, i.e. where a label is defined
+ *  (or the next one after it, for a label at the end of a block)
+ */
+func debugLineAt(lines []debugLine, address int) int {
+	for k, l := range lines {
+		if (address >= l.Address) && (address < l.Address + l.Size) {
+			return k
+		}
+	}
+	for k, l := range lines {
+		if (l.Address >= address) {
+			return k
+		}
+	}
+	return 0
+}
+
+/*
+ *  The ca65 address size of the address
+ */
+func debugAddrSize(address int) string {
+	if (address > 0xFFFF) {
+		return "far"
+	}
+	return "absolute"
+}
@@ -0,0 +1,660 @@
+package aCCembler
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The prefix codes that can start an instruction on the 65C2402
+var disasmPrefixes = []int { A24, R16, R24, W16, W24 }
+
+// An opcode of the target CPU, looked up by (prefix << 8) | opcode
+type disasmOpcode struct {
+	mnemonic	int				// index into mnemonics
+	op			opcode
+	zeroPageY	bool			// STA $zz,Y assembles as this STA $00zz,Y
+}
+
+// One decoded instruction (or the bytes that aren't one)
+type disasmItem struct {
+	address		int
+	bytes		[]uint8
+	mnemonic	int				// 0 when the bytes are data
+	addressMode	int
+	prefix		int
+	value		int				// the operand (the offset for a branch)
+	zeroPage	int				// the zero page address of BBRn/BBSn
+	note		string			// the instruction, when it is kept as data
+}
+
+// A run of instructions (output as a SUB) or of data (output as DATA)
+type disasmSegment struct {
+	name		string
+	isCode		bool
+	items		[]*disasmItem
+	labels		map[int]string	// labels inside the segment, by address
+}
+
+// A name from the symbol file, and how good a name it is for its address
+type disasmSymbol struct {
+	name		string
+	rank		int
+}
+
+// The state of one disassembly
+type disassembler struct {
+	cpu			int
+	symbols		map[int][]string	// names from a symbol file, by address (the best first)
+	segments	[]*disasmSegment
+	names		map[int]string	// SUB, DATA, and data label names, by address
+	used		map[string]bool	// every name that is output
+	consts		map[int]string	// symbols output as a CONST, by address
+	equates		map[int][]string	// the other names at an address that is named, output as a CONST
+}
+
+
+/*
+ *  Disassemble machine code loaded at an address, for the target CPU (e.g. CPU_65C02),
+ *  into aCCembler source that assembles back into the same bytes
+ *  (the symbols, e.g. from ReadSymbolFile, can be nil)
+ */
+func Disassemble(code []uint8, address int, cpu int, symbols map[int][]string) string {
+	d := new(disassembler)
+	d.cpu = cpu
+	d.symbols = symbols
+	if (d.symbols == nil) {
+		d.symbols = make(map[int][]string)
+	}
+	d.names = make(map[int]string)
+	d.used = make(map[string]bool)
+	d.consts = make(map[int]string)
+	d.equates = make(map[int][]string)
+
+	d.split(d.decode(code, address))
+	d.nameSegments()
+	return d.output(address, len(code))
+}
+
+/*
+ *  Read a symbol file (written by aCCemble -s) into every name at each address
+ *  (a SUB, ISR, NMI, THREAD, or DATA name first, then a label, then a GLOBAL or REG,
+ *  then a CONST, which is only kept when it is past the zero page)
+ */
+func ReadSymbolFile(filename string) (map[int][]string, error) {
+	file, err := os.Open(filename)
+	if (err != nil) {
+		return nil, err
+	}
+	defer file.Close()
+
+	ranked := make(map[int][]disasmSymbol)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if (len(fields) < 3) || strings.HasPrefix(fields[0], ";") {
+			continue
+		}
+		address, err := strconv.ParseInt(fields[0], 16, 64)
+		if (err != nil) {
+			return nil, fmt.Errorf("invalid address '%s' in the symbol file %s", fields[0], filename)
+		}
+
+		// The width suffix of a GLOBAL or REG isn't part of the name
+		name := fields[2]
+		if dot := strings.Index(name, "."); (dot > 0) {
+			name = name[:dot]
+		}
+
+		r := 0
+		switch (fields[1]) {
+		case "SUB", "ISR", "NMI", "THREAD", "DATA":
+			r = 4
+		case "LABEL":
+			r = 3
+		case "GLOBAL", "REG":
+			r = 2
+		case "CONST":
+			if (address > 0xFF) {
+				r = 1
+			}
+		}
+		if (r > 0) {
+			ranked[int(address)] = append(ranked[int(address)], disasmSymbol{name, r})
+		}
+	}
+
+	// The best first (else in the order of the file)
+	symbols := make(map[int][]string)
+	for a, names := range ranked {
+		sort.SliceStable(names, func(j, k int) bool {
+			return names[j].rank > names[k].rank
+		})
+		for _, n := range names {
+			symbols[a] = append(symbols[a], n.name)
+		}
+	}
+
+	return symbols, scanner.Err()
+}
+
+
+/*
+ *  Build the opcodes of the target CPU
+ *  (where two mnemonics share an opcode, e.g. BCC and BLT, the first one in the table wins)
+ */
+func disasmTable(cpu int) map[int]disasmOpcode {
+	table := make(map[int]disasmOpcode)
+	for m := 1; m < len(mnemonics); m++ {
+		for _, o := range mnemonics[m].opcode {
+			c := opcodeCPU(mnemonics[m].name, o.mode, o.size)
+			if (c > cpu) || ((c == CPU_W65C02) && (cpu != CPU_W65C02)) {
+				continue
+			}
+			key := (o.size << 8) | o.opcode
+			prev, found := table[key]
+			if (found) {
+				// STA $zz,Y is STA $00zz,Y and JSR ($zz) is JSR ($00zz), so prefer the absolute
+				if !((prev.op.mode == modeZeroPageY) && (o.mode == modeAbsoluteY)) &&
+						!((prev.op.mode == modeIndirectZeroPage) && (o.mode == modeIndirect)) {
+					continue
+				}
+			}
+			table[key] = disasmOpcode{m, o, false}
+			if (found) && (prev.op.mode == modeZeroPageY) && (prev.op.len == o.len) {
+				table[key] = disasmOpcode{m, o, true}
+			}
+		}
+	}
+
+	return table
+}
+
+/*
+ *  Decode the bytes into instructions, and the bytes that aren't one into data
+ */
+func (d *disassembler) decode(code []uint8, address int) []*disasmItem {
+	table := disasmTable(d.cpu)
+	items := []*disasmItem{}
+
+	for k := 0; k < len(code); {
+		item, op := decodeInstruction(table, code[k:], address + k)
+		if (item.mnemonic == 0) {
+			items = append(items, item)
+			k += 1
+			continue
+		}
+
+		// An absolute address in the zero page would assemble as zero page, so keep those bytes as data
+		switch (item.addressMode) {
+		case modeAbsolute, modeAbsoluteX, modeAbsoluteY, modeIndirect, modeAbsoluteIndexedIndirectX:
+			if (item.value <= 0xFF) && !op.zeroPageY {
+				item.note = d.instructionStr(item, nil) + " (an absolute address)"
+				item.mnemonic = 0
+			}
+		}
+
+		items = append(items, item)
+		k += len(item.bytes)
+	}
+
+	return items
+}
+
+/*
+ *  Decode the instruction at the start of the bytes
+ *  (with the mnemonic 0 and just the first byte when it isn't an instruction)
+ */
+func decodeInstruction(table map[int]disasmOpcode, code []uint8, address int) (*disasmItem, disasmOpcode) {
+	item := new(disasmItem)
+	item.address = address
+
+	// A prefix code then an opcode, else just an opcode
+	op, found := disasmOpcode{}, false
+	if (len(code) > 1) && isDisasmPrefix(int(code[0])) {
+		op, found = table[(int(code[0]) << 8) | int(code[1])]
+	}
+	if (!found) {
+		op, found = table[int(code[0])]
+	}
+	if (!found) || (op.op.len > len(code)) {
+		item.bytes = code[:1]
+		return item, op
+	}
+
+	item.bytes = code[:op.op.len]
+	item.mnemonic = op.mnemonic
+	item.addressMode = op.op.mode
+	item.prefix = op.op.size
+	operand := item.bytes[1:]
+	if (item.prefix != A16) {
+		operand = item.bytes[2:]
+	}
+	if (item.addressMode == modeZeroPageRelative) {
+		item.zeroPage = int(operand[0])
+		operand = operand[1:]
+	}
+	for j := len(operand)-1; j >= 0; j-- {
+		item.value = (item.value << 8) | int(operand[j])
+	}
+	if (item.addressMode == modeRelative) || (item.addressMode == modeZeroPageRelative) {
+		bits := uint(8 * len(operand))
+		if (item.value >= 1 << (bits-1)) {
+			item.value -= 1 << bits
+		}
+	}
+
+	return item, op
+}
+
+/*
+ *  Is the byte one of the prefix codes?
+ */
+func isDisasmPrefix(b int) bool {
+	for _, prefix := range disasmPrefixes {
+		if (b == prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+ *  Split the items into runs of code and runs of data
+ */
+func (d *disassembler) split(items []*disasmItem) {
+	var s *disasmSegment
+	for _, item := range items {
+		isCode := (item.mnemonic != 0)
+		if (s == nil) || (s.isCode != isCode) {
+			s = new(disasmSegment)
+			s.isCode = isCode
+			s.labels = make(map[int]string)
+			d.segments = append(d.segments, s)
+		}
+		s.items = append(s.items, item)
+	}
+
+	// The lowest address has to be code, so if it isn't, it is all data (with the code in the comments)
+	if (len(d.segments) > 1) && (!d.segments[0].isCode) {
+		s = d.segments[0]
+		for _, code := range d.segments[1:] {
+			for _, item := range code.items {
+				if (item.mnemonic != 0) {
+					item.note = d.instructionStr(item, nil)
+					item.mnemonic = 0
+				}
+				s.items = append(s.items, item)
+			}
+		}
+		d.segments = d.segments[:1]
+	}
+}
+
+/*
+ *  Name the segments and the labels inside them
+ */
+func (d *disassembler) nameSegments() {
+	for _, s := range d.segments {
+		start := s.items[0].address
+		s.name = d.symbol(start)
+		if (s.name == "") {
+			if (s.isCode) {
+				s.name = fmt.Sprintf("code_%04x", start)
+			} else {
+				s.name = fmt.Sprintf("data_%04x", start)
+			}
+		}
+		d.use(s.name)
+		d.names[start] = s.name
+
+		// The next symbol at the start, e.g. a label, and those past the start (at an instruction or data byte)
+		for _, item := range s.items {
+			if name := d.symbol(item.address); (name != "") {
+				s.labels[item.address] = name
+				d.use(name)
+				if (!s.isCode) && (item.address != start) {
+					d.names[item.address] = name
+				}
+			}
+		}
+	}
+
+	// The targets of the branches and jumps inside the same SUB
+	for _, s := range d.segments {
+		if (!s.isCode) {
+			continue
+		}
+		for _, item := range s.items {
+			target, ok := disasmTarget(item)
+			if (ok) && (s.contains(target)) && (s.labels[target] == "") {
+				s.labels[target] = fmt.Sprintf("L_%04x", target)
+				d.use(s.labels[target])
+			}
+		}
+	}
+}
+
+/*
+ *  The best name from the symbol file at the address that isn't used yet (else "")
+ */
+func (d *disassembler) symbol(address int) string {
+	for _, name := range d.symbols[address] {
+		if (!d.used[strings.ToLower(name)]) {
+			return name
+		}
+	}
+	return ""
+}
+
+/*
+ *  Keep the other names from the symbol file at each address that is named, as equates
+ */
+func (d *disassembler) nameEquates() {
+	named := make(map[int]bool)
+	for a := range d.names {
+		named[a] = true
+	}
+	for a := range d.consts {
+		named[a] = true
+	}
+	for _, s := range d.segments {
+		for a := range s.labels {
+			named[a] = true
+		}
+	}
+	for a := range named {
+		for _, name := range d.symbols[a] {
+			if (!d.used[strings.ToLower(name)]) {
+				d.equates[a] = append(d.equates[a], name)
+				d.use(name)
+			}
+		}
+	}
+}
+
+/*
+ *  Mark a name as used (names are case insensitive)
+ */
+func (d *disassembler) use(name string) {
+	d.used[strings.ToLower(name)] = true
+}
+
+/*
+ *  The address a branch or jump goes to
+ */
+func disasmTarget(item *disasmItem) (int, bool) {
+	switch (item.addressMode) {
+	case modeRelative, modeZeroPageRelative:
+		return item.address + len(item.bytes) + item.value, true
+	case modeAbsolute:
+		name := mnemonics[item.mnemonic].name
+		if (name == "jmp") || (name == "jsr") {
+			return item.value, true
+		}
+	}
+	return 0, false
+}
+
+/*
+ *  Is the address the start of an instruction in the segment?
+ */
+func (s *disasmSegment) contains(address int) bool {
+	for _, item := range s.items {
+		if (item.address == address) {
+			return true
+		}
+	}
+	return false
+}
+
+
+/*
+ *  The name for an address in a SUB, else "" to leave it as a number
+ *  (a label inside the SUB, a SUB, DATA, or data label, or a symbol as a CONST)
+ */
+func (d *disassembler) nameOf(s *disasmSegment, address int, zeroPage bool) string {
+	if (s != nil) && (!zeroPage) {
+		if name := s.labels[address]; (name != "") {
+			return name
+		}
+		if name := d.names[address]; (name != "") {
+			return name
+		}
+	}
+	if name := d.consts[address]; (name != "") {
+		return name
+	}
+	if name := d.symbol(address); (s != nil) && (name != "") {
+		d.consts[address] = name
+		d.use(name)
+		return name
+	}
+	return ""
+}
+
+/*
+ *  The instruction as aCCembler source, with names from the segment (or none if nil)
+ */
+func (d *disassembler) instructionStr(item *disasmItem, s *disasmSegment) string {
+	str := mnemonics[item.mnemonic].name + sizeToSuffix(item.prefix)
+	digits := 4
+	if (item.value > 0xFFFF) {
+		digits = 6
+	}
+	addr := func(zeroPage bool) string {
+		if name := d.nameOf(s, item.value, zeroPage); (name != "") {
+			return name
+		} else if (zeroPage) {
+			return fmt.Sprintf("$%02x", item.value)
+		}
+		return fmt.Sprintf("$%0*x", digits, item.value)
+	}
+	branch := func() string {
+		target := item.address + len(item.bytes) + item.value
+		if (s != nil) && (s.labels[target] != "") {
+			return "+" + s.labels[target]
+		}
+		return fmt.Sprintf("%+d", item.value)
+	}
+
+	switch (item.addressMode) {
+	case modeImmediate:
+		str += fmt.Sprintf(" #$%0*x", prefixToWidth(item.prefix)/4, item.value)
+	case modeZeroPage:
+		str += " " + addr(true)
+	case modeZeroPageX:
+		str += " " + addr(true) + ",X"
+	case modeZeroPageY:
+		str += " " + addr(true) + ",Y"
+	case modeRelative:
+		str += " " + branch()
+	case modeAbsolute:
+		str += " " + addr(false)
+	case modeAbsoluteX:
+		str += " " + addr(false) + ",X"
+	case modeAbsoluteY:
+		str += " " + addr(false) + ",Y"
+	case modeIndirect:
+		str += " (" + addr(false) + ")"
+	case modeIndexedIndirectX:
+		str += " (" + addr(true) + ",X)"
+	case modeIndirectIndexedY:
+		str += " (" + addr(true) + "),Y"
+	case modeIndirectZeroPage:
+		str += " (" + addr(true) + ")"
+	case modeAbsoluteIndexedIndirectX:
+		str += " (" + addr(false) + ",X)"
+	case modeX:
+		str += " X"
+	case modeXY:
+		str += " XY"
+	case modeZeroPageRelative:
+		zp := fmt.Sprintf("$%02x", item.zeroPage)
+		if name := d.nameOf(s, item.zeroPage, true); (name != "") {
+			zp = name
+		}
+		str += " " + zp + "," + branch()
+	}
+
+	return str
+}
+
+/*
+ *  The bytes as hex, like the listing
+ */
+func disasmBytesStr(bytes []uint8) string {
+	hex := make([]string, len(bytes))
+	for j, b := range bytes {
+		hex[j] = fmt.Sprintf("%02x", b)
+	}
+	return strings.Join(hex, " ")
+}
+
+/*
+ *  Output the segments as SUB and DATA blocks
+ *  (with the address and bytes of each line in a comment, like the listing)
+ */
+func (d *disassembler) output(address int, length int) string {
+	var body strings.Builder
+	for _, s := range d.segments {
+		start := s.items[0].address
+		if (s.isCode) {
+			body.WriteString(fmt.Sprintf("\nSUB %s @$%04x {\n", s.name, start))
+			for _, item := range s.items {
+				if label := s.labels[item.address]; (label != "") {
+					body.WriteString(label + ":\n")
+				}
+				body.WriteString(fmt.Sprintf("\t%-24s; %06x  %s\n", d.instructionStr(item, s), item.address, disasmBytesStr(item.bytes)))
+			}
+		} else {
+			body.WriteString(fmt.Sprintf("\nDATA %s @$%04x {\n", s.name, start))
+			for j := 0; j < len(s.items); {
+				// Up to 8 bytes a line, with an instruction kept as data on a line by itself
+				n := 1
+				for (j+n < len(s.items)) && (n < 8) && (s.items[j].note == "") && (s.items[j+n].note == "") && (s.labels[s.items[j+n].address] == "") {
+					n += 1
+				}
+				if label := s.labels[s.items[j].address]; (label != "") {
+					body.WriteString(label + ":\n")
+				}
+				bytes := []uint8{}
+				for _, item := range s.items[j:j+n] {
+					bytes = append(bytes, item.bytes...)
+				}
+				hex := make([]string, len(bytes))
+				for k, b := range bytes {
+					hex[k] = fmt.Sprintf("$%02x", b)
+				}
+				comment := fmt.Sprintf("; %06x  %s", s.items[j].address, disasmBytesStr(bytes))
+				if (s.items[j].note != "") {
+					comment += "  " + s.items[j].note
+				}
+				body.WriteString(fmt.Sprintf("\t%-24s%s\n", strings.Join(hex, ", "), comment))
+				j += n
+			}
+		}
+		body.WriteString("}\n")
+	}
+
+	// The CONSTs were found while writing the code, but go first (with the other names at an address)
+	d.nameEquates()
+	var src strings.Builder
+	src.WriteString(fmt.Sprintf("; aCCembler disassembly of %d bytes at $%04x\n", length, address))
+	src.WriteString(fmt.Sprintf("#cpu %s\n", cpuNames[d.cpu]))
+	if (len(d.consts) > 0) || (len(d.equates) > 0) {
+		src.WriteString("\n")
+		addresses := []int{}
+		for a := range d.consts {
+			addresses = append(addresses, a)
+		}
+		for a := range d.equates {
+			if (d.consts[a] == "") {
+				addresses = append(addresses, a)
+			}
+		}
+		sort.Ints(addresses)
+		for _, a := range addresses {
+			if (d.consts[a] != "") {
+				src.WriteString(fmt.Sprintf("CONST %s = $%04x\n", d.consts[a], a))
+			}
+			for _, name := range d.equates[a] {
+				src.WriteString(fmt.Sprintf("CONST %s = $%04x\n", name, a))
+			}
+		}
+	}
+	src.WriteString(body.String())
+
+	return src.String()
+}
+
+
+/*
+ *  aCCemble disasm [-cpu target] [-a address] [-s symbols] [-o file.ac] file.bin
+ */
+func disassembleCommand(args []string) {
+	flags := flag.NewFlagSet("disasm", flag.ExitOnError)
+	oflag := flags.String("o", "", "filename of the disassembled source")
+	aflag := flags.String("a", "$0000", "load address of the machine code")
+	sflag := flags.String("s", "", "filename of a symbol file (from aCCemble -s)")
+	cpuFlag := flags.String("cpu", "65c24t8", "target CPU (6502, 65c02, w65c02, 65c2402, or 65c24t8)")
+	flags.Parse(args)
+
+	filename := flags.Arg(0)
+	if filename == "" {
+		fmt.Printf("ERROR: No file was specified\n");
+		return
+	}
+	cpu, err := lookupCPU(*cpuFlag)
+	if (err != nil) {
+		fmt.Printf("ERROR: %v\n", err);
+		return
+	}
+	address, err := strconv.ParseInt(strings.Replace(strings.TrimPrefix(*aflag, "$"), "0x", "", 1), 16, 32)
+	if (err != nil) {
+		fmt.Printf("ERROR: invalid load address '%s', e.g. -a $1000\n", *aflag);
+		return
+	}
+
+	// Generate the output name from the filename (if not specified)
+	outname := *oflag
+	if outname == "" {
+		dot := strings.LastIndex(filename, ".")
+		if (dot < 0) {
+			outname = filename + ".dis.ac"
+		} else {
+			outname = filename[:dot] + ".dis.ac"
+		}
+	}
+
+	fmt.Printf("READ %s\n", filename)
+	code, err := readFile(filename)
+	if err != nil {
+		fmt.Printf("ERROR: %v\n", err);
+		return
+	}
+	var symbols map[int][]string
+	if (*sflag != "") {
+		fmt.Printf("READ %s\n", *sflag)
+		symbols, err = ReadSymbolFile(*sflag)
+		if err != nil {
+			fmt.Printf("ERROR: %v\n", err);
+			return
+		}
+	}
+
+	fmt.Printf("CREATE %s\n", outname)
+	out, err := os.Create(outname)
+	if err != nil {
+		fmt.Printf("ERROR: %v\n", err);
+		return
+	}
+	defer out.Close()
+	out.WriteString(Disassemble(code, int(address), cpu, symbols))
+
+	fmt.Printf("DISASSEMBLY COMPLETE\n")
+}
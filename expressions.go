@@ -143,6 +143,11 @@ func (p *parser) parseExpression(token string) error {
 	// // Generate the code
 	p.addExpression(expr)
 
+	// Without the 65C2402 prefix codes, 16-bit and 24-bit values are handled a byte at a time
+	if (p.cpu < CPU_65C2402) && (isWideExpression(expr)) {
+		return p.generateWideExpression(expr)
+	}
+
 	// The simplest expression: R = V
 	if (expr.equalOp == EQUALS) && (expr.op == NO_OP) {
 		return p.generateExpressionEquals(expr)
@@ -169,7 +174,11 @@ func (p *parser) generateExpressionEquals(expr *expression) error {
 	case MEMORY, VARIABLE:
 		switch (expr.src1.location) {
 		case MEMORY, VARIABLE:
-			p.addExprInstruction("sta", modeZeroPage, saveRestoreSize, 0) // sta R0
+			r0, err := p.scratchAddress(saveRestoreSize)
+			if (err != nil) {
+				return err
+			}
+			p.addExprInstruction("sta", modeZeroPage, saveRestoreSize, r0) // sta R0
 			if (expr.src1.addrval <= 0x0FF) {
 				p.addExprInstruction("lda", modeZeroPage, size, expr.src1.addrval)
 			} else {
@@ -180,16 +189,20 @@ func (p *parser) generateExpressionEquals(expr *expression) error {
 			} else {
 				p.addExprInstruction("sta", modeAbsolute, size, expr.dest.addrval)
 			}
-			p.addExprInstruction("lda", modeZeroPage, saveRestoreSize, 0) // lda R0
+			p.addExprInstruction("lda", modeZeroPage, saveRestoreSize, r0) // lda R0
 		case VALUE:
-			p.addExprInstruction("sta", modeZeroPage, saveRestoreSize, 0) // sta R0
+			r0, err := p.scratchAddress(saveRestoreSize)
+			if (err != nil) {
+				return err
+			}
+			p.addExprInstruction("sta", modeZeroPage, saveRestoreSize, r0) // sta R0
 			p.addExprInstruction("lda", modeImmediate, expr.src1.size, expr.src1.addrval)
 			if (expr.dest.addrval <= 0x0FF) {
 				p.addExprInstruction("sta", modeZeroPage, size, expr.dest.addrval)
 			} else {
 				p.addExprInstruction("sta", modeAbsolute, size, expr.dest.addrval)
 			}
-			p.addExprInstruction("lda", modeZeroPage, saveRestoreSize, 0) // lda R0
+			p.addExprInstruction("lda", modeZeroPage, saveRestoreSize, r0) // lda R0
 		case REG_A:
 			if (expr.dest.addrval <= 0x0FF) {
 				p.addExprInstruction("sta", modeZeroPage, size, expr.dest.addrval)
@@ -241,8 +254,12 @@ func (p *parser) generateExpressionEquals(expr *expression) error {
 		case REG_X:
 			return fmt.Errorf("X = X is not allowed")
 		case REG_Y:
-			p.addExprInstruction("sty", modeZeroPage, size, 0) // sty R0
-			p.addExprInstruction("ldx", modeZeroPage, size, 0) // ldx R0
+			r0, err := p.scratchAddress(size)
+			if (err != nil) {
+				return err
+			}
+			p.addExprInstruction("sty", modeZeroPage, size, r0) // sty R0
+			p.addExprInstruction("ldx", modeZeroPage, size, r0) // ldx R0
 		}
 	case REG_Y:
 		switch (expr.src1.location) {
@@ -257,8 +274,12 @@ func (p *parser) generateExpressionEquals(expr *expression) error {
 		case REG_A:
 			p.addExprInstruction("tay", modeImplicit, size, 0)
 		case REG_X:
-			p.addExprInstruction("stx", modeZeroPage, size, 0) // sty R0
-			p.addExprInstruction("ldy", modeZeroPage, size, 0) // ldx R0
+			r0, err := p.scratchAddress(size)
+			if (err != nil) {
+				return err
+			}
+			p.addExprInstruction("stx", modeZeroPage, size, r0) // sty R0
+			p.addExprInstruction("ldy", modeZeroPage, size, r0) // ldx R0
 		case REG_Y:
 			return fmt.Errorf("Y = Y is not allowed")
 		}
@@ -278,7 +299,11 @@ func (p *parser) generateExpressionOpEquals(expr *expression) error {
 	case PLUS:
 		switch (expr.dest.location) {
 		case MEMORY, VARIABLE:
-			p.addExprInstruction("sta", modeZeroPage, saveRestoreSize, 0) // sta R0
+			r0, err := p.scratchAddress(saveRestoreSize)
+			if (err != nil) {
+				return err
+			}
+			p.addExprInstruction("sta", modeZeroPage, saveRestoreSize, r0) // sta R0
 			p.addExprInstruction("clc", modeImplicit, 0, 0)
 			var mmm string
 			if (expr.src1.location == REG_A) {
@@ -310,7 +335,7 @@ func (p *parser) generateExpressionOpEquals(expr *expression) error {
 			} else {
 				p.addExprInstruction("sta", modeAbsolute, size, expr.dest.addrval)
 			}
-			p.addExprInstruction("lda", modeZeroPage, saveRestoreSize, 0) // lda R0
+			p.addExprInstruction("lda", modeZeroPage, saveRestoreSize, r0) // lda R0
 		case REG_A:
 			switch (expr.src1.location) {
 			case MEMORY, VARIABLE:
@@ -321,7 +346,7 @@ func (p *parser) generateExpressionOpEquals(expr *expression) error {
 					p.addExprInstruction("adc", modeAbsolute, expr.src1.size, expr.src1.addrval)
 				}
 			case VALUE:
-				if (expr.src1.addrval == 1) {
+				if (expr.src1.addrval == 1) && (p.cpu >= CPU_65C02) {
 					p.addExprInstruction("inc", modeImplicit, 0, 0)
 				} else {
 					p.addExprInstruction("clc", modeImplicit, 0, 0)
@@ -337,7 +362,11 @@ func (p *parser) generateExpressionOpEquals(expr *expression) error {
 		case REG_X:
 			switch (expr.src1.location) {
 			case MEMORY, VARIABLE:
-				p.addExprInstruction("sta", modeZeroPage, saveRestoreSize, 0) // sta R0
+				r0, err := p.scratchAddress(saveRestoreSize)
+				if (err != nil) {
+					return err
+				}
+				p.addExprInstruction("sta", modeZeroPage, saveRestoreSize, r0) // sta R0
 				p.addExprInstruction("txa", modeImplicit, expr.dest.size, 0)
 				p.addExprInstruction("clc", modeImplicit, 0, 0)
 				if (expr.src1.addrval <= 0x0FF) {
@@ -346,9 +375,13 @@ func (p *parser) generateExpressionOpEquals(expr *expression) error {
 					p.addExprInstruction("adc", modeAbsolute, expr.src1.size, expr.src1.addrval)
 				}
 				p.addExprInstruction("tax", modeImplicit, size, 0)
-				p.addExprInstruction("lda", modeZeroPage, saveRestoreSize, 0) // lda R0
+				p.addExprInstruction("lda", modeZeroPage, saveRestoreSize, r0) // lda R0
 			case VALUE:
-				p.addExprInstruction("sta", modeZeroPage, saveRestoreSize, 0) // sta R0
+				r0, err := p.scratchAddress(saveRestoreSize)
+				if (err != nil) {
+					return err
+				}
+				p.addExprInstruction("sta", modeZeroPage, saveRestoreSize, r0) // sta R0
 				p.addExprInstruction("tya", modeImplicit, expr.dest.size, 0)
 				p.addExprInstruction("clc", modeImplicit, 0, 0)
 				if (expr.src1.addrval <= 0x0FF) {
@@ -357,22 +390,30 @@ func (p *parser) generateExpressionOpEquals(expr *expression) error {
 					p.addExprInstruction("adc", modeAbsolute, expr.src1.size, expr.src1.addrval)
 				}
 				p.addExprInstruction("tay", modeImplicit, size, 0)
-				p.addExprInstruction("lda", modeZeroPage, saveRestoreSize, 0) // lda R0
+				p.addExprInstruction("lda", modeZeroPage, saveRestoreSize, r0) // lda R0
 			case REG_A:
-				p.addExprInstruction("sta", modeZeroPage, saveRestoreSize, 0) // sta R0
+				r0, err := p.scratchAddress(saveRestoreSize)
+				if (err != nil) {
+					return err
+				}
+				p.addExprInstruction("sta", modeZeroPage, saveRestoreSize, r0) // sta R0
 				p.addExprInstruction("clc", modeImplicit, 0, 0)
 				p.addExprInstruction("adx", modeImplicit, size, 0)
 				p.addExprInstruction("tax", modeImplicit, size, 0)
-				p.addExprInstruction("lda", modeZeroPage, saveRestoreSize, 0) // lda R0
+				p.addExprInstruction("lda", modeZeroPage, saveRestoreSize, r0) // lda R0
 			case REG_X:
 				p.addExprInstruction("xsl", modeImplicit, 0, 0) // X << 1 = X + X
 			case REG_Y:
-				p.addExprInstruction("sta", modeZeroPage, saveRestoreSize, 0) // sta R0
+				r0, err := p.scratchAddress(saveRestoreSize)
+				if (err != nil) {
+					return err
+				}
+				p.addExprInstruction("sta", modeZeroPage, saveRestoreSize, r0) // sta R0
 				p.addExprInstruction("txa", modeImplicit, expr.dest.size, 0)
 				p.addExprInstruction("clc", modeImplicit, 0, 0)
 				p.addExprInstruction("ady", modeImplicit, size, 0)
 				p.addExprInstruction("tax", modeImplicit, size, 0)
-				p.addExprInstruction("lda", modeZeroPage, saveRestoreSize, 0) // lda R0
+				p.addExprInstruction("lda", modeZeroPage, saveRestoreSize, r0) // lda R0
 			}
 		case REG_Y:
 			// TBD
@@ -434,7 +475,11 @@ func (p *parser) generateExpressionOpEquals(expr *expression) error {
 			switch (expr.dest.location) {
 			case MEMORY, VARIABLE:
 				for i := 0; i < expr.src1.addrval; i++ {
-					p.addExprInstruction("asl", modeAbsolute, expr.src1.size, expr.src1.addrval) // asl M[aaa]
+					if (expr.dest.addrval <= 0x0FF) {
+						p.addExprInstruction("asl", modeZeroPage, expr.dest.size, expr.dest.addrval) // asl M[zz]
+					} else {
+						p.addExprInstruction("asl", modeAbsolute, expr.dest.size, expr.dest.addrval) // asl M[aaa]
+					}
 				}
 			case REG_A:
 				for i := 0; i < expr.src1.addrval; i++ {
@@ -459,28 +504,40 @@ func (p *parser) generateExpressionOpEquals(expr *expression) error {
 			switch (expr.dest.location) {
 			case MEMORY, VARIABLE:
 				for i := 0; i < expr.src1.addrval; i++ {
-					p.addExprInstruction("lsr", modeAbsolute, expr.src1.size, expr.src1.addrval) // asl M[aaa]
+					if (expr.dest.addrval <= 0x0FF) {
+						p.addExprInstruction("lsr", modeZeroPage, expr.dest.size, expr.dest.addrval) // lsr M[zz]
+					} else {
+						p.addExprInstruction("lsr", modeAbsolute, expr.dest.size, expr.dest.addrval) // lsr M[aaa]
+					}
 				}
 			case REG_A:
 				for i := 0; i < expr.src1.addrval; i++ {
 					p.addExprInstruction("lsr", modeImplicit, expr.dest.size, 0)
 				}
 			case REG_X:
-				p.addExprInstruction("sta", modeZeroPage, saveRestoreSize, 0) // lda R0
+				r0, err := p.scratchAddress(saveRestoreSize)
+				if (err != nil) {
+					return err
+				}
+				p.addExprInstruction("sta", modeZeroPage, saveRestoreSize, r0) // lda R0
 				p.addExprInstruction("txa", modeImplicit, expr.dest.size, 0)
 				for i := 0; i < expr.src1.addrval; i++ {
 					p.addExprInstruction("lsr", modeImplicit, expr.dest.size, 0)
 				}
 				p.addExprInstruction("tax", modeImplicit, expr.dest.size, 0)
-				p.addExprInstruction("lda", modeZeroPage, saveRestoreSize, 0) // lda R0
+				p.addExprInstruction("lda", modeZeroPage, saveRestoreSize, r0) // lda R0
 			case REG_Y:
-				p.addExprInstruction("sta", modeZeroPage, saveRestoreSize, 0) // lda R0
+				r0, err := p.scratchAddress(saveRestoreSize)
+				if (err != nil) {
+					return err
+				}
+				p.addExprInstruction("sta", modeZeroPage, saveRestoreSize, r0) // lda R0
 				p.addExprInstruction("tya", modeImplicit, expr.dest.size, 0)
 				for i := 0; i < expr.src1.addrval; i++ {
 					p.addExprInstruction("lsr", modeImplicit, expr.dest.size, 0)
 				}
 				p.addExprInstruction("tay", modeImplicit, expr.dest.size, 0)
-				p.addExprInstruction("lda", modeZeroPage, saveRestoreSize, 0) // lda R0
+				p.addExprInstruction("lda", modeZeroPage, saveRestoreSize, r0) // lda R0
 			}
 		}
 		return nil
@@ -535,13 +592,15 @@ func (p *parser) parseExpressionArg(token string) (int, int, int, error) {
 		if p.peekChar() == '@' {
 			p.skip(1)
 			token = p.nextAZ_az_09()
-			address, size, err := p.lookupVariable(p.currentCode, token)
+			address, size, found, err := p.lookupVariable(p.currentCode, token)
 			if (err != nil) {
+				return 0, 0, 0, err
+			} else if (!found) {
 				return 0, 0, 0, fmt.Errorf("unknown variable '@%s'", token)
 			}
 			return MEMORY, address, size, nil
 		// register or subrouting parameter
-		} else if (p.peekChar() == '%') {
+		} else if p.isRegisterOrParameter() {
 			p.skip(1)
 			address, err := p.parseRegisterOrParameter()
 			if (err != nil) {
@@ -557,8 +616,10 @@ func (p *parser) parseExpressionArg(token string) (int, int, int, error) {
 			return VALUE, value, valueToPrefix(value), err
 		}
 	default:
-		value, err := p.lookupConstant(token)
-		if (err == nil) {
+		value, found, err := p.lookupConstant(token)
+		if (err != nil) {
+			return 0, 0, 0, err
+		} else if (found) {
 			return VALUE, value, valueToPrefix(value), nil
 		}
 		return 0, 0, 0, fmt.Errorf("constant '%s' not found", token)
@@ -578,13 +639,15 @@ func (p *parser) parseMemoryAddress() (int, error) {
 	
 	// M@label
 	token := p.nextAZ_az_09()
-	value, err := p.lookupConstant(token)
-	if (err == nil) {
+	value, found, err := p.lookupConstant(token)
+	if (err != nil) {
+		return 0, err
+	} else if (found) {
 		return value, err
 	}
-	data := p.lookupDataName(token)
-	if (data != nil) {
-		return data.startAddr, err
+	address, err := p.lookupDataName(token)
+	if (err == nil) {
+		return address, err
 	}
 	return 0, fmt.Errorf("M@%s is an unknown variable address", token)
 }
@@ -604,6 +667,10 @@ func (p *parser) addExpression(expr *expression) {
 	}
 	p.currentCode.lastInstr = instr
 	instr.next = nil
+	instr.noopt = p.noopt
+	instr.line = p.line
+	instr.column = p.col
+	instr.filename = p.filename
 	instr.len = 0
 	instr.hasValue = true
 	instr.expr = expr
@@ -627,6 +694,10 @@ func (p *parser) addExprInstructionWithSymbol(mmm string, addressMode int, size
 	}
 	p.currentCode.lastInstr = instr
 	instr.next = nil
+	instr.noopt = p.noopt
+	instr.line = p.line
+	instr.column = p.col
+	instr.filename = p.filename
 
 	var o *opcode
 	instr.mnemonic, o, _ = lookupMnemonic(mmm, addressMode, size)
@@ -0,0 +1,526 @@
+package aCCembler
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// Keywords that are formatted in uppercase (the mnemonics are all lowercase)
+var formatKeywords = map[string]bool {
+	"const": true, "global": true, "reg": true, "sub": true, "isr": true, "nmi": true,
+	"thread": true, "vectors": true, "data": true, "var": true, "print": true, "os": true,
+	"if": true, "else": true, "loop": true, "for": true, "do": true, "while": true,
+	"break": true, "continue": true, "return": true, "spawn": true, "yield": true,
+	"wait": true, "timed": true,
+}
+
+// Keywords in the middle of a line, formatted in uppercase after the keyword that starts the line
+var formatInnerKeywords = map[string][]string {
+	"for": {"down", "to"},
+	"thread": {"stack"},
+}
+
+// Tabs are every 4 columns when aligning the comments
+const FORMAT_TAB = 4
+
+// A line of formatted source
+type formatLine struct {
+	indent		string
+	code		string
+	comment		string			// a trailing (or whole line) comment
+	verbatim	bool			// inside a /* ... */ comment, so left as is
+	opens		bool			// changes the depth of the {...}
+}
+
+
+/*
+ *  Format the source in the canonical style: a tab for each {...} the line is in, labels a space
+ *  past the block they are in, one space between the parts of a line (except inside quotes),
+ *  lowercase mnemonics and uppercase keywords, and trailing comments aligned
+ *  (keeping every comment, and one blank line wherever there were blank lines)
+ */
+func Format(src []uint8) []uint8 {
+	text := strings.Replace(string(src), "\r\n", "\n", -1)
+	lines := strings.Split(strings.TrimRight(text, "\n \t"), "\n")
+
+	var out []formatLine
+	depth := 0
+	inComment := false
+	blank := false
+	var kinds []string				// the keyword that opened each {...}, e.g. sub or data
+	for _, raw := range lines {
+		raw = strings.TrimRight(raw, " \t")
+
+		// Inside a /* ... */ comment
+		if (inComment) {
+			out = append(out, formatLine{verbatim: true, code: raw})
+			if (strings.Contains(raw, "*/")) {
+				inComment = false
+			}
+			continue
+		}
+
+		// One blank line for any number of them (and none at the start)
+		if (strings.TrimSpace(raw) == "") {
+			if (len(out) > 0) {
+				blank = true
+			}
+			continue
+		}
+		if (blank) {
+			out = append(out, formatLine{})
+			blank = false
+		}
+
+		code, comment, open := splitComment(raw)
+		inComment = open
+		code = collapseSpaces(strings.TrimSpace(code))
+
+		// Closing braces at the start of the line are at the outer depth
+		closes := 0
+		for (closes < len(code)) && (code[closes] == '}') {
+			closes += 1
+		}
+		indentDepth := depth - closes
+		if (indentDepth < 0) {
+			indentDepth = 0
+		}
+		inData := (len(kinds) > 0) && (kinds[len(kinds)-1] == "data")
+
+		// The case of the keyword or mnemonic, or a label
+		label := false
+		first := ""
+		if (!inData) {
+			code, first, label = formatCase(code)
+		}
+
+		line := formatLine{indent: strings.Repeat("\t", indentDepth), code: code, comment: comment}
+		if (label) && (indentDepth > 0) {
+			line.indent = strings.Repeat("\t", indentDepth-1) + " "
+		}
+
+		// Track the depth of the {...}, and which are DATA (or VECTORS) blocks
+		opens, shut := countBraces(code)
+		for k := 0; k < shut; k++ {
+			if (len(kinds) > 0) {
+				kinds = kinds[:len(kinds)-1]
+			}
+		}
+		for k := 0; k < opens; k++ {
+			if (first == "data") || (first == "vectors") || (inData) {
+				kinds = append(kinds, "data")
+			} else {
+				kinds = append(kinds, first)
+			}
+		}
+		depth += opens - shut
+		if (depth < 0) {
+			depth = 0
+		}
+		line.opens = (opens > 0) || (shut > 0)
+
+		out = append(out, line)
+	}
+
+	alignComments(out)
+
+	var b strings.Builder
+	for _, line := range out {
+		switch {
+		case (line.verbatim):
+			b.WriteString(line.code)
+		case (line.code == "") && (line.comment == ""):
+		case (line.code == ""):
+			b.WriteString(line.indent + line.comment)
+		case (line.comment == ""):
+			b.WriteString(line.indent + line.code)
+		default:
+			b.WriteString(line.indent + line.code + line.comment)
+		}
+		b.WriteString("\n")
+	}
+
+	return []uint8(b.String())
+}
+
+/*
+ *  Split the line into the code and a trailing comment (; or // or /* ...)
+ *  (returning whether a /* comment continues onto the next line)
+ */
+func splitComment(line string) (string, string, bool) {
+	quote := byte(0)
+	for k := 0; k < len(line); k++ {
+		c := line[k]
+		switch {
+		case (quote != 0):
+			if (c == quote) {
+				quote = 0
+			}
+		case (c == '"') || (c == '\''):
+			quote = c
+		case (c == ';'):
+			return line[:k], line[k:], false
+		case (c == '/') && (k+1 < len(line)) && (line[k+1] == '/'):
+			return line[:k], line[k:], false
+		case (c == '/') && (k+1 < len(line)) && (line[k+1] == '*'):
+			return line[:k], line[k:], !strings.Contains(line[k+2:], "*/")
+		}
+	}
+
+	return line, "", false
+}
+
+/*
+ *  Replace every run of spaces and tabs with one space (except inside quotes)
+ */
+func collapseSpaces(code string) string {
+	var b strings.Builder
+	quote := byte(0)
+	space := false
+	for k := 0; k < len(code); k++ {
+		c := code[k]
+		if (quote == 0) && ((c == ' ') || (c == '\t')) {
+			space = true
+			continue
+		}
+		if (space) {
+			b.WriteByte(' ')
+			space = false
+		}
+		b.WriteByte(c)
+		if (quote != 0) && (c == quote) {
+			quote = 0
+		} else if (quote == 0) && ((c == '"') || (c == '\'')) {
+			quote = c
+		}
+	}
+
+	return b.String()
+}
+
+/*
+ *  Count the { and } outside of quotes
+ */
+func countBraces(code string) (int, int) {
+	opens, closes := 0, 0
+	quote := byte(0)
+	for k := 0; k < len(code); k++ {
+		c := code[k]
+		switch {
+		case (quote != 0):
+			if (c == quote) {
+				quote = 0
+			}
+		case (c == '"') || (c == '\''):
+			quote = c
+		case (c == '{'):
+			opens += 1
+		case (c == '}'):
+			closes += 1
+		}
+	}
+
+	return opens, closes
+}
+
+/*
+ *  Lowercase the mnemonic or uppercase the keyword that starts the line (or follows its closing braces)
+ *  (returning the keyword in lowercase, and whether the line is a label)
+ */
+func formatCase(code string) (string, string, bool) {
+	start := 0
+	for (start < len(code)) && ((code[start] == '}') || (code[start] == ' ')) {
+		start += 1
+	}
+	end := start
+	for (end < len(code)) && (isFormatTokenChar(code[end])) {
+		end += 1
+	}
+	if (end == start) {
+		return code, "", false
+	}
+	token := code[start:end]
+	tokenLC := strings.ToLower(token)
+	rest := code[end:]
+
+	// A label, e.g. loop:
+	if (strings.HasPrefix(rest, ":")) && (start == 0) {
+		return code, "", true
+	}
+
+	// The width suffix is part of the mnemonic, e.g. lda.w
+	base := tokenLC
+	if dot := strings.Index(tokenLC, "."); (dot >= 0) {
+		base = tokenLC[:dot]
+	}
+	switch {
+	case formatKeywords[base]:
+		token = strings.ToUpper(token)
+		for _, inner := range formatInnerKeywords[base] {
+			rest = replaceWord(rest, inner, strings.ToUpper(inner))
+		}
+	case isMnemonicName(base):
+		token = tokenLC
+	default:
+		n, _ := registerMnemonicIndex(base)
+		if (n < 0) {
+			return code, "", false
+		}
+		token = tokenLC
+	}
+
+	return code[:start] + token + rest, base, false
+}
+
+func isFormatTokenChar(c byte) bool {
+	return ((c >= 'a') && (c <= 'z')) || ((c >= 'A') && (c <= 'Z')) || ((c >= '0') && (c <= '9')) || (c == '_') || (c == '.')
+}
+
+/*
+ *  Whether the name is a mnemonic, e.g. lda
+ */
+func isMnemonicName(name string) bool {
+	for m := range mnemonics {
+		if (m > 0) && (mnemonics[m].name == name) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+ *  Replace each whole word (in any case, outside of quotes) with another
+ */
+func replaceWord(code string, word string, with string) string {
+	var b strings.Builder
+	quote := byte(0)
+	k := 0
+	for k < len(code) {
+		c := code[k]
+		if (quote != 0) {
+			if (c == quote) {
+				quote = 0
+			}
+		} else if (c == '"') || (c == '\'') {
+			quote = c
+		} else if (isFormatTokenChar(c)) {
+			end := k
+			for (end < len(code)) && (isFormatTokenChar(code[end])) {
+				end += 1
+			}
+			if (strings.ToLower(code[k:end]) == word) {
+				b.WriteString(with)
+			} else {
+				b.WriteString(code[k:end])
+			}
+			k = end
+			continue
+		}
+		b.WriteByte(c)
+		k += 1
+	}
+
+	return b.String()
+}
+
+/*
+ *  Align the trailing comments of the lines between each blank line, comment, or { or }
+ *  (one tab stop past the longest line of code)
+ */
+func alignComments(lines []formatLine) {
+	start := 0
+	for k := 0; k <= len(lines); k++ {
+		if (k < len(lines)) && (lines[k].code != "") && (!lines[k].verbatim) && (!lines[k].opens) {
+			continue
+		}
+
+		// Align lines[start:k]
+		widest := 0
+		for _, line := range lines[start:k] {
+			if (line.comment != "") && (formatWidth(line.indent + line.code) > widest) {
+				widest = formatWidth(line.indent + line.code)
+			}
+		}
+		column := (widest/FORMAT_TAB + 1) * FORMAT_TAB
+		for j := start; j < k; j++ {
+			if (lines[j].comment != "") {
+				lines[j].code += strings.Repeat(" ", column - formatWidth(lines[j].indent + lines[j].code))
+			}
+		}
+
+		// A { or } line has its own comment one space after it
+		if (k < len(lines)) && (lines[k].opens) && (lines[k].comment != "") {
+			lines[k].code += " "
+		}
+		start = k+1
+	}
+}
+
+/*
+ *  The width of the text in columns, with tabs every FORMAT_TAB
+ */
+func formatWidth(text string) int {
+	width := 0
+	for k := 0; k < len(text); k++ {
+		if (text[k] == '\t') {
+			width = (width/FORMAT_TAB + 1) * FORMAT_TAB
+		} else {
+			width += 1
+		}
+	}
+	return width
+}
+
+/*
+ *  The differences between two texts, as a unified diff with 3 lines of context
+ */
+func diffLines(nameA string, nameB string, a []string, b []string) string {
+	// The longest common subsequence of the lines from each point onwards
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a)-1; i >= 0; i-- {
+		for j := len(b)-1; j >= 0; j-- {
+			if (a[i] == b[j]) {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if (lcs[i+1][j] >= lcs[i][j+1]) {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	// Each line kept (' '), removed ('-'), or added ('+'), and its line in a and b
+	type edit struct {
+		op		byte
+		i, j	int
+	}
+	var edits []edit
+	i, j := 0, 0
+	for (i < len(a)) || (j < len(b)) {
+		switch {
+		case (i < len(a)) && (j < len(b)) && (a[i] == b[j]):
+			edits = append(edits, edit{' ', i, j})
+			i, j = i+1, j+1
+		case (i < len(a)) && ((j == len(b)) || (lcs[i+1][j] >= lcs[i][j+1])):
+			edits = append(edits, edit{'-', i, j})
+			i += 1
+		default:
+			edits = append(edits, edit{'+', i, j})
+			j += 1
+		}
+	}
+
+	// Group the changes into hunks, with 3 lines of context around them
+	var out strings.Builder
+	for k := 0; k < len(edits); {
+		if (edits[k].op == ' ') {
+			k += 1
+			continue
+		}
+		first := k - 3
+		if (first < 0) {
+			first = 0
+		}
+		last := k
+		for n := k; n < len(edits); n++ {
+			if (edits[n].op != ' ') {
+				last = n
+			} else if (n - last > 6) {
+				break
+			}
+		}
+		end := last + 4
+		if (end > len(edits)) {
+			end = len(edits)
+		}
+
+		if (out.Len() == 0) {
+			out.WriteString(fmt.Sprintf("--- %s\n+++ %s\n", nameA, nameB))
+		}
+		countA, countB := 0, 0
+		for _, e := range edits[first:end] {
+			if (e.op != '+') {
+				countA += 1
+			}
+			if (e.op != '-') {
+				countB += 1
+			}
+		}
+		out.WriteString(fmt.Sprintf("@@ -%d,%d +%d,%d @@\n", edits[first].i+1, countA, edits[first].j+1, countB))
+		for _, e := range edits[first:end] {
+			switch (e.op) {
+			case ' ', '-':
+				out.WriteString(string(e.op) + a[e.i] + "\n")
+			case '+':
+				out.WriteString("+" + b[e.j] + "\n")
+			}
+		}
+		k = end
+	}
+
+	return out.String()
+}
+
+/*
+ *  aCCemble fmt [-l] [-d] [-w] file ...
+ *  (writing the formatted source, or listing the files whose formatting differs, showing the
+ *  differences, or rewriting the files; -l and -d exit with 1 if any file isn't formatted)
+ */
+func formatCommand(args []string) {
+	flags := flag.NewFlagSet("fmt", flag.ExitOnError)
+	lflag := flags.Bool("l", false, "list the files whose formatting differs")
+	dflag := flags.Bool("d", false, "show the differences from the formatted source")
+	wflag := flags.Bool("w", false, "write the formatted source back to each file")
+	flags.Parse(args)
+
+	if (flags.NArg() == 0) {
+		fmt.Printf("ERROR: No file was specified\n");
+		os.Exit(2)
+	}
+
+	differ := false
+	for _, filename := range flags.Args() {
+		src, err := readFile(filename)
+		if err != nil {
+			fmt.Printf("ERROR: %v\n", err);
+			os.Exit(2)
+		}
+		formatted := Format(src)
+		if (string(formatted) == string(src)) {
+			if (!*lflag) && (!*dflag) && (!*wflag) {
+				os.Stdout.Write(formatted)
+			}
+			continue
+		}
+		differ = true
+
+		if (*lflag) {
+			fmt.Println(filename)
+		}
+		if (*dflag) {
+			a := strings.Split(strings.TrimSuffix(string(src), "\n"), "\n")
+			b := strings.Split(strings.TrimSuffix(string(formatted), "\n"), "\n")
+			fmt.Print(diffLines(filename, filename + " (formatted)", a, b))
+		}
+		if (*wflag) {
+			err = ioutil.WriteFile(filename, formatted, 0644)
+			if err != nil {
+				fmt.Printf("ERROR: %v\n", err);
+				os.Exit(2)
+			}
+		}
+		if (!*lflag) && (!*dflag) && (!*wflag) {
+			os.Stdout.Write(formatted)
+		}
+	}
+
+	if (differ) && ((*lflag) || (*dflag)) {
+		os.Exit(1)
+	}
+}
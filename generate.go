@@ -4,6 +4,7 @@ import (
 	//"errors"
 	"fmt"
 	"os"
+	"strings"
 )
 
 /*
@@ -12,11 +13,20 @@ import (
 func (p *parser) generateCode(out *os.File, listing *os.File) error {
 	fmt.Printf("GENERATE CODE\n")
 
-	// Resolve forward referenes
-	err := p.resolveSymbols()
+	// Resolve the thread IDs and stacks, then the other forward referenes
+	err := p.resolveSpawns()
 	if (err != nil) {
 		return err
 	}
+	err = p.resolveSymbols()
+	if (err != nil) {
+		return err
+	}
+	err = p.checkVectors()
+	if (err != nil) {
+		return err
+	}
+	p.checkUnusedSymbols()
 
 	// Check for overlapping addresses
 	err = p.checkAddressRanges()
@@ -24,11 +34,33 @@ func (p *parser) generateCode(out *os.File, listing *os.File) error {
 		return err
 	}
 
-	// Generate the machine code and listing
+	// Check the cycles of the TIMED blocks
+	for b := p.code; b != nil; b = b.next {
+		err = p.checkTimedBlocks(b)
+		if (err != nil) {
+			return err
+		}
+	}
+
+	// Generate the machine code and listing (without the part written before an error)
 	err = p.outputCode(out, listing)
 	if (err != nil) {
+		out.Truncate(0)
 		return err
 	}
+	if (p.optimize) {
+		p.outputOptimizerStats(listing)
+	}
+	p.outputCallGraph(listing)
+	if (p.pruned != nil) {
+		p.outputPruned(listing)
+	}
+
+	// -W error turns the warnings into errors (some are only found while writing the code)
+	if (p.warnErrors > 0) {
+		out.Truncate(0)
+		return fmt.Errorf("%d of the warnings are errors (-W error)", p.warnErrors)
+	}
 
 	fmt.Printf("+ %6d bytes ($%x) of DATA\n", p.dataSize, p.dataSize)
 	fmt.Printf("+ %6d bytes ($%x) in TOTAL\n", p.codeSize + p.dataSize, p.codeSize + p.dataSize)
@@ -51,6 +83,45 @@ func (p *parser) resolveSymbols() error {
 		}
 	}
 
+	// Loop through all the data blocks
+	for d := p.data; d != nil; d = d.next {
+		err := p.resolveDataSymbols(d)
+		if (err != nil) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+/*
+ *  Resolve any data entries that reference a subroutine or data block
+ */
+func (p *parser) resolveDataSymbols(d *dataBlock) error {
+	for e := d.data; e != nil; e = e.next {
+		if (e.symbol == "") {
+			continue
+		}
+
+		s := p.lookupSubroutineName(e.symbol)
+		if (s != nil) {
+			e.value += s.startAddr
+		} else {
+			address, err := p.lookupDataName(e.symbol)
+			if (err == nil) {
+				e.value += address
+			} else {
+				return fmt.Errorf("'%s' in DATA '%s' is an unknown symbol", e.symbol, d.name)
+			}
+		}
+
+		if (e.size == R08) && (e.value > 0x0FF) {
+			return fmt.Errorf("'%s' @$%06x is bigger than 8-bits (in '%s')", e.symbol, e.value, d.name)
+		} else if (e.size == R16) && (e.value > 0x0FFFF) {
+			return fmt.Errorf("'%s' @$%06x is bigger than 16-bits (in '%s')", e.symbol, e.value, d.name)
+		}
+	}
+
 	return nil
 }
 
@@ -91,7 +162,7 @@ func (p *parser) resolveCodeSymbols(b *codeBlock) error {
 		}
 
 		// Compute branches
-		if (i.addressMode == modeRelative) && (i.hasValue == false) {
+		if ((i.addressMode == modeRelative) || (i.addressMode == modeZeroPageRelative)) && (i.hasValue == false) {
 			targetAddr, err := b.lookupInstructionLabel(i.symbol)
 			if (err == nil) {
 				i.hasValue = true
@@ -117,10 +188,10 @@ func (p *parser) resolveCodeSymbols(b *codeBlock) error {
 					i.hasValue = true
 					i.value = s.startAddr
 				} else {
-					d := p.lookupDataName(i.symbol)
-					if (d != nil) {
+					address, err := p.lookupDataName(i.symbol)
+					if (err == nil) {
 						i.hasValue = true
-						i.value = d.startAddr + i.value
+						i.value = address + i.value
 					} else {
 						return fmt.Errorf("*** %s is an unknown symbol", i.symbol)
 					}
@@ -152,10 +223,10 @@ func (p *parser) resolveCodeSymbols(b *codeBlock) error {
  *  Check to ensure the address ranges of the subroutines and data blocks do not overlap
  */
 func (p *parser) checkAddressRanges() error {
-	for b := p.code; b != nil; b = b.next {
-		fmt.Printf("  SUB  @$%06x-$%06x  '%s'\n", b.startAddr, b.endAddr, b.name)
+	for b := p.code; (b != nil) && (!p.quiet); b = b.next {
+		fmt.Printf("  %-4s @$%06x-$%06x  '%s'\n", strings.ToUpper(blockKindStr(b.kind)), b.startAddr, b.endAddr, b.name)
 	}
-	for d := p.data; d != nil; d = d.next {
+	for d := p.data; (d != nil) && (!p.quiet); d = d.next {
 		fmt.Printf("  DATA @$%06x-$%06x  '%s'\n", d.startAddr, d.endAddr, d.name)
 	}
 
@@ -194,7 +265,7 @@ func (p *parser) checkAddressRanges() error {
 		if (b != nil) && ((d == nil) || (b.startAddr < d.startAddr)) {
 			if (b.startAddr < lastEndAddr) {
 				return fmt.Errorf("SUB '%s' @$%06x-$%06x is specified after @$%06x-$%06x and there is no auto sort",
-					d.name, d.startAddr, d.endAddr, lastStartAddr, lastEndAddr)
+					b.name, b.startAddr, b.endAddr, lastStartAddr, lastEndAddr)
 			}
 
 			lastStartAddr = b.startAddr
@@ -214,7 +285,7 @@ func (p *parser) checkAddressRanges() error {
 				d.name, d.startAddr, d.endAddr, lastStartAddr, lastEndAddr)
 		} else {
 			return fmt.Errorf("SUB '%s' @$%06x-$%06x is specified after @$%06x-$%06x and there is no auto sort",
-				d.name, d.startAddr, d.endAddr, lastStartAddr, lastEndAddr)
+				b.name, b.startAddr, b.endAddr, lastStartAddr, lastEndAddr)
 		}
 	}
 
@@ -238,6 +309,10 @@ func (p *parser) checkAddressRanges() error {
  *  Output the code and data
  */
 func (p *parser) outputCode(out *os.File, listing *os.File) error {
+	// Where the registers, parameters, and thread stacks are
+	p.outputLayout(listing)
+	p.outputThreads(listing)
+
 	// Dump the global variables at the top
 	for v := p.global; v != nil; v = v.next {
 		size := "       "
@@ -274,7 +349,7 @@ func (p *parser) outputCode(out *os.File, listing *os.File) error {
 			}
 			lastEndAddr = b.endAddr
 
-			sub := fmt.Sprintf("\n%06x ; SUB %s:\n", b.startAddr, b.name)
+			sub := fmt.Sprintf("\n%06x ; %s %s:\n", b.startAddr, strings.ToUpper(blockKindStr(b.kind)), b.name)
 			listing.WriteString(sub)
 			//fmt.Printf(sub)
 
@@ -282,6 +357,7 @@ func (p *parser) outputCode(out *os.File, listing *os.File) error {
 			if (err != nil) {
 				return err
 			}
+			p.outputBlockCycles(b, listing)
 
 			p.codeSize += b.endAddr - b.startAddr
 			b = b.next
@@ -421,7 +497,11 @@ func (p *parser) outputCodeBlock(b *codeBlock, out *os.File, listing *os.File) e
 			length -= 1
 
 			// Value
-			if length > 3 {
+			if (i.addressMode == modeZeroPageRelative) {
+				opcodes += fmt.Sprintf("%02x %02x ", i.zeroPage & 0xff, i.value & 0xff)
+				bytes[byteIdx] = byte(i.zeroPage & 0xff); byteIdx += 1;
+				bytes[byteIdx] = byte(i.value & 0xff); byteIdx += 1;
+			} else if length > 3 {
 				return fmt.Errorf("*** the length for %s is %d, too long", mnemonics[i.mnemonic].name, i.len)
 			} else if length >= 3 {
 				opcodes += fmt.Sprintf("%02x %02x %02x ",
@@ -438,9 +518,17 @@ func (p *parser) outputCodeBlock(b *codeBlock, out *os.File, listing *os.File) e
 				bytes[byteIdx] = byte(i.value & 0xff); byteIdx += 1;
 			}
 
+			// Decode the bytes again to check them (-verify)
+			if (p.verify) {
+				err := p.verifyInstruction(i, bytes[:byteIdx])
+				if (err != nil) {
+					return err
+				}
+			}
+
 			// Assembly code mneumonic
 			spaces := "                                        "
-			line += fmt.Sprintf("%s%s %s", opcodes, spaces[:35-(i.len*3)], mnemonics[i.mnemonic].name)
+			line += fmt.Sprintf("%s%s%5s %s", opcodes, spaces[:30-(i.len*3)], p.instructionCycles(i), mnemonics[i.mnemonic].name)
 
 			// Suffix
 			line += sizeToSuffix(i.prefix)
@@ -504,6 +592,12 @@ func (p *parser) outputCodeBlock(b *codeBlock, out *os.File, listing *os.File) e
 				args += fmt.Sprintf(" X")
 			case modeXY:
 				args += fmt.Sprintf(" XY")
+			case modeZeroPageRelative:
+				if (i.value < 0) {
+					args += fmt.Sprintf(" $%02x,%d", i.zeroPage, i.value)
+				} else {
+					args += fmt.Sprintf(" $%02x,+%d", i.zeroPage, i.value)
+				}
 			}
 			line += args
 
@@ -514,7 +608,7 @@ func (p *parser) outputCodeBlock(b *codeBlock, out *os.File, listing *os.File) e
 				line += fmt.Sprintf("; %s", i.symbol)
 			}
 			// Append the computed address for relative branches
-			if (i.addressMode == modeRelative) {
+			if (i.addressMode == modeRelative) || (i.addressMode == modeZeroPageRelative) {
 				line += fmt.Sprintf(" [%x]", i.address + i.len + i.value)
 			}
 		}
@@ -528,7 +622,13 @@ func (p *parser) outputCodeBlock(b *codeBlock, out *os.File, listing *os.File) e
 
 		// IF/FOR/LOOP/DO/ETC
 		if (i.subBlock != nil) {
-			p.outputCodeBlock(i.subBlock.block, out, listing)
+			err := p.outputCodeBlock(i.subBlock.block, out, listing)
+			if (err != nil) {
+				return err
+			}
+			if (i.subBlock.keyword == KW_TIMED) {
+				listing.WriteString(fmt.Sprintf("%06x ; TIMED %s takes %d cycles\n", i.subBlock.block.endAddr, i.subBlock.block.name, i.subBlock.cycles))
+			}
 		}
 	}
 
@@ -542,7 +642,35 @@ func (p *parser) outputDataBlock(d *dataBlock, out *os.File, listing *os.File) e
 	// Loop through all the data entries
 	for e := d.data; e != nil; e = e.next {
 		line := fmt.Sprintf("%06x ", e.address)
-		bytes := make([]byte, e.len)
+
+		// Label
+		if (e.size == DLABEL) {
+			line += fmt.Sprintf("                %s:\n", e.label)
+			listing.WriteString(line)
+			continue
+		}
+
+		// Binary files are summarized in the listing
+		if (e.size == DBINARY) {
+			for k := 0; (k < len(e.bytes)) && (k < 8); k++ {
+				line += fmt.Sprintf("%02x ", e.bytes[k])
+			}
+			if (len(e.bytes) > 8) {
+				line += "..."
+			}
+			spaces := "                                        "
+			line += fmt.Sprintf("%s; %d bytes from \"%s\"\n", spaces[:41-len(line)], len(e.bytes), e.string)
+			listing.WriteString(line)
+			out.Write(e.bytes)
+			continue
+		}
+
+		// Repeated values are listed once
+		count := e.count
+		if (count < 1) {
+			count = 1
+		}
+		bytes := make([]byte, e.len / count)
 
 		switch (e.size) {
 		case R08:
@@ -563,15 +691,30 @@ func (p *parser) outputDataBlock(d *dataBlock, out *os.File, listing *os.File) e
 				line += fmt.Sprintf("%02x ", e.string[s])
 				bytes[s] = e.string[s]
 			}
-			line += fmt.Sprintf("00")
-			bytes[e.len-1] = 0
+			line = strings.TrimSuffix(line, " ")
 		default:
 			return fmt.Errorf("invalid data type %x", e.size)
 		}
+
+		// Append a comment if the data referenced a symbol or is repeated
+		comment := e.symbol
+		if (count > 1) {
+			comment = strings.TrimSpace(fmt.Sprintf("%s [%d]", comment, count))
+		}
+		if (comment != "") {
+			spaces := "                                        "
+			pad := 35 - (len(bytes)*3)
+			if (pad < 1) {
+				pad = 1
+			}
+			line += fmt.Sprintf("%s; %s", spaces[:pad], comment)
+		}
 		line += "\n"
 
 		listing.WriteString(line)
-		out.Write(bytes)
+		for n := 0; n < count; n++ {
+			out.Write(bytes)
+		}
 		//fmt.Printf(line)
 	}
 
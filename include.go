@@ -0,0 +1,171 @@
+package aCCembler
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Where an #include was, e.g. line 3 of main.ac (for the chain of includes in an error)
+type includeFrame struct {
+	filename	string
+	line		int
+}
+
+// An error in an #include'd file (already printed, so not printed again by each file that included it)
+type includeError struct {
+	filename	string			// the file with the error
+	line		int
+	err			error
+}
+
+func (e *includeError) Error() string {
+	return fmt.Sprintf("in %s [line %d] -- %v", e.filename, e.line, e.err)
+}
+
+// Every -I, e.g. -I lib -I ../common
+type includeFlags []string
+
+func (f *includeFlags) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *includeFlags) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+
+/*
+ *  Parse the #include directive, e.g. #include "lib/print.ac"
+ *  (skipping a file that has a #once and has already been parsed)
+ */
+func (p *parser) parseInclude() error {
+	// Parse the filename
+	if (p.peekChar() != '"') {
+		return fmt.Errorf("#include is missing the opening \"")
+	}
+	p.skip(1)
+	filename := p.untilQuote()
+	if (p.peekChar() != '"') {
+		return fmt.Errorf("#include is missing the closing \"")
+	}
+	p.skip(1)
+
+	// Find the file, then check it isn't already being parsed
+	path, err := p.findInclude(filename)
+	if (err != nil) {
+		return fmt.Errorf("#include %s", err)
+	}
+	if (p.once[absPath(path)]) {
+		return nil
+	}
+	err = p.checkIncludeCycle(path)
+	if (err != nil) {
+		return err
+	}
+
+	// Load the file
+	buffer, err := readFile(path)
+	if err != nil {
+		return fmt.Errorf("#include can't read '%s' -- %s", path, err)
+	}
+
+	// Remember where we left off
+	saveB := p.b
+	saveEnd := p.end
+	saveI := p.i
+	saveN := p.n
+	saveFilename := p.filename
+	p.includes = append(p.includes, includeFrame{p.filename, p.n})
+
+	// Parse the file
+	err = p.parseFile(path, buffer)
+	errorLine := p.n
+
+	// Restore where we left off
+	p.b = saveB
+	p.end = saveEnd
+	p.i = saveI
+	p.n = saveN
+	p.filename = saveFilename
+	p.includes = p.includes[:len(p.includes)-1]
+
+	// The error was printed with the file and line it was on (and the #include lines to there)
+	if (err != nil) {
+		if _, ok := err.(*includeError); (!ok) {
+			err = &includeError{path, errorLine, err}
+		}
+		return err
+	}
+
+	return nil
+}
+
+/*
+ *  Parse the #once directive, i.e. any later #include of this file is skipped
+ */
+func (p *parser) parseOnce() error {
+	if (p.once == nil) {
+		p.once = make(map[string]bool)
+	}
+	p.once[absPath(p.filename)] = true
+
+	p.skipWhitespaceAndEOL()
+	return nil
+}
+
+/*
+ *  Find the file of an #include or #incbin: in the folder of the file being parsed,
+ *  then in each -I folder (in order), then in the current folder
+ */
+func (p *parser) findInclude(filename string) (string, error) {
+	if (filepath.IsAbs(filename)) {
+		return filename, nil
+	}
+
+	tried := []string{}
+	folders := append([]string{filepath.Dir(p.filename)}, p.includePaths...)
+	for _, folder := range folders {
+		path := filepath.Join(folder, filename)
+		if stat, err := os.Stat(path); (err == nil) && (!stat.IsDir()) {
+			return path, nil
+		}
+		tried = append(tried, path)
+	}
+	if stat, err := os.Stat(filename); (err == nil) && (!stat.IsDir()) {
+		return filename, nil
+	}
+
+	return "", fmt.Errorf("can't find '%s' (tried %s)", filename, strings.Join(tried, ", "))
+}
+
+/*
+ *  Return an error if the file is being parsed, i.e. it (indirectly) includes itself
+ */
+func (p *parser) checkIncludeCycle(path string) error {
+	abs := absPath(path)
+	chain := append(append([]includeFrame{}, p.includes...), includeFrame{p.filename, p.n})
+	for k := range chain {
+		if (absPath(chain[k].filename) == abs) {
+			cycle := []string{}
+			for _, f := range chain[k:] {
+				cycle = append(cycle, fmt.Sprintf("%s [line %d] includes", f.filename, f.line))
+			}
+			return fmt.Errorf("#include cycle: %s %s", strings.Join(cycle, " "), path)
+		}
+	}
+	return nil
+}
+
+/*
+ *  The path without any . or .. (or the path itself if it has no absolute path)
+ */
+func absPath(path string) string {
+	abs, err := filepath.Abs(path)
+	if (err != nil) {
+		return filepath.Clean(path)
+	}
+	return abs
+}
@@ -0,0 +1,320 @@
+package aCCembler
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// CPU vector locations
+const VECTORS_A16 = 0xFFFA		// NMI, RESET, IRQ as 16-bit words
+const VECTORS_A24 = 0xFFFFF7	// NMI, RESET, IRQ as 24-bit trips (65C2402)
+
+
+/*
+ *  The label of the restores and RTI at the end of an ISR/NMI block (where RETURN jumps to)
+ *  named like the labels of IF, LOOP, and FOR, e.g. ISR2000_exit
+ */
+func interruptExitLabel(b *codeBlock) string {
+	return fmt.Sprintf("%s%x_exit", strings.ToUpper(blockKindStr(b.kind)), b.startAddr)
+}
+
+/*
+ *  Wrap the body of an ISR/NMI block with the register saves and restores
+ *  e.g. PHA.w PHX ... PLX PLA.w RTI
+ */
+func (p *parser) wrapInterruptBlock(b *codeBlock) error {
+	// The body can't have a label of its own with the name of the exit
+	exit := interruptExitLabel(b)
+	if l := findLabel(b, strings.ToLower(exit)); (l != nil) {
+		return fmt.Errorf("the label '%s' on line %d is reserved for the end of %s %s", l.symbol, l.line, strings.ToUpper(blockKindStr(b.kind)), b.name)
+	}
+
+	// Which registers (and how wide) does the body touch?
+	aSz, xSz, ySz, calls := registersTouched(b)
+
+	// Any JSR could touch any register (at any width the CPU has), so save them all
+	if (calls) {
+		wide := R08
+		if (p.cpu >= CPU_65C2402) {
+			wide = R24
+		}
+		if (aSz < wide) { aSz = wide }
+		if (xSz < wide) { xSz = wide }
+		if (ySz < wide) { ySz = wide }
+	}
+
+	// Without PHX/PHY (before the 65C02), X and Y are saved through A, so A is saved too
+	pushXY := (p.cpu >= CPU_65C02)
+	if (!pushXY) && ((xSz >= R08) || (ySz >= R08)) && (aSz < R08) {
+		aSz = R08
+	}
+
+	// Detach the body, so the saves can go in front of it
+	body := b.instr
+	lastBody := b.lastInstr
+	b.instr = nil
+	b.lastInstr = nil
+	b.endAddr = b.startAddr
+
+	p.currentCode = b
+	p.addInstructionComment(fmt.Sprintf("%s %s (save registers)", strings.ToUpper(blockKindStr(b.kind)), b.name))
+	if (aSz >= R08) {
+		p.addExprInstruction("pha", modeImplicit, aSz, 0)
+	}
+	if (xSz >= R08) && (pushXY) {
+		p.addExprInstruction("phx", modeImplicit, xSz, 0)
+	} else if (xSz >= R08) {
+		p.addExprInstruction("txa", modeImplicit, R08, 0)
+		p.addExprInstruction("pha", modeImplicit, R08, 0)
+	}
+	if (ySz >= R08) && (pushXY) {
+		p.addExprInstruction("phy", modeImplicit, ySz, 0)
+	} else if (ySz >= R08) {
+		p.addExprInstruction("tya", modeImplicit, R08, 0)
+		p.addExprInstruction("pha", modeImplicit, R08, 0)
+	}
+
+	// Re-attach the body, and move it past the saves
+	if (body != nil) {
+		body.prev = b.lastInstr
+		b.lastInstr.next = body
+		b.lastInstr = lastBody
+		b.endAddr = relocateCodeBlock(body, b.endAddr)
+	}
+
+	// Restore (in the reverse order) and return from the interrupt
+	p.addInstructionLabel(exit)
+	if (ySz >= R08) && (pushXY) {
+		p.addExprInstruction("ply", modeImplicit, ySz, 0)
+	} else if (ySz >= R08) {
+		p.addExprInstruction("pla", modeImplicit, R08, 0)
+		p.addExprInstruction("tay", modeImplicit, R08, 0)
+	}
+	if (xSz >= R08) && (pushXY) {
+		p.addExprInstruction("plx", modeImplicit, xSz, 0)
+	} else if (xSz >= R08) {
+		p.addExprInstruction("pla", modeImplicit, R08, 0)
+		p.addExprInstruction("tax", modeImplicit, R08, 0)
+	}
+	if (aSz >= R08) {
+		p.addExprInstruction("pla", modeImplicit, aSz, 0)
+	}
+	p.addExprInstruction("rti", modeImplicit, A16, 0)
+
+	return nil
+}
+
+/*
+ *  Find the widest use of A, X, and Y in the block (and any sub-blocks)
+ *  (returning -1 for a register that isn't touched, and whether there is a JSR)
+ */
+func registersTouched(b *codeBlock) (int, int, int, bool) {
+	aSz, xSz, ySz := -1, -1, -1
+	calls := false
+
+	for i := b.instr; i != nil; i = i.next {
+		if (i.subBlock != nil) {
+			a, x, y, c := registersTouched(i.subBlock.block)
+			if (a > aSz) { aSz = a }
+			if (x > xSz) { xSz = x }
+			if (y > ySz) { ySz = y }
+			calls = calls || c
+			continue
+		}
+		if (i.mnemonic == 0) || (i.len == 0) {
+			continue
+		}
+
+		// The register bits of the prefix only (not A24), with R32 as R24 as it isn't implemented
+		m := mnemonics[i.mnemonic]
+		sz := R08
+		switch (prefixToWidth(i.prefix)) {
+		case 16:
+			sz = R16
+		case 24:
+			sz = R24
+		}
+		switch (m.reg) {
+		case REG_A:
+			if (sz > aSz) { aSz = sz }
+		case REG_X:
+			if (sz > xSz) { xSz = sz }
+		case REG_Y:
+			if (sz > ySz) { ySz = sz }
+		}
+		if (m.name == "jsr") {
+			calls = true
+		}
+	}
+
+	return aSz, xSz, ySz, calls
+}
+
+/*
+ *  Recompute the address of every instruction from the specified one onward
+ *  (returning the address after the last instruction)
+ */
+func relocateCodeBlock(i *instruction, address int) int {
+	for ; i != nil; i = i.next {
+		i.address = address
+		if (i.subBlock != nil) {
+			sub := i.subBlock
+			sub.startAddr = address
+			sub.block.startAddr = address
+			address = relocateCodeBlock(sub.block.instr, address)
+			sub.block.endAddr = address
+			sub.endAddr = address
+			continue
+		}
+		address += i.len
+	}
+
+	return address
+}
+
+
+/*
+ *  Parse the CPU vectors, e.g. VECTORS { nmi = h1, reset = start, irq = h2 }
+ *  (VECTORS.w forces 16-bit vectors at $FFFA, VECTORS.t 24-bit vectors at $FFFFF7)
+ */
+func (p *parser) parseVectors() error {
+	// 16-bit or 24-bit vectors?
+	size := p.parseOpWidth() & R32
+	if (size == A16) {
+		if (p.abWidth == A24) {
+			size = R24
+		} else {
+			size = R16
+		}
+	}
+	if (size != R16) && (size != R24) {
+		return errors.New("VECTORS must be .w (16-bit) or .t (24-bit)")
+	}
+
+	p.skipWhitespace()
+	if (p.nextChar() != '{') {
+		return errors.New("missing { in VECTORS")
+	}
+	p.skipWhitespaceAndEOL()
+
+	// NMI, RESET, IRQ/BRK in the order the CPU expects them
+	line := p.n
+	names := []string{"", "", ""}
+	lines := []int{0, 0, 0}
+	for p.i < p.end {
+		p.skipWhitespace()
+		token := strings.ToLower(p.nextAZ_az_09())
+
+		if (token == "") {
+			if (p.skipComment()) {
+				continue
+			} else if (p.peekChar() == ',') {
+				p.skip(1)
+				continue
+			} else if (p.peekChar() == '}') {
+				p.nextLine()
+				break
+			}
+			return fmt.Errorf("found '%c' instead of nmi, reset, or irq in VECTORS", p.peekChar())
+		}
+
+		var v int
+		switch (token) {
+		case "nmi": v = 0
+		case "reset", "rst", "res": v = 1
+		case "irq", "brk": v = 2
+		default:
+			return fmt.Errorf("'%s' is not a vector, expecting nmi, reset, or irq", token)
+		}
+		if (names[v] != "") {
+			return fmt.Errorf("the %s vector is specified twice", token)
+		}
+
+		p.skipWhitespace()
+		if (p.nextChar() != '=') {
+			return fmt.Errorf("the %s vector is missing a '='", token)
+		}
+		names[v] = p.nextAZ_az_09()
+		lines[v] = p.n
+		if (names[v] == "") {
+			return fmt.Errorf("the %s vector is missing the name of a SUB or ISR", token)
+		}
+	}
+	if (names[1] == "") {
+		return errors.New("VECTORS must specify the reset vector")
+	}
+	if (names[0] == "") {
+		p.warning(WARN_VECTORS, line, "VECTORS has no nmi, so an NMI jumps to $0000")
+	}
+	if (names[2] == "") {
+		p.warning(WARN_VECTORS, line, "VECTORS has no irq, so an IRQ or BRK jumps to $0000")
+	}
+
+	// Store the vectors as a data block
+	var block *dataBlock
+	if (size == R16) {
+		block = p.addDataBlock("VECTORS", VECTORS_A16)
+	} else {
+		block = p.addDataBlock("VECTORS", VECTORS_A24)
+	}
+	block.placed = true
+	block.filename = p.filename
+	block.line = line
+	p.vectors = block
+	for v := range names {
+		e := block.addData(size, 0, "", vectorLen(size))
+		e.symbol = names[v]
+		e.line = lines[v]
+	}
+
+	return nil
+}
+
+/*
+ *  Check that the nmi vector is to an NMI block and the irq vector to an ISR block
+ *  (as a SUB would return with RTS, and an NMI or ISR doesn't end the same way)
+ */
+func (p *parser) checkVectors() error {
+	kinds := []int{BLK_NMI, -1, BLK_ISR}
+	vectors := []string{"nmi", "reset", "irq"}
+	if (p.vectors == nil) {
+		return nil
+	}
+
+	v := 0
+	for e := p.vectors.data; (e != nil) && (v < len(kinds)); e = e.next {
+		if (kinds[v] >= 0) && (e.symbol != "") {
+			b := p.lookupSubroutineName(e.symbol)
+			if (b == nil) || (b.kind != kinds[v]) {
+				return &sourceError{p.vectors.filename, e.line,
+					fmt.Errorf("the %s vector '%s' is not an %s", vectors[v], e.symbol, strings.ToUpper(blockKindStr(kinds[v])))}
+			}
+		}
+		v += 1
+	}
+
+	return nil
+}
+
+/*
+ *  The length in bytes of each vector
+ */
+func vectorLen(size int) int {
+	if (size == R24) {
+		return 3
+	}
+	return 2
+}
+
+/*
+ *  Turn the block kind into a string
+ */
+func blockKindStr(kind int) string {
+	switch (kind) {
+	case BLK_ISR: return "isr"
+	case BLK_NMI: return "nmi"
+	case BLK_THREAD: return "thread"
+	}
+	return "sub"
+}
@@ -14,6 +14,7 @@ type kFunc func (*parser, string) error
 
 var keywords = []string {
 	"var",
+	"reg",
 	"print",
 	"os",
 	"if",
@@ -24,6 +25,10 @@ var keywords = []string {
 	"break",
 	"continue",
 	"return",
+	"spawn",
+	"yield",
+	"wait",
+	"timed",
 }
 
 // Boolean expression in IF, WHILE, etc.
@@ -66,6 +71,7 @@ func (p *parser) parseKeyword(token string) error {
 	// Find the parser for the keyword
 	switch (token) {
 	case "var": return p.parseLocalVariable(token)
+	case "reg": return p.parseLocalRegister(token)
 	case "print": return p.parsePrint(token)
 	case "os": return p.parseOs(token)
 	case "if": return p.parseIf(token)
@@ -76,6 +82,10 @@ func (p *parser) parseKeyword(token string) error {
 	case "continue": return p.parseContinue(token)
 	case "break": return p.parseBreak(token)
 	case "return": return p.parseReturn(token)
+	case "spawn": return p.parseSpawn(token)
+	case "yield": return p.parseYield(token)
+	case "wait": return p.parseWait(token)
+	case "timed": return p.parseTimed(token)
 	}
 
 	return fmt.Errorf("keyword '%s' is invalid", token)
@@ -89,11 +99,21 @@ func (p *parser) parseLocalVariable(token string) error {
 	return p.parseVariable(VAR_LOCAL, p.currentCode, p.nextAZ_az_09())
 }
 
+/*
+ *  Parse the 'reg' keyword
+ */
+func (p *parser) parseLocalRegister(token string) error {
+	p.skipWhitespace()
+	return p.parseRegisterName(p.currentCode, p.nextAZ_az_09())
+}
+
 /*
  *  Parse the 'print' keyword
  */
 func (p *parser) parsePrint(token string) error {
-	fmt.Printf("PRINT is not yet supported [%d-%d]\n", p.i, p.n)
+	if (!p.quiet) {
+		fmt.Printf("PRINT is not yet supported [%d-%d]\n", p.i, p.n)
+	}
 	return nil
 }
 
@@ -101,10 +121,21 @@ func (p *parser) parsePrint(token string) error {
  *  Parse the 'os' keyword
  */
 func (p *parser) parseOs(token string) error {
-	fmt.Printf("OS is not yet supported [%d-%d]\n", p.i, p.n)
+	if (!p.quiet) {
+		fmt.Printf("OS is not yet supported [%d-%d]\n", p.i, p.n)
+	}
 	return nil
 }
 
+/*
+ *  Name the next construct, e.g. IF3, and so the labels it generates, e.g. IF3_end
+ *  (numbered in order, as relaxing the branches moves the code after it was named)
+ */
+func (p *parser) constructName(kind string) string {
+	p.constructs++
+	return fmt.Sprintf("%s%d", kind, p.constructs)
+}
+
 /*
  *  Parse the 'if' keyword
  */
@@ -133,7 +164,7 @@ func (p *parser) parseIf(token string) error {
 	p.skipWhitespaceAndEOL()
 
 	// Name this construct
-	name := fmt.Sprintf("IF%x", p.currentCode.endAddr)
+	name := p.constructName("IF")
 
 	// Add the instruction with the sub in the current block (before starting a new block)
 	comment := fmt.Sprintf("IF %s {", be.string)
@@ -166,7 +197,7 @@ func (p *parser) parseIf(token string) error {
 		p.skipWhitespaceAndEOL()
 
 		// Jump from the end of the IF block to after the ELSE
-		p.addExprInstructionWithSymbol("bra", modeRelative, A16, 0, endLabel, false)
+		p.addBranchAlways(endLabel)
 
 		// Add a label to where the else goes, and change the NOT IF branch to the ELSE block
 		if (skipInstr.prev != nil) && (skipInstr.prev.symbol == endLabel) {
@@ -229,7 +260,7 @@ func (p *parser) parseLoop(token string) error {
 	p.skipWhitespaceAndEOL()
 
 	// Name this construct
-	name := fmt.Sprintf("LOOP%x", p.currentCode.endAddr)
+	name := p.constructName("LOOP")
 
 	// Add the instruction with the sub in the current block (before starting a new block)
 	comment := "LOOP {"
@@ -247,15 +278,61 @@ func (p *parser) parseLoop(token string) error {
 		return err
 	}
 
-	// How far back is the top of the loop?
-	target, err := p.currentCode.lookupInstructionLabel(loopLabel)
-	distance := p.currentCode.endAddr - target
-	if (distance+2 < 0x07F) {
-		p.addExprInstructionWithSymbol("bra", modeRelative, A16, -(distance+2), loopLabel, true)
-	} else if (distance+4 < 0x7FFF) {
-		p.addExprInstructionWithSymbol("bra", modeRelative, A24, -(distance+4), loopLabel, true)
-	} else {
-		p.addExprInstructionWithSymbol("jmp", modeAbsolute, A24, target, loopLabel, true)
+	// Back to the top of the loop (lengthened later if it's too far for a short branch)
+	p.addBranchAlways(loopLabel)
+
+	// Add a label to the end of the block
+	p.addInstructionLabel(b.name + "_end")
+
+	// Go back to parsing code for the main block
+	p.endCodeBlock(sub)
+
+	return nil
+}
+
+/*
+ *  Parse the 'timed' keyword, e.g. TIMED hsync = 65 { ... }
+ *  (every path through the block is checked to take exactly that many cycles)
+ */
+func (p *parser) parseTimed(token string) error {
+	sub := new(subBlock)
+	sub.keyword = KW_TIMED
+	sub.startAddr = p.currentCode.endAddr
+	sub.endAddr = sub.startAddr
+
+	p.skipWhitespace()
+	name := p.nextAZ_az_09()
+	if (name == "") {
+		return fmt.Errorf("TIMED is missing a name, e.g. TIMED hsync = 65 { ... }")
+	}
+	p.skipWhitespace()
+	if (p.nextChar() != '=') {
+		return fmt.Errorf("TIMED %s is missing the = before the cycles", name)
+	}
+	p.skipWhitespace()
+	cycles, err := p.nextValue()
+	if (err != nil) {
+		return fmt.Errorf("TIMED %s does not specify how many cycles", name)
+	}
+	sub.cycles = cycles
+
+	p.skipWhitespace()
+	if (p.nextChar() != '{') {
+		return fmt.Errorf("missing { in TIMED")
+	}
+	p.skipWhitespaceAndEOL()
+
+	// Add the instruction with the sub in the current block (before starting a new block)
+	comment := fmt.Sprintf("TIMED %s = %d {", name, cycles)
+	p.addKeywordInstructionAndLabel(sub, comment, name)
+
+	// Add the code for the TIMED block
+	b := p.addCodeBlock(sub, "TIMED", name, false);
+
+	// Parse the code
+	err = p.parseCode(name)
+	if (err != nil) {
+		return err
 	}
 
 	// Add a label to the end of the block
@@ -301,8 +378,11 @@ func (p *parser) parseFor(token string) error {
 	} else if (sym1 == '@') {
 		p.skip(1)
 		symbol := p.nextAZ_az_09()
-		forAddress, forSz, err = p.lookupVariable(p.lastCode, symbol)
+		var found bool
+		forAddress, forSz, found, err = p.lookupVariable(p.lastCode, symbol)
 		if (err != nil) {
+			return err
+		} else if (!found) {
 			return fmt.Errorf("variable '@%s' not found", symbol)
 		}
 		if (forAddress <= 0xff) { forAddressMode = modeZeroPage } else { forAddressMode = modeAbsolute }
@@ -310,13 +390,14 @@ func (p *parser) parseFor(token string) error {
 		forMRegStr = fmt.Sprintf("@%s", symbol)
 	} else if (sym1 == '%') {
 		p.skip(1)
+		start := p.i
 		forAddress, err = p.parseRegisterOrParameter()
 		if (err != nil) {
 			return err
 		}
-		forAddressMode = modeZeroPage
+		if (forAddress <= 0xff) { forAddressMode = modeZeroPage } else { forAddressMode = modeAbsolute }
 		forIsMemory = true
-		forMRegStr = fmt.Sprintf("%R%d", forAddress)
+		forMRegStr = "%" + string(p.b[start:p.i])
 	} else if (sym1 == 'A') {
 		return fmt.Errorf("you can't iterate a FOR loop on register A")
 	} else if (sym1 == 'X') {
@@ -350,8 +431,11 @@ func (p *parser) parseFor(token string) error {
 		}
 	} else if p.isNextAZ() {
 		symbol := p.nextAZ_az_09()
-		start, err = p.lookupConstant(symbol)
+		var found bool
+		start, found, err = p.lookupConstant(symbol)
 		if (err != nil) {
+			return err
+		} else if (!found) {
 			return fmt.Errorf("constant '%s' not found", symbol)
 		}
 	} else {
@@ -387,13 +471,16 @@ func (p *parser) parseFor(token string) error {
 	} else if (sym1 == '@') {
 		p.skip(1)
 		symbol := p.nextAZ_az_09()
-		end, forSz, err = p.lookupVariable(p.lastCode, symbol)
+		var found bool
+		end, forSz, found, err = p.lookupVariable(p.lastCode, symbol)
 		if (err != nil) {
+			return err
+		} else if (!found) {
 			return fmt.Errorf("variable '@%s' not found", symbol)
 		}
 		if (end <= 0xff) { forAddressMode = modeZeroPage } else { forAddressMode = modeAbsolute }
 		endIsMemory = true
-	} else if (sym1 == '%') {
+	} else if p.isRegisterOrParameter() {
 		p.skip(1)
 		end, err = p.parseRegisterOrParameter()
 		if (err != nil) {
@@ -403,8 +490,11 @@ func (p *parser) parseFor(token string) error {
 		endIsMemory = true
 	} else if p.isNextAZ() {
 		symbol := p.nextAZ_az_09()
-		end, err = p.lookupConstant(symbol)
+		var found bool
+		end, found, err = p.lookupConstant(symbol)
 		if (err != nil) {
+			return err
+		} else if (!found) {
 			return fmt.Errorf("constant '%s' not found", symbol)
 		}
 	} else {
@@ -421,7 +511,7 @@ func (p *parser) parseFor(token string) error {
 	p.skipWhitespaceAndEOL()
 
 	// Name this construct
-	name := fmt.Sprintf("FOR%x", p.currentCode.endAddr)
+	name := p.constructName("FOR")
 
 	// Add the instruction with the sub in the current block (before starting a new block)
 	down := "DOWN "
@@ -444,8 +534,23 @@ func (p *parser) parseFor(token string) error {
 		fmt.Errorf("FOR loop range doesn't match the size of the loop register/varaible/memory")
 	}
 
+	// Without the 65C2402 prefix codes, a 16-bit or 24-bit loop counts a byte at a time
+	nb := prefixToWidth(forSz) / 8
+	if (prefixToWidth(loopSz) / 8 > nb) {
+		nb = prefixToWidth(loopSz) / 8
+	}
+	wide := (p.cpu < CPU_65C2402) && (nb > 1)
+	if (wide) && (forIsRegister) {
+		return fmt.Errorf("the %s only has an 8-bit %s, so it can't count from %d TO %d", cpuStr(p.cpu), forRegister, start, end)
+	}
+
 	// Load the start value of the loop
-	if (forIsMemory) {
+	if (wide) {
+		for k := 0; k < nb; k++ {
+			p.addExprInstruction("ldx", modeImmediate, R08, (start >> uint(8*k)) & 0xFF)
+			p.addByteInstruction("stx", forAddress, k)
+		}
+	} else if (forIsMemory) {
 		p.addExprInstruction("ldx", modeImmediate, loopSz, start)
 		p.addExprInstruction("stx", forAddressMode, forSz, forAddress)
 	} else if (forIsRegister) {
@@ -467,7 +572,9 @@ func (p *parser) parseFor(token string) error {
 
 	// Increment/Decrement the loop count
 	var mmm string
-	if (forIsMemory) {
+	if (wide) {
+		p.addWideForStep(name, forAddress, nb, sub.upDown, end+1)
+	} else if (forIsMemory) {
 		if sub.upDown { mmm = "inc" } else { mmm = "dec"}
 		p.addExprInstruction(mmm, forAddressMode, forSz, forAddress)
 		p.addExprInstruction("ldx", forAddressMode, forSz, forAddress)
@@ -518,7 +625,7 @@ func (p *parser) parseDo(token string) error {
 	p.skipWhitespaceAndEOL()
 
 	// Name this construct
-	name := fmt.Sprintf("DO%x", p.currentCode.endAddr)
+	name := p.constructName("DO")
 
 	// Add the instruction with the sub in the current block (before starting a new block)
 	comment := "DO {"
@@ -561,16 +668,8 @@ func (p *parser) parseDo(token string) error {
 	endLabel := name + "_end"
 	p.outputBooleanExpression(*be, endLabel)
 
-	// How far back is the top of the loop?
-	target, err := p.currentCode.lookupInstructionLabel(loopLabel)
-	distance := p.currentCode.endAddr - target
-	if (distance+2 < 0x07F) {
-		p.addExprInstructionWithSymbol("bra", modeRelative, A16, -(distance+2), loopLabel, true)
-	} else if (distance+4 < 0x7FFF) {
-		p.addExprInstructionWithSymbol("bra", modeRelative, A24, -(distance+4), loopLabel, true)
-	} else {
-		p.addExprInstructionWithSymbol("jmp", modeAbsolute, A24, target, loopLabel, true)
-	}
+	// Back to the top of the loop (lengthened later if it's too far for a short branch)
+	p.addBranchAlways(loopLabel)
 
 	// Add a label to the end of the block
 	p.addInstructionLabel(endLabel)
@@ -585,7 +684,9 @@ func (p *parser) parseDo(token string) error {
  *  Parse the 'while' keyword
  */
 func (p *parser) parseWhile(token string) error {
-	fmt.Printf("WHILE is not yet supported [%d-%d]\n", p.i, p.n)
+	if (!p.quiet) {
+		fmt.Printf("WHILE is not yet supported [%d-%d]\n", p.i, p.n)
+	}
 	return nil
 }
 
@@ -600,17 +701,9 @@ func (p *parser) parseContinue(token string) error {
 		return fmt.Errorf("CONTINUE called outside of a loop")
 	}
 
-	// How far back is the top of the loop?
+	// Back to the top of the loop (lengthened later if it's too far for a short branch)
 	loopLabel := strings.ToLower(loop.name + "_start")
-	target, _ := p.currentCode.lookupInstructionLabel(loopLabel)
-	distance := p.currentCode.endAddr - target
-	if (distance+2 < 0x07F) {
-		p.addExprInstructionWithSymbol("bra", modeRelative, A16, -(distance+2), loopLabel, true)
-	} else if (distance+4 < 0x7FFF) {
-		p.addExprInstructionWithSymbol("bra", modeRelative, A24, -(distance+4), loopLabel, true)
-	} else {
-		p.addExprInstructionWithSymbol("jmp", modeAbsolute, A24, target, loopLabel, true)
-	}
+	p.addBranchAlways(loopLabel)
 
 	return nil
 }
@@ -626,8 +719,9 @@ func (p *parser) parseBreak(token string) error {
 		return fmt.Errorf("CONTINUE called outside of a loop")
 	}
 
+	// Out of the loop (lengthened later if it's too far for a short branch)
 	label := strings.ToLower(loop.name + "_end")
-	p.addExprInstructionWithSymbol("bra", modeRelative, A24, 0, label, false)
+	p.addBranchAlways(label)
 
 	return nil
 }
@@ -643,8 +737,11 @@ func (p *parser) parseReturn(token string) error {
 	// Constant
 	if (p.isNextAZ()) {
 		symbol := p.nextAZ_az_09()
-		value, err = p.lookupConstant(symbol)
+		var found bool
+		value, found, err = p.lookupConstant(symbol)
 		if (err != nil) {
+			return err
+		} else if (!found) {
 			return fmt.Errorf("invalid constant '%s' in RETURN", symbol)
 		}
 	// Value
@@ -656,6 +753,24 @@ func (p *parser) parseReturn(token string) error {
 		hasValue = true
 	}
 
+	// RETURN from a THREAD ends the thread
+	if (p.lastCode.kind == BLK_THREAD) {
+		if hasValue {
+			return fmt.Errorf("RETURN from a THREAD can not return a value")
+		}
+		p.addExprInstruction("thr", modeImplicit, A16, 0)
+		return nil
+	}
+
+	// RETURN from an ISR/NMI restores the registers before the RTI
+	if (p.lastCode.kind != BLK_SUB) {
+		if hasValue {
+			return fmt.Errorf("RETURN from an %s can not return a value", strings.ToUpper(blockKindStr(p.lastCode.kind)))
+		}
+		p.addExprInstructionWithSymbol("jmp", modeAbsolute, p.abWidth, 0, interruptExitLabel(p.lastCode), false)
+		return nil
+	}
+
 	if hasValue {
 		returnSz := R08
 		if value > 0x0FFFFFF {
@@ -730,8 +845,11 @@ func (p *parser) parseBooleanExpression(keyword string) (*boolExpr, error) {
 		// Constant
 		if (p.isNextAZ()) {
 			symbol := p.nextAZ_az_09()
-			be.value, err = p.lookupConstant(symbol)
+			var found bool
+			be.value, found, err = p.lookupConstant(symbol)
 			if (err != nil) {
+				return nil, err
+			} else if (!found) {
 				return nil, fmt.Errorf("invalid constant '%s' in %s", symbol, keyword)
 			}
 			if (p.peekChar() == '+') {
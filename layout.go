@@ -0,0 +1,168 @@
+package aCCembler
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Where the %Rn registers and %%n.k parameters are, unless moved by #registers and #params
+const (
+	REGISTER_BASE = 0x00		// %R0 = $00
+	REGISTER_COUNT = 0x100		//   through %R255 = $FF
+	PARAM_BASE = 0xD000			// %%0 = $D000
+	PARAM_STRIDE = 0x100		//   %%1 = $D100, ...
+	PARAM_COUNT = 9				//   through %%8 = $D800
+)
+
+
+/*
+ *  Parse the #registers directive, e.g. #registers $80 or #registers $80 count 16
+ */
+func (p *parser) parseRegisters() error {
+	if (p.regUsed) {
+		return fmt.Errorf("#registers must come before the first %%R register (or expression that saves a register in %%R0)")
+	}
+	if (p.regSet) {
+		return fmt.Errorf("#registers can only be set once")
+	}
+
+	base, err := p.nextValue()
+	if (err != nil) {
+		return fmt.Errorf("#registers needs a zero page address (%s)", err)
+	} else if (base < 0) || (base > 0xFF) {
+		return fmt.Errorf("#registers must be in the zero page, not $%x", base)
+	}
+
+	count := 0x100 - base
+	p.skipWhitespace()
+	if (p.peekAZ_az_09() != "") {
+		keyword := strings.ToLower(p.nextAZ_az_09())
+		if (keyword != "count") {
+			return fmt.Errorf("was expecting 'count' after #registers $%02x, not '%s'", base, keyword)
+		}
+		p.skipWhitespace()
+		count, err = p.nextValue()
+		if (err != nil) {
+			return fmt.Errorf("#registers count %s", err)
+		} else if (count < 1) || (base + count > 0x100) {
+			return fmt.Errorf("#registers $%02x count %d doesn't fit in the zero page", base, count)
+		}
+	}
+
+	p.regBase = base
+	p.regCount = count
+	p.regSet = true
+
+	p.skipWhitespaceAndEOL()
+	return nil
+}
+
+/*
+ *  Parse the #params directive, e.g. #params $0300 or #params $0300 stride $20
+ */
+func (p *parser) parseParams() error {
+	if (p.paramUsed) {
+		return fmt.Errorf("#params must come before the first %%%% parameter")
+	}
+	if (p.paramSet) {
+		return fmt.Errorf("#params can only be set once")
+	}
+
+	base, err := p.nextValue()
+	if (err != nil) {
+		return fmt.Errorf("#params needs an address (%s)", err)
+	}
+
+	stride := PARAM_STRIDE
+	p.skipWhitespace()
+	if (p.peekAZ_az_09() != "") {
+		keyword := strings.ToLower(p.nextAZ_az_09())
+		if (keyword != "stride") {
+			return fmt.Errorf("was expecting 'stride' after #params $%04x, not '%s'", base, keyword)
+		}
+		p.skipWhitespace()
+		stride, err = p.nextValue()
+		if (err != nil) {
+			return fmt.Errorf("#params stride %s", err)
+		} else if (stride < 1) {
+			return fmt.Errorf("#params stride must be at least 1, not %d", stride)
+		}
+	}
+	if (base < 0) || (base + PARAM_COUNT*stride > 0x1000000) {
+		return fmt.Errorf("#params $%x stride $%x goes past the end of memory", base, stride)
+	}
+
+	p.paramBase = base
+	p.paramStride = stride
+	p.paramSet = true
+
+	p.skipWhitespaceAndEOL()
+	return nil
+}
+
+/*
+ *  The address of the register, checking that all its bytes are inside the registers
+ */
+func (p *parser) registerAddress(n int, bytes int) (int, error) {
+	p.regUsed = true
+	if (n < 0) || (n + bytes > p.regCount) {
+		if (bytes > 1) {
+			return 0, fmt.Errorf("the %d bytes of register %d don't fit in the %d registers at $%02x", bytes, n, p.regCount, p.regBase)
+		}
+		return 0, fmt.Errorf("register %d is outside the %d registers at $%02x", n, p.regCount, p.regBase)
+	}
+
+	return p.regBase + n, nil
+}
+
+/*
+ *  The address of %R0, where an expression saves a register while it works on another
+ *  (checking that the bytes of the register fit in the registers)
+ */
+func (p *parser) scratchAddress(size int) (int, error) {
+	bytes := prefixToWidth(size) / 8
+	if (bytes > p.regCount) {
+		return 0, fmt.Errorf("the expression saves %d bytes in %%R0, but there are only %d registers at $%02x", bytes, p.regCount, p.regBase)
+	}
+
+	p.regUsed = true
+	return p.regBase, nil
+}
+
+/*
+ *  The address of byte k of parameter n, checking that it is inside that parameter
+ */
+func (p *parser) paramAddress(n int, k int) (int, error) {
+	p.paramUsed = true
+	if (n < 0) || (n >= PARAM_COUNT) {
+		return 0, fmt.Errorf("invalid value %%%%%d, must instead be %%%%0. through %%%%%d.", n, PARAM_COUNT-1)
+	}
+	if (k < 0) || (k >= p.paramStride) {
+		return 0, fmt.Errorf("%%%%%d.%d is outside the $%x bytes of that parameter", n, k, p.paramStride)
+	}
+
+	return p.paramBase + n*p.paramStride + k, nil
+}
+
+/*
+ *  List where the registers and parameters are (when moved by #registers or #params),
+ *  and the top-level named registers
+ */
+func (p *parser) outputLayout(listing *os.File) {
+	if (p.regSet) {
+		line := fmt.Sprintf("%06x-%06x   ; REGISTERS %%R0-%%R%d\n", p.regBase, p.regBase+p.regCount-1, p.regCount-1)
+		listing.WriteString(line)
+	}
+	if (p.paramSet) {
+		for n := 0; n < PARAM_COUNT; n++ {
+			start := p.paramBase + n*p.paramStride
+			line := fmt.Sprintf("%06x-%06x   ; PARAMS %%%%%d\n", start, start+p.paramStride-1, n)
+			listing.WriteString(line)
+		}
+	}
+	for r := p.reg; r != nil; r = r.next {
+		line := fmt.Sprintf("%06x-%06x   ; REG %s = %%R%d.%s\n", r.address, r.address+registerBytes(r.size)-1, r.name, r.n, widthSuffix(prefixToWidth(r.size)))
+		listing.WriteString(line)
+	}
+}
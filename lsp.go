@@ -0,0 +1,802 @@
+package aCCembler
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The Language Server Protocol server, over stdin/stdout
+type lspServer struct {
+	in			*bufio.Reader
+	out			io.Writer
+	docs		map[string]string	// the text of each open document, by URI
+	cpu			int					// target CPU (unless the document has a #cpu)
+	warn		warningFlags		// every -W
+	include		includeFlags		//   and -I
+	shutdown	bool
+}
+
+// A JSON-RPC request, response, or notification
+type lspMessage struct {
+	JSONRPC		string			`json:"jsonrpc"`
+	ID			json.RawMessage	`json:"id,omitempty"`
+	Method		string			`json:"method,omitempty"`
+	Params		json.RawMessage	`json:"params,omitempty"`
+}
+
+// Positions and ranges are from 0, unlike the lines of the parser
+type lspPosition struct {
+	Line		int				`json:"line"`
+	Character	int				`json:"character"`
+}
+type lspRange struct {
+	Start		lspPosition		`json:"start"`
+	End			lspPosition		`json:"end"`
+}
+type lspLocation struct {
+	URI			string			`json:"uri"`
+	Range		lspRange		`json:"range"`
+}
+type lspDiagnostic struct {
+	Range		lspRange		`json:"range"`
+	Severity	int				`json:"severity"`		// 1 error, 2 warning
+	Source		string			`json:"source"`
+	Message		string			`json:"message"`
+}
+type lspCompletion struct {
+	Label		string			`json:"label"`
+	Kind		int				`json:"kind"`			// 14 keyword, 21 constant, 6 variable, 3 function, 18 reference
+	Detail		string			`json:"detail,omitempty"`
+	TextEdit	*lspTextEdit	`json:"textEdit,omitempty"`
+}
+type lspTextEdit struct {
+	Range		lspRange		`json:"range"`
+	NewText		string			`json:"newText"`
+}
+
+// The parameters of the requests and notifications
+type lspTextDocument struct {
+	URI			string			`json:"uri"`
+	Text		string			`json:"text"`
+}
+type lspDocumentParams struct {
+	TextDocument	lspTextDocument	`json:"textDocument"`
+	Position		lspPosition		`json:"position"`
+	Text			*string			`json:"text"`
+	ContentChanges	[]struct {
+		Text	string			`json:"text"`
+	}							`json:"contentChanges"`
+	Context			struct {
+		IncludeDeclaration	bool	`json:"includeDeclaration"`
+	}							`json:"context"`
+}
+
+// What a name in the source is
+type lspSymbol struct {
+	kind		string			// CONST, GLOBAL, VAR, REG, SUB, ISR, NMI, THREAD, DATA, or label
+	name		string
+	filename	string
+	line		int				// where it is defined
+	block		*codeBlock		// the top-level block of a label, VAR, or REG (else nil)
+	about		string			// the hover text
+}
+
+// Where an error message says the line, e.g. [line 12]
+var lspLineRegexp = regexp.MustCompile(`\[line (\d+)\]`)
+
+
+/*
+ *  aCCemble lsp [-cpu target] [-W name] [-I folder]
+ *  (speaks the Language Server Protocol over stdin/stdout, e.g. for an editor)
+ */
+func lspCommand(args []string) {
+	flags := flag.NewFlagSet("lsp", flag.ExitOnError)
+	cpuFlag := flags.String("cpu", "65c24t8", "target CPU (6502, 65c02, w65c02, 65c2402, or 65c24t8)")
+	var warnFlags warningFlags
+	flags.Var(&warnFlags, "W", "turn a warning on (name), off (no-name), or into an error (error=name), or all, or error")
+	var includeDirs includeFlags
+	flags.Var(&includeDirs, "I", "a folder to search for #include and #incbin files (after the folder of the file)")
+	flags.Parse(args)
+
+	cpu, err := lookupCPU(*cpuFlag)
+	if (err != nil) {
+		fmt.Fprintf(os.Stderr, "ERROR: %v\n", err);
+		os.Exit(2)
+	}
+	err = newParser(cpu).setWarnings(warnFlags)
+	if (err != nil) {
+		fmt.Fprintf(os.Stderr, "ERROR: %v\n", err);
+		os.Exit(2)
+	}
+
+	s := &lspServer{bufio.NewReader(os.Stdin), os.Stdout, make(map[string]string), cpu, warnFlags, includeDirs, false}
+	for {
+		msg, err := s.read()
+		if (err == io.EOF) {
+			return
+		} else if (err != nil) {
+			fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+			return
+		}
+		if (msg.Method == "exit") {
+			if (s.shutdown) {
+				os.Exit(0)
+			}
+			os.Exit(1)
+		}
+		s.handle(msg)
+	}
+}
+
+/*
+ *  Read the next message, i.e. the Content-Length header, a blank line, and the JSON
+ */
+func (s *lspServer) read() (*lspMessage, error) {
+	length := -1
+	for {
+		line, err := s.in.ReadString('\n')
+		if (err != nil) {
+			return nil, err
+		}
+		line = strings.TrimSpace(line)
+		if (line == "") {
+			break
+		}
+		if (strings.HasPrefix(strings.ToLower(line), "content-length:")) {
+			length, err = strconv.Atoi(strings.TrimSpace(line[15:]))
+			if (err != nil) {
+				return nil, fmt.Errorf("invalid %s", line)
+			}
+		}
+	}
+	if (length < 0) {
+		return nil, fmt.Errorf("the message is missing the Content-Length")
+	}
+
+	body := make([]uint8, length)
+	_, err := io.ReadFull(s.in, body)
+	if (err != nil) {
+		return nil, err
+	}
+	msg := new(lspMessage)
+	err = json.Unmarshal(body, msg)
+	if (err != nil) {
+		return nil, err
+	}
+
+	return msg, nil
+}
+
+/*
+ *  Write a message (a response when id isn't nil, else a notification)
+ */
+func (s *lspServer) write(id json.RawMessage, method string, value interface{}) {
+	msg := map[string]interface{}{"jsonrpc": "2.0"}
+	if (id != nil) {
+		msg["id"] = id
+		msg["result"] = value
+	} else {
+		msg["method"] = method
+		msg["params"] = value
+	}
+	body, _ := json.Marshal(msg)
+	fmt.Fprintf(s.out, "Content-Length: %d\r\n\r\n%s", len(body), body)
+}
+
+/*
+ *  Answer a request, or act on a notification
+ */
+func (s *lspServer) handle(msg *lspMessage) {
+	var params lspDocumentParams
+	if (msg.Params != nil) {
+		json.Unmarshal(msg.Params, &params)
+	}
+	uri := params.TextDocument.URI
+
+	switch (msg.Method) {
+	case "initialize":
+		s.write(msg.ID, "", map[string]interface{}{
+			"capabilities": map[string]interface{}{
+				"textDocumentSync": map[string]interface{}{
+					"openClose": true,
+					"change": 1,			// the full text
+					"save": map[string]interface{}{"includeText": true},
+				},
+				"definitionProvider": true,
+				"hoverProvider": true,
+				"referencesProvider": true,
+				"completionProvider": map[string]interface{}{"triggerCharacters": []string{"."}},
+			},
+			"serverInfo": map[string]interface{}{"name": "aCCemble lsp"},
+		})
+	case "shutdown":
+		s.shutdown = true
+		s.write(msg.ID, "", nil)
+	case "textDocument/didOpen":
+		s.docs[uri] = params.TextDocument.Text
+		s.publishDiagnostics(uri)
+	case "textDocument/didChange":
+		if (len(params.ContentChanges) > 0) {
+			s.docs[uri] = params.ContentChanges[len(params.ContentChanges)-1].Text
+		}
+	case "textDocument/didSave":
+		if (params.Text != nil) {
+			s.docs[uri] = *params.Text
+		}
+		s.publishDiagnostics(uri)
+	case "textDocument/didClose":
+		delete(s.docs, uri)
+		s.write(nil, "textDocument/publishDiagnostics", map[string]interface{}{"uri": uri, "diagnostics": []lspDiagnostic{}})
+	case "textDocument/definition":
+		p, _ := s.analyze(uri)
+		if sym := s.symbolAt(p, uri, params.Position); (sym != nil) {
+			s.write(msg.ID, "", s.location(uri, sym.filename, sym.line, sym.name))
+		} else {
+			s.write(msg.ID, "", nil)
+		}
+	case "textDocument/hover":
+		p, _ := s.analyze(uri)
+		about := ""
+		if sym := s.symbolAt(p, uri, params.Position); (sym != nil) {
+			about = sym.about
+		} else {
+			about = mnemonicAbout(wordAt(s.docs[uri], params.Position), p.cpu)
+		}
+		if (about == "") {
+			s.write(msg.ID, "", nil)
+		} else {
+			s.write(msg.ID, "", map[string]interface{}{"contents": map[string]string{"kind": "plaintext", "value": about}})
+		}
+	case "textDocument/references":
+		p, _ := s.analyze(uri)
+		s.write(msg.ID, "", s.references(p, uri, params.Position, params.Context.IncludeDeclaration))
+	case "textDocument/completion":
+		p, _ := s.analyze(uri)
+		s.write(msg.ID, "", s.completions(p, uri, params.Position))
+	default:
+		// Any other request gets an empty answer (notifications, e.g. initialized, get none)
+		if (msg.ID != nil) {
+			s.write(msg.ID, "", nil)
+		}
+	}
+}
+
+/*
+ *  The filename of a file:// URI
+ */
+func uriToFilename(uri string) string {
+	if (strings.HasPrefix(uri, "file://")) {
+		path, err := url.PathUnescape(uri[7:])
+		if (err == nil) {
+			return path
+		}
+		return uri[7:]
+	}
+	return uri
+}
+
+/*
+ *  Parse the document, then resolve the symbols and check the addresses as when assembling
+ *  (returning the parser, with everything it could parse, and any errors and warnings)
+ */
+func (s *lspServer) analyze(uri string) (p *parser, diags []lspDiagnostic) {
+	filename := uriToFilename(uri)
+	p = newParser(s.cpu)
+	p.quiet = true
+	p.setWarnings(s.warn)
+	p.includePaths = s.include
+
+	// Report a crash on a half-written line as an error, instead of stopping the server
+	defer func() {
+		if r := recover(); (r != nil) {
+			diags = append(diags, lspError(p.n, fmt.Sprintf("%v", r)))
+		}
+		p.b = []uint8{';'}		// so a lookup doesn't read past the end of the file (plusOrMinus)
+		p.i = 0
+		p.end = 1
+	}()
+
+	err := p.parseFile(filename, []uint8(s.docs[uri]))
+	if (err != nil) {
+		diags = append(diags, lspError(p.n, err.Error()))
+	} else {
+		err = p.resolveSpawns()
+		if (err == nil) {
+			err = p.resolveSymbols()
+		}
+		if (err == nil) {
+			err = p.checkVectors()
+		}
+		if (err == nil) {
+			err = p.checkAddressRanges()
+		}
+		if (err == nil) {
+			p.checkUnusedSymbols()
+			for b := p.code; (b != nil) && (err == nil); b = b.next {
+				err = p.checkTimedBlocks(b)
+			}
+		}
+		if (err != nil) {
+			line := 1
+			if e, ok := err.(*sourceError); (ok) {
+				if (e.filename == filename) {
+					diags = append(diags, lspError(e.line, e.err.Error()))
+				}
+			} else {
+				if m := lspLineRegexp.FindStringSubmatch(err.Error()); (m != nil) {
+					line, _ = strconv.Atoi(m[1])
+				}
+				diags = append(diags, lspError(line, err.Error()))
+			}
+		}
+	}
+
+	for _, w := range p.warnings {
+		if (w.filename == filename) {
+			d := lspError(w.line, fmt.Sprintf("%s [-W %s]", w.msg, warningClasses[w.class].name))
+			d.Severity = 2
+			diags = append(diags, d)
+		}
+	}
+
+	return p, diags
+}
+
+/*
+ *  An error on the whole of a line (from 1)
+ */
+func lspError(line int, msg string) lspDiagnostic {
+	if (line < 1) {
+		line = 1
+	}
+	return lspDiagnostic{lspRange{lspPosition{line-1, 0}, lspPosition{line-1, 1000}}, 1, "aCCemble", msg}
+}
+
+/*
+ *  Send the errors and warnings in the document
+ */
+func (s *lspServer) publishDiagnostics(uri string) {
+	_, diags := s.analyze(uri)
+	if (diags == nil) {
+		diags = []lspDiagnostic{}
+	}
+	s.write(nil, "textDocument/publishDiagnostics", map[string]interface{}{"uri": uri, "diagnostics": diags})
+}
+
+/*
+ *  The word (letters, digits, and _) at the position
+ */
+func wordAt(text string, pos lspPosition) string {
+	start, end := wordRange(text, pos)
+	lines := strings.Split(text, "\n")
+	if (pos.Line < 0) || (pos.Line >= len(lines)) {
+		return ""
+	}
+	return lines[pos.Line][start:end]
+}
+
+func wordRange(text string, pos lspPosition) (int, int) {
+	lines := strings.Split(text, "\n")
+	if (pos.Line < 0) || (pos.Line >= len(lines)) {
+		return 0, 0
+	}
+	line := lines[pos.Line]
+	start := pos.Character
+	if (start < 0) {
+		start = 0
+	} else if (start > len(line)) {
+		start = len(line)
+	}
+	end := start
+	for (start > 0) && (isWordChar(line[start-1])) {
+		start -= 1
+	}
+	for (end < len(line)) && (isWordChar(line[end])) {
+		end += 1
+	}
+	return start, end
+}
+
+func isWordChar(c byte) bool {
+	return ((c >= 'a') && (c <= 'z')) || ((c >= 'A') && (c <= 'Z')) || ((c >= '0') && (c <= '9')) || (c == '_')
+}
+
+/*
+ *  The top-level block the line (from 1) is in
+ */
+func (p *parser) blockAtLine(filename string, line int) *codeBlock {
+	for b := p.code; b != nil; b = b.next {
+		if (b.filename == filename) && (line >= b.line) && (line <= b.endLine) {
+			return b
+		}
+	}
+	return nil
+}
+
+/*
+ *  The symbol named at the position
+ */
+func (s *lspServer) symbolAt(p *parser, uri string, pos lspPosition) *lspSymbol {
+	word := wordAt(s.docs[uri], pos)
+	if (word == "") || (p == nil) {
+		return nil
+	}
+	return p.lookupSymbol(word, p.blockAtLine(uriToFilename(uri), pos.Line+1), pos.Line+1)
+}
+
+/*
+ *  What the name is, looking first in the block (labels, then VARs and REGs), then
+ *  at the CONSTs, GLOBALs, REGs, SUBs, and DATA
+ */
+func (p *parser) lookupSymbol(name string, b *codeBlock, line int) *lspSymbol {
+	nameLC := strings.ToLower(name)
+
+	if (b != nil) {
+		// A label in the block
+		if i := findLabel(b, nameLC); (i != nil) {
+			address, _ := b.lookupInstructionLabel(nameLC)
+			return &lspSymbol{"label", i.symbol, b.filename, i.line, b,
+				fmt.Sprintf("%s: @$%04x in %s %s", i.symbol, address, strings.ToUpper(blockKindStr(b.kind)), b.name)}
+		}
+
+		// A VAR (or parameter) or REG in the block or one of its sub-blocks
+		if v, in := findVariable(b, nameLC, line); (v != nil) {
+			if vv := p.lookupVariableName(in, nameLC); (vv != nil) {
+				return &lspSymbol{"VAR", v.name, b.filename, v.line, b,
+					fmt.Sprintf("VAR %s @$%04x (%d-bit)", v.name, vv.address, prefixToWidth(vv.size))}
+			}
+		}
+		if r := findRegister(b, nameLC); (r != nil) {
+			return &lspSymbol{"REG", r.name, b.filename, r.line, b,
+				fmt.Sprintf("REG %s = %%R%d @$%02x (%d-bit)", r.name, r.n, r.address, prefixToWidth(r.size))}
+		}
+	}
+
+	for c := p.cnst; c != nil; c = c.next {
+		if (c.nameLC == nameLC) {
+			return &lspSymbol{"CONST", c.name, c.filename, c.line, nil,
+				fmt.Sprintf("CONST %s = %d ($%x, %d-bit)", c.name, c.value, c.value, prefixToWidth(valueToPrefix(c.value)))}
+		}
+	}
+	for v := p.global; v != nil; v = v.next {
+		if (v.nameLC == nameLC) {
+			return &lspSymbol{"GLOBAL", v.name, v.filename, v.line, nil,
+				fmt.Sprintf("GLOBAL %s @$%04x (%d-bit)", v.name, v.address, prefixToWidth(v.size))}
+		}
+	}
+	for r := p.reg; r != nil; r = r.next {
+		if (r.nameLC == nameLC) {
+			return &lspSymbol{"REG", r.name, p.filename, r.line, nil,
+				fmt.Sprintf("REG %s = %%R%d @$%02x (%d-bit)", r.name, r.n, r.address, prefixToWidth(r.size))}
+		}
+	}
+	if c := p.lookupSubroutineName(nameLC); (c != nil) {
+		kind := strings.ToUpper(blockKindStr(c.kind))
+		return &lspSymbol{kind, c.name, c.filename, c.line, nil,
+			fmt.Sprintf("%s %s @$%04x-$%04x (%d bytes)", kind, c.name, c.startAddr, c.endAddr, c.endAddr - c.startAddr)}
+	}
+	if address, err := p.lookupDataName(nameLC); (err == nil) {
+		for d := p.data; d != nil; d = d.next {
+			if (d.nameLC == nameLC) {
+				return &lspSymbol{"DATA", d.name, d.filename, d.line, nil,
+					fmt.Sprintf("DATA %s @$%04x-$%04x (%d bytes)", d.name, d.startAddr, d.endAddr, d.endAddr - d.startAddr)}
+			}
+			for e := d.data; e != nil; e = e.next {
+				if (e.size == DLABEL) && (strings.ToLower(e.label) == nameLC) {
+					return &lspSymbol{"label", e.label, d.filename, e.line, nil,
+						fmt.Sprintf("%s: @$%04x in DATA %s", e.label, address, d.name)}
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+/*
+ *  The label written in the block (or its sub-blocks)
+ */
+func findLabel(b *codeBlock, nameLC string) *instruction {
+	for i := b.instr; i != nil; i = i.next {
+		if (i.subBlock != nil) {
+			if l := findLabel(i.subBlock.block, nameLC); (l != nil) {
+				return l
+			}
+		} else if (i.mnemonic == 0) && (i.source) && (i.symbolLC == nameLC) {
+			return i
+		}
+	}
+	return nil
+}
+
+/*
+ *  The VAR in the block (or its sub-blocks) defined closest before the line, and the block it is in
+ */
+func findVariable(b *codeBlock, nameLC string, line int) (*vrbl, *codeBlock) {
+	var found *vrbl
+	var in *codeBlock
+	for v := b.vrbl; v != nil; v = v.next {
+		if (v.nameLC == nameLC) {
+			found, in = v, b
+		}
+	}
+	for i := b.instr; i != nil; i = i.next {
+		if (i.subBlock != nil) {
+			if v, sub := findVariable(i.subBlock.block, nameLC, line); (v != nil) && ((found == nil) || ((v.line <= line) && (v.line > found.line))) {
+				found, in = v, sub
+			}
+		}
+	}
+	return found, in
+}
+
+/*
+ *  The named register in the block (or its sub-blocks)
+ */
+func findRegister(b *codeBlock, nameLC string) *rgstr {
+	for r := b.reg; r != nil; r = r.next {
+		if (r.nameLC == nameLC) {
+			return r
+		}
+	}
+	for i := b.instr; i != nil; i = i.next {
+		if (i.subBlock != nil) {
+			if r := findRegister(i.subBlock.block, nameLC); (r != nil) {
+				return r
+			}
+		}
+	}
+	return nil
+}
+
+/*
+ *  The location of the name on the line (from 1) of the file
+ */
+func (s *lspServer) location(uri string, filename string, line int, name string) lspLocation {
+	if (filename != uriToFilename(uri)) {
+		uri = "file://" + filename
+	}
+	column := 0
+	if text, ok := s.docs[uri]; ok {
+		lines := strings.Split(text, "\n")
+		if (line >= 1) && (line <= len(lines)) {
+			if k := strings.Index(strings.ToLower(lines[line-1]), strings.ToLower(name)); (k >= 0) {
+				column = k
+			}
+		}
+	}
+	return lspLocation{uri, lspRange{lspPosition{line-1, column}, lspPosition{line-1, column + len(name)}}}
+}
+
+/*
+ *  Every place the symbol at the position is named in the open documents
+ *  (outside of comments and quotes, and only inside its block for a label, VAR, or REG)
+ */
+func (s *lspServer) references(p *parser, uri string, pos lspPosition, declaration bool) []lspLocation {
+	locations := []lspLocation{}
+	sym := s.symbolAt(p, uri, pos)
+	if (sym == nil) {
+		return locations
+	}
+
+	uris := []string{}
+	for u := range s.docs {
+		uris = append(uris, u)
+	}
+	sort.Strings(uris)
+	nameLC := strings.ToLower(sym.name)
+	for _, u := range uris {
+		filename := uriToFilename(u)
+		if (sym.block != nil) && (filename != sym.block.filename) {
+			continue
+		}
+		inComment := false
+		for n, line := range strings.Split(s.docs[u], "\n") {
+			code := line
+			if (inComment) {
+				end := strings.Index(code, "*/")
+				if (end < 0) {
+					continue
+				}
+				code = strings.Repeat(" ", end+2) + code[end+2:]
+				inComment = false
+			}
+			code, _, inComment = splitComment(code)
+			if (sym.block != nil) && ((n+1 < sym.block.line) || (n+1 > sym.block.endLine)) {
+				continue
+			}
+			if (!declaration) && (filename == sym.filename) && (n+1 == sym.line) {
+				continue
+			}
+			for _, k := range wordIndexes(code, nameLC) {
+				locations = append(locations, lspLocation{u, lspRange{lspPosition{n, k}, lspPosition{n, k + len(nameLC)}}})
+			}
+		}
+	}
+
+	return locations
+}
+
+/*
+ *  Where the whole word is in the code (in any case, outside of quotes)
+ */
+func wordIndexes(code string, wordLC string) []int {
+	var found []int
+	quote := byte(0)
+	for k := 0; k < len(code); k++ {
+		c := code[k]
+		if (quote != 0) {
+			if (c == quote) {
+				quote = 0
+			}
+			continue
+		}
+		if (c == '"') || (c == '\'') {
+			quote = c
+			continue
+		}
+		if (isWordChar(c)) {
+			end := k
+			for (end < len(code)) && (isWordChar(code[end])) {
+				end += 1
+			}
+			if (strings.ToLower(code[k:end]) == wordLC) {
+				found = append(found, k)
+			}
+			k = end - 1
+		}
+	}
+	return found
+}
+
+/*
+ *  The mnemonics and keywords (at the start of a line), the width suffixes of a mnemonic
+ *  (after its '.'), or the symbols (anywhere else)
+ */
+func (s *lspServer) completions(p *parser, uri string, pos lspPosition) []lspCompletion {
+	items := []lspCompletion{}
+	lines := strings.Split(s.docs[uri], "\n")
+	if (pos.Line < 0) || (pos.Line >= len(lines)) {
+		return items
+	}
+	line := lines[pos.Line]
+	end := pos.Character
+	if (end < 0) {
+		end = 0
+	} else if (end > len(line)) {
+		end = len(line)
+	}
+	start := end
+	for (start > 0) && ((isWordChar(line[start-1])) || (line[start-1] == '.')) {
+		start -= 1
+	}
+	token := strings.ToLower(line[start:end])
+	replace := lspRange{lspPosition{pos.Line, start}, lspPosition{pos.Line, end}}
+
+	// The widths of the mnemonic, e.g. lda.w
+	if dot := strings.Index(token, "."); (dot >= 0) {
+		for _, suffix := range mnemonicSuffixes(token[:dot], p.cpu) {
+			items = append(items, lspCompletion{token[:dot] + suffix, 14, widthSuffixAbout(suffix), &lspTextEdit{replace, token[:dot] + suffix}})
+		}
+		return items
+	}
+
+	// The mnemonics and keywords start a line (after any label)
+	before := strings.TrimSpace(line[:start])
+	if (before == "") || (strings.HasSuffix(before, ":")) || (before == "}") {
+		seen := make(map[string]bool)
+		for m := range mnemonics {
+			name := mnemonics[m].name
+			if (m == 0) || (seen[name]) || (len(mnemonicSuffixes(name, p.cpu)) == 0) {
+				continue
+			}
+			seen[name] = true
+			items = append(items, lspCompletion{name, 14, "mnemonic", nil})
+		}
+		for _, keyword := range keywords {
+			items = append(items, lspCompletion{strings.ToUpper(keyword), 14, "keyword", nil})
+		}
+		items = append(items, lspCompletion{"ELSE", 14, "keyword", nil})
+		return items
+	}
+
+	// The symbols
+	for c := p.cnst; c != nil; c = c.next {
+		items = append(items, lspCompletion{c.name, 21, "CONST", nil})
+	}
+	for v := p.global; v != nil; v = v.next {
+		items = append(items, lspCompletion{v.name, 6, "GLOBAL", nil})
+	}
+	for r := p.reg; r != nil; r = r.next {
+		items = append(items, lspCompletion{r.name, 6, "REG", nil})
+	}
+	for b := p.code; b != nil; b = b.next {
+		items = append(items, lspCompletion{b.name, 3, strings.ToUpper(blockKindStr(b.kind)), nil})
+	}
+	for d := p.data; d != nil; d = d.next {
+		items = append(items, lspCompletion{d.name, 21, "DATA", nil})
+	}
+	if b := p.blockAtLine(uriToFilename(uri), pos.Line+1); (b != nil) {
+		for _, it := range flattenCodeBlock(b, nil) {
+			if (it.i.mnemonic == 0) && (it.i.source) {
+				items = append(items, lspCompletion{it.i.symbol, 18, "label", nil})
+			}
+		}
+		for v := b.vrbl; v != nil; v = v.next {
+			items = append(items, lspCompletion{v.name, 6, "VAR", nil})
+		}
+	}
+
+	return items
+}
+
+/*
+ *  The width suffixes the target CPU has for the mnemonic, e.g. "" ".w" ".t" ".a24" for lda
+ *  (none when the CPU doesn't have the mnemonic)
+ */
+func mnemonicSuffixes(name string, cpu int) []string {
+	var suffixes []string
+	seen := make(map[string]bool)
+	for m := range mnemonics {
+		if (m == 0) || (mnemonics[m].name != name) {
+			continue
+		}
+		for _, o := range mnemonics[m].opcode {
+			c := opcodeCPU(name, o.mode, o.size)
+			if (c > cpu) || ((c == CPU_W65C02) && (cpu != CPU_W65C02)) {
+				continue
+			}
+			suffix := sizeToSuffix(o.size)
+			if (!seen[suffix]) {
+				seen[suffix] = true
+				suffixes = append(suffixes, suffix)
+			}
+		}
+	}
+	sort.Strings(suffixes)
+	return suffixes
+}
+
+/*
+ *  Explain the width suffix in a string
+ */
+func widthSuffixAbout(suffix string) string {
+	about := []string{}
+	if (strings.Contains(suffix, ".w")) {
+		about = append(about, "16-bit register")
+	} else if (strings.Contains(suffix, ".t")) {
+		about = append(about, "24-bit register")
+	} else {
+		about = append(about, "8-bit register")
+	}
+	if (strings.Contains(suffix, ".a24")) {
+		about = append(about, "24-bit address")
+	}
+	return strings.Join(about, ", ")
+}
+
+/*
+ *  The hover text of a mnemonic, i.e. its width suffixes on the target CPU
+ */
+func mnemonicAbout(word string, cpu int) string {
+	name := strings.ToLower(word)
+	suffixes := mnemonicSuffixes(name, cpu)
+	if (len(suffixes) == 0) {
+		return ""
+	}
+	for k := range suffixes {
+		if (suffixes[k] == "") {
+			suffixes[k] = "(none)"
+		}
+	}
+	return fmt.Sprintf("%s on the %s: %s", strings.ToUpper(name), cpuStr(cpu), strings.Join(suffixes, " "))
+}
@@ -47,6 +47,8 @@ const (
 	// Added on the 65c2402
 	modeX
 	modeXY
+	// Added on the WDC 65C02
+	modeZeroPageRelative
 )
 
 // All the valid assembly language mnemonics
@@ -427,7 +429,7 @@ var opSTA = []opcode {
 	{modeZeroPage, R08, 0x85, 2}, {modeZeroPage, R16, 0x85, 3}, {modeZeroPage, R24, 0x85, 3},
 	{modeZeroPageX, R08, 0x95, 2}, {modeZeroPageX, R16, 0x95, 3}, {modeZeroPageX, R24, 0x95, 3},
 	{modeZeroPageY, R08, 0x99, 3}, {modeZeroPageY, R16, 0x99, 4}, {modeZeroPageY, R24, 0x99, 4},
-	{modeZeroPageY, A24, 0x99, 5}, {modeZeroPageY, W16, 0x99, 4}, {modeZeroPageY, W24, 0x99, 5},
+	{modeZeroPageY, A24, 0x99, 5}, {modeZeroPageY, W16, 0x99, 5}, {modeZeroPageY, W24, 0x99, 5},
 	{modeAbsolute, A16, 0x8D, 3}, {modeAbsolute, A24, 0x8D, 5},
 		{modeAbsolute, R16, 0x8D, 4}, {modeAbsolute, R24, 0x8D, 4},
 		{modeAbsolute, W16, 0x8D, 5}, {modeAbsolute, W24, 0x8D, 5},
@@ -596,7 +598,7 @@ var opTHY = []opcode {
 	{modeImplicit, A16, 0x23, 1},
 }
 var opTHI = []opcode {
-	{modeAbsolute, A16, 0x33, 3}, {modeAbsolute, A24, 0x33, 4},
+	{modeAbsolute, A16, 0x33, 3}, {modeAbsolute, A24, 0x33, 5},
 }
 var opTTA = []opcode {
 	{modeImplicit, R08, 0x43, 1}, {modeImplicit, R16, 0x43, 2}, {modeImplicit, R24, 0x43, 2},
@@ -610,6 +612,108 @@ var opTTS = []opcode {
 var opTST = []opcode {
 	{modeImplicit, R08, 0x73, 1}, {modeImplicit, R16, 0x73, 2}, {modeImplicit, R24, 0x73, 2},
 }
+var opRMB0 = []opcode {
+	{modeZeroPage, A16, 0x07, 2},
+}
+var opRMB1 = []opcode {
+	{modeZeroPage, A16, 0x17, 2},
+}
+var opRMB2 = []opcode {
+	{modeZeroPage, A16, 0x27, 2},
+}
+var opRMB3 = []opcode {
+	{modeZeroPage, A16, 0x37, 2},
+}
+var opRMB4 = []opcode {
+	{modeZeroPage, A16, 0x47, 2},
+}
+var opRMB5 = []opcode {
+	{modeZeroPage, A16, 0x57, 2},
+}
+var opRMB6 = []opcode {
+	{modeZeroPage, A16, 0x67, 2},
+}
+var opRMB7 = []opcode {
+	{modeZeroPage, A16, 0x77, 2},
+}
+var opSMB0 = []opcode {
+	{modeZeroPage, A16, 0x87, 2},
+}
+var opSMB1 = []opcode {
+	{modeZeroPage, A16, 0x97, 2},
+}
+var opSMB2 = []opcode {
+	{modeZeroPage, A16, 0xA7, 2},
+}
+var opSMB3 = []opcode {
+	{modeZeroPage, A16, 0xB7, 2},
+}
+var opSMB4 = []opcode {
+	{modeZeroPage, A16, 0xC7, 2},
+}
+var opSMB5 = []opcode {
+	{modeZeroPage, A16, 0xD7, 2},
+}
+var opSMB6 = []opcode {
+	{modeZeroPage, A16, 0xE7, 2},
+}
+var opSMB7 = []opcode {
+	{modeZeroPage, A16, 0xF7, 2},
+}
+var opBBR0 = []opcode {
+	{modeZeroPageRelative, A16, 0x0F, 3},
+}
+var opBBR1 = []opcode {
+	{modeZeroPageRelative, A16, 0x1F, 3},
+}
+var opBBR2 = []opcode {
+	{modeZeroPageRelative, A16, 0x2F, 3},
+}
+var opBBR3 = []opcode {
+	{modeZeroPageRelative, A16, 0x3F, 3},
+}
+var opBBR4 = []opcode {
+	{modeZeroPageRelative, A16, 0x4F, 3},
+}
+var opBBR5 = []opcode {
+	{modeZeroPageRelative, A16, 0x5F, 3},
+}
+var opBBR6 = []opcode {
+	{modeZeroPageRelative, A16, 0x6F, 3},
+}
+var opBBR7 = []opcode {
+	{modeZeroPageRelative, A16, 0x7F, 3},
+}
+var opBBS0 = []opcode {
+	{modeZeroPageRelative, A16, 0x8F, 3},
+}
+var opBBS1 = []opcode {
+	{modeZeroPageRelative, A16, 0x9F, 3},
+}
+var opBBS2 = []opcode {
+	{modeZeroPageRelative, A16, 0xAF, 3},
+}
+var opBBS3 = []opcode {
+	{modeZeroPageRelative, A16, 0xBF, 3},
+}
+var opBBS4 = []opcode {
+	{modeZeroPageRelative, A16, 0xCF, 3},
+}
+var opBBS5 = []opcode {
+	{modeZeroPageRelative, A16, 0xDF, 3},
+}
+var opBBS6 = []opcode {
+	{modeZeroPageRelative, A16, 0xEF, 3},
+}
+var opBBS7 = []opcode {
+	{modeZeroPageRelative, A16, 0xFF, 3},
+}
+var opWAI = []opcode {
+	{modeImplicit, A16, 0xCB, 1},
+}
+var opSTP = []opcode {
+	{modeImplicit, A16, 0xDB, 1},
+}
 
 var mnemonics = []mnemonic {
 	{":", nil, N_A}, // used to store labels
@@ -704,6 +808,41 @@ var mnemonics = []mnemonic {
 	{"tat", opTAT, REG_A},
 	{"tts", opTTS, N_A},
 	{"tst", opTST, N_A},
+	// WDC 65C02 (these opcodes are the prefix codes and other extras on the 65C2402)
+	{"rmb0", opRMB0, N_A},
+	{"rmb1", opRMB1, N_A},
+	{"rmb2", opRMB2, N_A},
+	{"rmb3", opRMB3, N_A},
+	{"rmb4", opRMB4, N_A},
+	{"rmb5", opRMB5, N_A},
+	{"rmb6", opRMB6, N_A},
+	{"rmb7", opRMB7, N_A},
+	{"smb0", opSMB0, N_A},
+	{"smb1", opSMB1, N_A},
+	{"smb2", opSMB2, N_A},
+	{"smb3", opSMB3, N_A},
+	{"smb4", opSMB4, N_A},
+	{"smb5", opSMB5, N_A},
+	{"smb6", opSMB6, N_A},
+	{"smb7", opSMB7, N_A},
+	{"bbr0", opBBR0, N_A},
+	{"bbr1", opBBR1, N_A},
+	{"bbr2", opBBR2, N_A},
+	{"bbr3", opBBR3, N_A},
+	{"bbr4", opBBR4, N_A},
+	{"bbr5", opBBR5, N_A},
+	{"bbr6", opBBR6, N_A},
+	{"bbr7", opBBR7, N_A},
+	{"bbs0", opBBS0, N_A},
+	{"bbs1", opBBS1, N_A},
+	{"bbs2", opBBS2, N_A},
+	{"bbs3", opBBS3, N_A},
+	{"bbs4", opBBS4, N_A},
+	{"bbs5", opBBS5, N_A},
+	{"bbs6", opBBS6, N_A},
+	{"bbs7", opBBS7, N_A},
+	{"wai", opWAI, N_A},
+	{"stp", opSTP, N_A},
 }
 
 // Parsed addressing arguments
@@ -744,6 +883,11 @@ func (p *parser) parseMnemonic(mnemonic string) error {
 		return errors.New("32-bit registers is not supported")
 	}
 
+	// BBRn/BBSn have both a zero page address and a branch, e.g. BBR0 $12,+label
+	if (isBitBranch(mnemonic)) {
+		return p.parseBitBranch(mnemonic)
+	}
+
 	// Parse the/any args
 	args, err := p.parseArgs()
 	if (err != nil) {
@@ -767,6 +911,74 @@ func (p *parser) parseMnemonic(mnemonic string) error {
 	return fmt.Errorf("mnemonic '%s' is invalid", mnemonic)
 }
 
+/*
+ *  Is the mnemonic one of the WDC 65C02 bit branches, BBR0-7 or BBS0-7?
+ */
+func isBitBranch(mnemonic string) bool {
+	return (len(mnemonic) == 4) && ((mnemonic[:3] == "bbr") || (mnemonic[:3] == "bbs")) &&
+		(mnemonic[3] >= '0') && (mnemonic[3] <= '7')
+}
+
+/*
+ *  Parse the zero page address and branch of BBRn/BBSn, e.g. BBS7 $C0,+ready or BBR0 flags,-4
+ */
+func (p *parser) parseBitBranch(mnemonic string) error {
+	var zp int
+	var err error
+	p.skipWhitespace()
+	if p.isRegisterOrParameter() {
+		p.skip(1)
+		zp, err = p.parseRegisterOrParameter()
+	} else if p.isNextAZ() {
+		symbol := p.nextAZ_az_09()
+		if r := p.lookupRegisterName(p.currentCode, symbol); (r != nil) {
+			zp = r.address
+		} else {
+			var found bool
+			zp, found, err = p.lookupConstant(symbol)
+			if (err == nil) && (!found) {
+				err = fmt.Errorf("'%s' is not a register or constant", symbol)
+			}
+		}
+	} else {
+		zp, err = p.nextValue()
+	}
+	if (err != nil) {
+		return fmt.Errorf("%s needs a zero page address (%s)", strings.ToUpper(mnemonic), err)
+	} else if (zp < 0) || (zp > 0xFF) {
+		return fmt.Errorf("%s needs a zero page address, not $%x", strings.ToUpper(mnemonic), zp)
+	}
+
+	p.skipWhitespace()
+	if (p.peekChar() != ',') {
+		return fmt.Errorf("%s is missing the ',' between the zero page address and the branch, e.g. %s $%02x,+label", strings.ToUpper(mnemonic), strings.ToUpper(mnemonic), zp)
+	}
+	p.skip(1)
+	p.skipWhitespace()
+	args, err := p.parseArgs()
+	if (err != nil) {
+		return err
+	}
+	if (args.mode != modeRelative) {
+		return fmt.Errorf("%s needs a branch after the zero page address, e.g. %s $%02x,+label", strings.ToUpper(mnemonic), strings.ToUpper(mnemonic), zp)
+	} else if (args.hasValue) && ((args.value < -128) || (args.value > 127)) {
+		return fmt.Errorf("%s can only branch -128 to +127 bytes, not %d", strings.ToUpper(mnemonic), args.value)
+	}
+
+	for m := range mnemonics {
+		if (mnemonic == mnemonics[m].name) {
+			err := p.addInstruction(m, modeZeroPageRelative, A16, args.hasValue, args.symbol, args.value)
+			if (err != nil) {
+				return err
+			}
+			p.currentCode.lastInstr.zeroPage = zp
+			return nil
+		}
+	}
+
+	return fmt.Errorf("mnemonic '%s' is invalid", mnemonic)
+}
+
 /*
  *  Return the explit opcode width
  *  (returning the string and index)
@@ -816,6 +1028,14 @@ func (p *parser) parseOpWidthOnce() int {
 }
 
 
+/*
+ *  Is the next % the start of a register or parameter (rather than a binary number, e.g. %0101)?
+ */
+func (p *parser) isRegisterOrParameter() bool {
+	sym1 := p.peekAhead(1)
+	return (p.peekChar() == '%') && (sym1 != '0') && (sym1 != '1')
+}
+
 /*
  *  Return the register or parameter address, i.e. the %Rn or %%n.k syntax
  *  (returning the address or any error)
@@ -823,18 +1043,19 @@ func (p *parser) parseOpWidthOnce() int {
 func (p *parser) parseRegisterOrParameter() (int, error) {
 	sym := p.peekChar()
 
-	// register, e.g. %R1 = $01
+	// register, e.g. %R1 = $01 (or $81 after #registers $80)
 	if ((sym == 'R') || (sym == 'r')) {
 		p.skip(1)
 
-		address, err := p.nextValue()
+		n, err := p.nextValue()
 		if (err != nil) {
-			return 0, fmt.Errorf("invalid register '%R%c'", p.peekChar())
+			return 0, fmt.Errorf("invalid register '%%R%c'", p.peekChar())
 		}
-		return address, nil
+		return p.registerAddress(n, 1)
 	}
 
 	// parameter %%n.n, e.g. %%0 = $D000 or %%7.1 = $D701 or %%8.$FF = $D8FF
+	// (or %%1 = $0320 after #params $0300 stride $20)
 	if (sym == '%') {
 		p.skip(1)
 
@@ -842,10 +1063,6 @@ func (p *parser) parseRegisterOrParameter() (int, error) {
 		if (err != nil) {
 			return 0, fmt.Errorf("invalid subroutine parameter '%%%%%c'", p.peekChar())
 		}
-		if (base > 8) {
-			return 0, fmt.Errorf("invalid value %%%%%d, must instead be %%%%0. through %%%%8.", base)
-		}
-
 		offset := 0
 		sym := p.peekChar()
 		sym1 := p.peekAhead(1)
@@ -873,7 +1090,7 @@ func (p *parser) parseRegisterOrParameter() (int, error) {
 			}
 		}
 
-		return 0xD000 | (base << 8) | offset, nil
+		return p.paramAddress(base, offset)
 	}
 
 	return 0, fmt.Errorf("expected %%R or %%%%, not %%%c", sym)
@@ -943,33 +1160,20 @@ func (p *parser) parseArgs() (assemblyArgs, error) {
 		args.mode = modeImmediate
 		sym = p.peekChar()
 		sym1 = p.peekAhead(1)
-		if sym == '\'' {
-			p.skip(1)
-			c := p.nextChar()
-			if sym != '\'' {
-				return args, fmt.Errorf("no matching single quote after %c", c)
-			}
-			p.skip(1)
-			sym = p.peekChar()
-			if (sym == 'h') || (sym == 'H') {
-				p.skip(1)
-				c |= 0x80
-			}
-			args.value = int(c)
-			args.size = R08
-			args.hasValue = true
-		} else if (sym == '@') {
+		if (sym == '@') {
 			p.skip(1)
 			symbol := p.nextAZ_az_09()
 			args.symbol = symbol
-			address, size, err := p.lookupVariable(p.currentCode, symbol)
+			address, size, found, err := p.lookupVariable(p.currentCode, symbol)
 			if (err != nil) {
+				return args, err
+			} else if (!found) {
 				return args, fmt.Errorf("unknown variable '%s'", symbol)
 			}
 			args.value = address
 			args.size |= size
 			args.hasValue = true
-		} else if (sym == '%') {
+		} else if p.isRegisterOrParameter() {
 			p.skip(1)
 			value, err := p.parseRegisterOrParameter()
 			if (err != nil) {
@@ -980,14 +1184,16 @@ func (p *parser) parseArgs() (assemblyArgs, error) {
 		} else if p.isNextAZ() {
 			symbol := p.nextAZ_az_09()
 			args.symbol = symbol
-			value, err := p.lookupConstant(symbol)
-			if (err == nil) {
+			value, found, err := p.lookupConstant(symbol)
+			if (err != nil) {
+				return args, err
+			} else if (found) {
 				args.value = value
 				args.hasValue = true
 			} else {
-				d := p.lookupDataName(symbol)
-				if (d != nil) {
-					args.value = d.startAddr
+				address, err := p.lookupDataName(symbol)
+				if (err == nil) {
+					args.value = address
 					args.hasValue = true
 				} else {
 					// Resolve this later
@@ -1026,14 +1232,16 @@ func (p *parser) parseArgs() (assemblyArgs, error) {
 			p.skip(1)
 			symbol := p.nextAZ_az_09()
 			args.symbol = symbol
-			address, size, err := p.lookupVariable(p.currentCode, symbol)
+			address, size, found, err := p.lookupVariable(p.currentCode, symbol)
 			if (err != nil) {
+				return args, err
+			} else if (!found) {
 				return args, fmt.Errorf("unknown variable '%s'", symbol)
 			}
 			args.value = address
 			args.size |= size
 			args.hasValue = true
-		} else if (sym == '%') {
+		} else if p.isRegisterOrParameter() {
 			p.skip(1)
 			value, err := p.parseRegisterOrParameter()
 			if (err != nil) {
@@ -1044,8 +1252,10 @@ func (p *parser) parseArgs() (assemblyArgs, error) {
 		} else if p.isNextAZ() {
 			symbol := p.nextAZ_az_09()
 			args.symbol = symbol
-			value, err := p.lookupConstant(symbol)
-			if (err == nil) {
+			value, found, err := p.lookupConstant(symbol)
+			if (err != nil) {
+				return args, err
+			} else if (found) {
 				args.value = value
 				args.hasValue = true
 			} else {
@@ -1118,14 +1328,16 @@ func (p *parser) parseArgs() (assemblyArgs, error) {
 			p.skip(1)
 			symbol := p.nextAZ_az_09()
 			args.symbol = symbol
-			address, size, err := p.lookupVariable(p.currentCode, symbol)
+			address, size, found, err := p.lookupVariable(p.currentCode, symbol)
 			if (err != nil) {
+				return args, err
+			} else if (!found) {
 				return args, fmt.Errorf("unknown variable '%s'", symbol)
 			}
 			args.value = address
 			args.size |= size
 			args.hasValue = true
-		} else if (sym == '%') {
+		} else if p.isRegisterOrParameter() {
 			p.skip(1)
 			value, err := p.parseRegisterOrParameter()
 			if (err != nil) {
@@ -1136,8 +1348,10 @@ func (p *parser) parseArgs() (assemblyArgs, error) {
 		} else if p.isNextAZ() {
 			symbol := p.nextAZ_az_09()
 			args.symbol = symbol
-			value, err := p.lookupConstant(symbol)
-			if (err == nil) {
+			value, found, err := p.lookupConstant(symbol)
+			if (err != nil) {
+				return args, err
+			} else if (found) {
 				args.value = value
 				args.hasValue = true
 			} else {
@@ -1226,6 +1440,7 @@ func (p *parser) parseLabel(label string) error {
 	// Skip past the ':'
 	p.skip(1)
 	p.addInstructionLabel(label)
+	p.currentCode.lastInstr.source = true
 	p.skipWhitespaceAndEOL()
 
 	return nil
@@ -1245,6 +1460,10 @@ func (p *parser) addInstruction(mnemonic int, addressMode int, size int, hasValu
 	}
 	p.currentCode.lastInstr = instr
 	instr.next = nil
+	instr.noopt = p.noopt
+	instr.line = p.line
+	instr.column = p.col
+	instr.filename = p.filename
 
 	instr.hasValue = hasValue
 	instr.symbol = symbol
@@ -1270,6 +1489,17 @@ func (p *parser) addInstruction(mnemonic int, addressMode int, size int, hasValu
 			instr.opcode = o.opcode
 			instr.len = o.len
 			instr.address = p.currentCode.endAddr
+
+			// Check that the target CPU has the opcode
+			err := p.checkInstructionCPU(instr)
+			if (err != nil) {
+				return err
+			}
+
+			// Negative values are two's-complement at the width of the register
+			if (addressMode == modeImmediate) && (value < 0) {
+				instr.value = value & ((1 << uint(prefixToWidth(o.size))) - 1)
+			}
 			p.currentCode.endAddr += o.len
 
 			// Remember the size of the opcode for each of A, X, and Y registers
@@ -1367,6 +1597,7 @@ func addressModeStr(mode int) string {
 		case modeAbsoluteIndexedIndirectX: return "mmm ($aaaa,X) [absolute indexed indirect X]"
 		case modeX: return "mmm X [address X]"
 		case modeXY: return "mmm XY [address X+Y]"
+		case modeZeroPageRelative: return "bbrN $zz,+dd [zero page relative]"
 	}
 }
 
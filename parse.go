@@ -3,6 +3,7 @@ package aCCembler
 import (
 	"errors"
 	"fmt"
+	"path/filepath"
     "strings"
 )
 
@@ -10,13 +11,16 @@ import (
  *  Parser
  */
 func (p *parser) parseFile(filename string, buffer []uint8) error {
-	fmt.Printf("PARSE %s\n", filename)
+	if (!p.quiet) {
+		fmt.Printf("PARSE %s\n", filename)
+	}
 
 	// (Re)Initialize the parser buffer and counts
 	p.b = buffer
 	p.end = len(buffer)-1
 	p.i = 0
 	p.n = 1
+	p.filename = filename
 
 	// Loop until there are no more top-level blocks in the file
 	for p.i < p.end {
@@ -34,6 +38,7 @@ func (p *parser) parseFile(filename string, buffer []uint8) error {
 				p.skip(1)
 				err := p.parseHashcode()
 				if (err != nil) {
+					p.printError(filename, err)
 					return err
 				}
 				continue
@@ -41,7 +46,7 @@ func (p *parser) parseFile(filename string, buffer []uint8) error {
 				continue
 			} else {
 				err := errors.New("expected @addr or #command or sub")
-				fmt.Printf("ERROR in %s [line %d] -- %s\n", filename, p.n, err)
+				p.printError(filename, err)
 				return err
 			}
 		}
@@ -53,7 +58,7 @@ func (p *parser) parseFile(filename string, buffer []uint8) error {
 			label = p.nextAZ_az_09()
 			err := p.parseConstant(label)
 			if (err != nil) {
-				fmt.Printf("ERROR in %s [line %d] -- %s\n", filename, p.n, err)
+				p.printError(filename, err)
 				return err
 			}
 		case "global":
@@ -61,15 +66,52 @@ func (p *parser) parseFile(filename string, buffer []uint8) error {
 			label = p.nextAZ_az_09()
 			err := p.parseVariable(VAR_GLOBAL, nil, label)
 			if (err != nil) {
-				fmt.Printf("ERROR in %s [line %d] -- %s\n", filename, p.n, err)
+				p.printError(filename, err)
+				return err
+			}
+		case "reg":
+			p.skipWhitespace()
+			err := p.parseRegisterName(nil, p.nextAZ_az_09())
+			if (err != nil) {
+				p.printError(filename, err)
 				return err
 			}
 		case "sub":
 			var label string
 			label = p.nextAZ_az_09()
-			err := p.parseSubroutineBlock(label)
+			err := p.parseSubroutineBlock(BLK_SUB, label)
 			if (err != nil) {
-				fmt.Printf("ERROR in %s [line %d] -- %s\n", filename, p.n, err)
+				p.printError(filename, err)
+				return err
+			}
+		case "isr":
+			var label string
+			label = p.nextAZ_az_09()
+			err := p.parseSubroutineBlock(BLK_ISR, label)
+			if (err != nil) {
+				p.printError(filename, err)
+				return err
+			}
+		case "nmi":
+			var label string
+			label = p.nextAZ_az_09()
+			err := p.parseSubroutineBlock(BLK_NMI, label)
+			if (err != nil) {
+				p.printError(filename, err)
+				return err
+			}
+		case "thread":
+			var label string
+			label = p.nextAZ_az_09()
+			err := p.parseSubroutineBlock(BLK_THREAD, label)
+			if (err != nil) {
+				p.printError(filename, err)
+				return err
+			}
+		case "vectors":
+			err := p.parseVectors()
+			if (err != nil) {
+				p.printError(filename, err)
 				return err
 			}
 		case "data":
@@ -77,12 +119,12 @@ func (p *parser) parseFile(filename string, buffer []uint8) error {
 			label = p.nextAZ_az_09()
 			err := p.parseDataBlock(label)
 			if (err != nil) {
-				fmt.Printf("ERROR in %s [line %d] -- %s\n", filename, p.n, err)
+				p.printError(filename, err)
 				return err
 			}
 		case "default":
 			err := errors.New("expected asm or sub")
-			fmt.Printf("ERROR in %s [line %d] -- %s\n", filename, p.n, err)
+			p.printError(filename, err)
 			return err
 		}
 	}
@@ -101,47 +143,100 @@ func (p *parser) parseHashcode() error {
 
 	switch (hashcode) {
 	case "include":
-		// Parse the filename, e.g. #include "foo.pom"
-		if (p.peekChar() != '"') {
-			return fmt.Errorf("#include is missing the opening \"\n")
+		return p.parseInclude()
+	case "once":
+		return p.parseOnce()
+	case "incbin":
+		// A block of data named after the file, e.g. #incbin "font.bin" is DATA font
+		block := p.addDataBlock("", p.endestAddr())
+		err := p.parseIncbin(block)
+		if (err == nil) && (p.isPruned(block.nameLC)) {
+			p.unlinkDataBlock(block)
 		}
-		p.skip(1)
-		filename := p.untilQuote()
-		if (p.peekChar() != '"') {
-			return fmt.Errorf("#include is missing the closing \"\n")
-		}
-		p.skip(1)
+		return err
+	case "keep":
+		return p.parseKeep()
+	case "pragma":
+		return p.parsePragma()
+	case "registers":
+		return p.parseRegisters()
+	case "cpu":
+		return p.parseCPU()
+	case "params":
+		return p.parseParams()
+	}
 
-		// Load the file
-		buffer, err := readFile(filename)
-		if err != nil {
-			fmt.Printf("ERROR trying to include %s -- %s\n", filename, err)
-			return err
-		}
 
-		// Remember where we left off
-		saveB := p.b
-		saveEnd := p.end
-		saveI := p.i
-		saveN := p.n
+	return fmt.Errorf("#%s is not a valid compiler directive", hashcode)
+}
 
-		// Parse the file
-		err = p.parseFile(filename, buffer)
-		if (err != nil) {
-			return err
-		}
+// An error found after parsing, on a line of a file (e.g. in a TIMED block)
+type sourceError struct {
+	filename	string
+	line		int
+	err			error
+}
 
-		// Restore where we left off
-		p.b = saveB
-		p.end = saveEnd
-		p.i = saveI
-		p.n = saveN
+func (e *sourceError) Error() string {
+	return fmt.Sprintf("in %s [line %d] -- %v", e.filename, e.line, e.err)
+}
 
-		return nil
+/*
+ *  An error on the line of the instruction
+ */
+func (i *instruction) errorf(format string, a ...interface{}) error {
+	return &sourceError{i.filename, i.line, fmt.Errorf(format, a...)}
+}
+
+/*
+ *  Print an error found after parsing, as ERROR in file [line n] -- ... like the parse errors
+ *  (or as ERROR: ... if it isn't on a line)
+ */
+func printSourceError(err error) {
+	if _, ok := err.(*sourceError); (ok) {
+		fmt.Printf("ERROR %v\n", err)
+	} else {
+		fmt.Printf("ERROR: %v\n", err)
+	}
+}
+
+/*
+ *  Print the error on the line being parsed, or its own line (unless quiet, e.g. for aCCemble lsp),
+ *  then the #include lines that led to the file
+ *  (an error in an #include'd file was already printed)
+ */
+func (p *parser) printError(filename string, err error) {
+	if _, ok := err.(*includeError); (ok) || (p.quiet) {
+		return
+	}
+	if _, ok := err.(*sourceError); (ok) {
+		fmt.Printf("ERROR %v\n", err)
+	} else {
+		fmt.Printf("ERROR in %s [line %d] -- %s\n", filename, p.n, err)
+	}
+	for k := len(p.includes)-1; k >= 0; k-- {
+		fmt.Printf("  included from %s [line %d]\n", p.includes[k].filename, p.includes[k].line)
 	}
+}
 
+/*
+ *  Parse the #pragma directive, e.g. #pragma noopt ... #pragma opt
+ */
+func (p *parser) parsePragma() error {
+	pragma := strings.ToLower(p.nextAZ_az_09())
+	switch (pragma) {
+	case "noopt":
+		p.noopt = true
+	case "opt":
+		p.noopt = false
+	case "warning":
+		return p.parsePragmaWarning()
+	default:
+		return fmt.Errorf("#pragma %s is not a valid pragma", pragma)
+	}
 
-	return fmt.Errorf("#%s is not a valid compiler directive", hashcode)
+	p.skipWhitespaceAndEOL()
+	return nil
 }
 
 /*
@@ -154,13 +249,13 @@ func (p *parser) parseConstant(label string) error {
 
 	// all constants are stored as lowercase
 	labelLC := strings.ToLower(label)
+	line := p.n
 
 	// Skip past whitespace
 	p.skipWhitespace()
 
 	// Check for duplicate
-	_, err := p.lookupConstant(labelLC)
-	if (err == nil) {
+	if (p.lookupConstantName(labelLC) != nil) {
 		return fmt.Errorf("const '%s' is already defined", label)
 	}
 
@@ -173,15 +268,22 @@ func (p *parser) parseConstant(label string) error {
 	var value int
 	if p.isNextAZ() {
 		ref := p.nextAZ_az_09()
-		value, err = p.lookupConstant(ref)
+		if (ref == "") {
+			return fmt.Errorf("const '%s' does not specify a value", label)
+		}
+		var found bool
+		var err error
+		value, found, err = p.lookupConstant(ref)
 		if (err != nil) {
+			return fmt.Errorf("const '%s' -- %s", label, err)
+		} else if (!found) {
 			return fmt.Errorf("const '%s' references '%s' which is not defined", label, ref)
 		}
 	} else {
 		var err error
 		value, err = p.nextValue()
 		if (err != nil) {
-			return fmt.Errorf("const '%s' does not specify a value", label)
+			return fmt.Errorf("const '%s' does not specify a value -- %s", label, err)
 		}
 	}
 
@@ -200,6 +302,8 @@ func (p *parser) parseConstant(label string) error {
 	cnst.name = label
 	cnst.nameLC = labelLC
 	cnst.value = value
+	cnst.filename = p.filename
+	cnst.line = line
 
 	return nil
 }
@@ -227,17 +331,16 @@ func (p *parser) parseVariable(varType int, b *codeBlock, name string) error {
 
 	// all variable names are stored as lowercase
 	nameLC := strings.ToLower(name)
+	line := p.n
 
 	// Skip past whitespace
 	p.skipWhitespace()
 
 	// Check for duplicate
-	_, err := p.lookupConstant(nameLC)
-	if (err == nil) {
+	if (p.lookupConstantName(nameLC) != nil) {
 		return fmt.Errorf("%s '%s' is already defined as the name of a constant", keyword, name)
 	}
-	_, _, err = p.lookupVariable(b, nameLC)
-	if (err == nil) {
+	if (p.lookupVariableName(b, nameLC) != nil) {
 		return fmt.Errorf("%s '%s' is already defined as another variable", keyword, name)
 	}
 
@@ -250,6 +353,7 @@ func (p *parser) parseVariable(varType int, b *codeBlock, name string) error {
 	}
 
 	var address int
+	var err error
 	addtoBlock := true
 	p.skipWhitespace()
 	sym := p.peekChar()
@@ -268,12 +372,15 @@ func (p *parser) parseVariable(varType int, b *codeBlock, name string) error {
 		} else {
 			// M@label  ; label = contstant or variable
 			token := p.nextAZ_az_09()
-			address, err = p.lookupConstant(token)
+			var found bool
+			address, found, err = p.lookupConstant(token)
+			if (err == nil) && (!found) {
+				address, _, found, err = p.lookupVariable(b, token)
+			}
 			if (err != nil) {
-				address, _, err = p.lookupVariable(b, token)
-				if (err != nil) {
-					return fmt.Errorf("%s '%s' specifies an unknown variable or constant '%s'", keyword, name, token)
-				}
+				return fmt.Errorf("%s '%s' -- %s", keyword, name, err)
+			} else if (!found) {
+				return fmt.Errorf("%s '%s' specifies an unknown variable or constant '%s'", keyword, name, token)
 			}
 		}
 	} else if (p.peekChar() == '%') {
@@ -329,6 +436,8 @@ func (p *parser) parseVariable(varType int, b *codeBlock, name string) error {
 		vrbl.nameLC = nameLC
 		vrbl.address = address
 		vrbl.size = size
+		vrbl.filename = p.filename
+		vrbl.line = line
 	}
 
 	return nil
@@ -336,10 +445,11 @@ func (p *parser) parseVariable(varType int, b *codeBlock, name string) error {
 
 /*
  *  Parse a (optionally named) block of assembly
+ *  (SUB, or ISR/NMI for interrupt handlers)
  */
-func (p *parser) parseSubroutineBlock(label string) error {
+func (p *parser) parseSubroutineBlock(kind int, label string) error {
 	if (label == "") {
-		return errors.New("'sub' is missing a name")
+		return fmt.Errorf("'%s' is missing a name", blockKindStr(kind))
 	}
 
 	// Skip past whitespace
@@ -364,13 +474,22 @@ func (p *parser) parseSubroutineBlock(label string) error {
 		var err error
 		address, err = p.nextValue()
 		if (err != nil) {
-			return fmt.Errorf("'sub %s @' does not specify an address value", label)
+			return fmt.Errorf("'%s %s @' does not specify an address value", blockKindStr(kind), label)
 		}
+		block.placed = true
 		p.skipWhitespace()
 	} else {
 		address = p.endestAddr()
 	}
 
+	// THREAD blocks have their own stack page
+	if (kind == BLK_THREAD) {
+		err := p.parseThreadStack(block, label)
+		if (err != nil) {
+			return err
+		}
+	}
+
 	// Set the default width based on the address of this block (@@@ not 100% correct but a good first guess)
 	if (address <= 0xFFFF) {
 		p.abWidth = A16
@@ -401,11 +520,65 @@ func (p *parser) parseSubroutineBlock(label string) error {
 	block.endAddr = address
 	block.name = label
 	block.nameLC = strings.ToLower(label)
+	block.kind = kind
 	block.instr = nil
+	block.filename = p.filename
+	block.line = p.n
 
-	// Parse the code
+	// Parse the code (with the code generated for the block itself on the line of the SUB)
 	p.skip(1)
-	return p.parseCode(label)
+	p.line = block.line
+	p.col = 1
+	err := p.parseCode(label)
+	if (err != nil) {
+		return err
+	}
+	block.endLine = p.n - 1
+
+	// -prune drops the SUB now that it is parsed, so the next block takes its address
+	if (kind == BLK_SUB) && (p.isPruned(block.nameLC)) {
+		p.unlinkCodeBlock(block)
+		return nil
+	}
+
+	// Named registers used together must not share any bytes
+	err = p.checkRegisterOverlap(block)
+	if (err != nil) {
+		return err
+	}
+
+	// Interrupt handlers save/restore the registers and end with RTI
+	if (kind == BLK_ISR) || (kind == BLK_NMI) {
+		err = p.wrapInterruptBlock(block)
+		if (err != nil) {
+			return err
+		}
+	}
+
+	// A thread ends when it runs off the end of its block
+	if (kind == BLK_THREAD) && (!block.endsThread()) {
+		p.addExprInstruction("thr", modeImplicit, A16, 0)
+	}
+
+	// Check that no instruction truncates a wider register
+	p.checkRegisterWidths(block)
+
+	// Warn about unused labels, unreachable code, and overlapping VARs
+	p.checkBlockWarnings(block)
+
+	// Optimize the code before the addresses are final
+	if (p.optimize) {
+		p.optimizeBlock(block)
+	}
+
+	// Size the branches now that every label in the block has an address
+	err = p.relaxBranches(block)
+	if (err != nil) {
+		return err
+	}
+
+	// Check that the target CPU has every opcode, including the generated ones
+	return p.checkBlockCPU(block)
 }
 
 /*
@@ -413,9 +586,15 @@ func (p *parser) parseSubroutineBlock(label string) error {
  */
 func (p *parser) parseCode(label string) error {
 	// Should be a sequence of mnemonics, keywords, and label, followed by a '}'
+	// (the code generated after the '}' is on the line of the keyword, e.g. the JMP of a LOOP)
+	line, col := p.line, p.col
 	var token string
 	for p.i < p.end {
+		p.skipWhitespace()
+		p.col = p.column(p.i)
 		token = strings.ToLower(p.nextAZ_az_09())
+		p.line = p.n
+		before := p.currentCode.lastInstr
 
 		// Not a AZ09 symbol, so is it a blank line or comment or variable or syntax error?
 		if (token == "") {
@@ -423,16 +602,28 @@ func (p *parser) parseCode(label string) error {
 				continue
 			} else if p.peekChar() == '}' {	// end of the block
 				p.nextLine()
+				p.line, p.col = line, col
 				return nil
 			} else if p.peekChar() == '@' {	// must be start of a variable in an expression
 				err := p.parseExpression(token)
 				if (err != nil) {
 					return err
 				}
+				p.markSource(before)
+				continue
+			} else if p.peekChar() == '#' {	// only #pragma is allowed inside a block
+				p.skip(1)
+				directive := strings.ToLower(p.nextAZ_az_09())
+				if (directive != "pragma") {
+					return fmt.Errorf("#%s is not allowed inside {...}", directive)
+				}
+				err := p.parsePragma()
+				if (err != nil) {
+					return err
+				}
 				continue
 			} else {
 				return fmt.Errorf("found '%c' instead of valid mnemonic or keyword in {...}", p.peekChar())
-				break
 			}
 		}
 
@@ -442,11 +633,13 @@ func (p *parser) parseCode(label string) error {
 			if (err != nil) {
 				return err
 			}
+			p.markSource(before)
 		} else if p.isRegisterMnemonic(token) {
 			err := p.parseRegister(token)
 			if (err != nil) {
 				return err
 			}
+			p.markSource(before)
 		} else if p.isKeyword(token) {
 			err := p.parseKeyword(token)
 			if (err != nil) {
@@ -457,6 +650,7 @@ func (p *parser) parseCode(label string) error {
 			if (err != nil) {
 				return err
 			}
+			p.markSource(before)
 		} else if p.peekChar() == ':' {
 			err := p.parseLabel(token)
 			if (err != nil) {
@@ -499,12 +693,17 @@ func (p *parser) parseDataBlock(label string) error {
 	if (label == "") {
 		return errors.New("data is missing a name")
 	}
+	err := p.checkDataName(label)
+	if (err != nil) {
+		return err
+	}
 
 	// Skip past whitespace
 	p.skipWhitespace()
 
 	// Optional @ADDR
 	address := 0
+	placed := false
 	if (p.peekChar() == '@') {
 		p.skip(1)
 		var err error
@@ -512,6 +711,7 @@ func (p *parser) parseDataBlock(label string) error {
 		if (err != nil) {
 			return errors.New("'@'' does not specify a value")
 		}
+		placed = true
 
 		// Skip past whitespace
 		p.skipWhitespace()
@@ -519,22 +719,13 @@ func (p *parser) parseDataBlock(label string) error {
 		address = p.endestAddr()
 	}
 
-	// Description of the data size comes next
-	token := strings.ToLower(p.nextAZ_az_09())
+	// Description of the (default) data size comes next
 	size := R08
-	if (token == "") {
-		return errors.New("missing data size (e.g. byte, u8, word, u16, trip, u24, str)")
-	} else {
-		switch (token) {
-		case "byte", "u8":
-			size = R08
-		case "word", "u16":
-			size = R16
-		case "trip", "u24":
-			size = R24
-		case "str", "string":
-			size = DSTRING
-		default:
+	token := strings.ToLower(p.nextAZ_az_09())
+	if (token != "") {
+		var ok bool
+		size, ok = dataSize(token)
+		if (!ok) {
 			return fmt.Errorf("invalid data size '%s', expecting byte, u8, word, u16, trip, u24, str", token)
 		}
 	}
@@ -552,6 +743,40 @@ func (p *parser) parseDataBlock(label string) error {
 	p.skipWhitespaceAndEOL()
 
 	// Store this data block
+	block := p.addDataBlock(label, address)
+	block.placed = placed
+	block.filename = p.filename
+	block.line = p.n
+
+	// Parse the data
+	err = p.parseData(size, label, block)
+	if (err != nil) {
+		return err
+	}
+
+	// -prune drops the DATA now that it is parsed, so the next block takes its address
+	if (p.isPruned(block.nameLC)) {
+		p.unlinkDataBlock(block)
+	}
+
+	return nil
+}
+
+/*
+ *  Check that the name of a data block isn't already a DATA (or data label) or SUB
+ */
+func (p *parser) checkDataName(label string) error {
+	_, err := p.lookupDataName(label)
+	if (err == nil) || (p.lookupSubroutineName(label) != nil) {
+		return fmt.Errorf("data '%s' is already defined", label)
+	}
+	return nil
+}
+
+/*
+ *  Add a new (empty) data block to the end of the list
+ */
+func (p *parser) addDataBlock(label string, address int) *dataBlock {
 	block := new(dataBlock)
 	if p.data == nil {
 		p.data = block
@@ -568,13 +793,7 @@ func (p *parser) parseDataBlock(label string) error {
 	block.nameLC = strings.ToLower(label)
 	block.data = nil
 
-	// Parse the data
-	err := p.parseData(size, label, block)
-	if (err != nil) {
-		return err
-	}
-
-	return nil
+	return block
 }
 
 /*
@@ -587,7 +806,8 @@ func (p *parser) parseData(size int, label string, block *dataBlock) error {
 		// Skip past whitespace
 		p.skipWhitespace()
 
-		token = strings.ToLower(p.nextAZ_az_09())
+		token = p.nextAZ_az_09()
+		tokenLC := strings.ToLower(token)
 
 		// Not a AZ09 symbol, so is it a blank line or comment or syntax error?
 		if (token == "") {
@@ -599,88 +819,411 @@ func (p *parser) parseData(size int, label string, block *dataBlock) error {
 			} else if p.peekChar() == '}' {	// end of the block
 				p.nextLine()
 				return nil
-			} else if size == DSTRING {
-				if p.peekChar() == '"' {
-					p.skip(1)
-					str := p.untilQuote()
-					block.addData(DSTRING, 0, str, len(str)+1)
-					p.skip(1)
-				} else {
-					return fmt.Errorf("was expecting quoted string in '%s'", label)
-				}
-			} else {
-				val, err := p.nextValue()
-				if (err != nil) {
-					return fmt.Errorf("was expecting a numeric value in '%s'", label)
-				}
-				switch size {
-				default:
-					if val > 0x0FF {
-						return fmt.Errorf("%d is bigger than 8-bits (in '%s')", val, label)
-					}
-					block.addData(R08, val, "", 1)
-				case R16:
-					if val > 0x0FFFF {
-						return fmt.Errorf("%d is bigger than 16-bits (in '%s')", val, label)
-					}
-					block.addData(R16, val, "", 2)
-				case R24:
-					if val > 0x0FFFFFF {
-						return fmt.Errorf("%d is bigger than 24-bits (in '%s')", val, label)
-					}
-					block.addData(R24, val, "", 3)
-				}
 			}
-		} else {
-			// Alphanumeric value but no quotes, and constants can't be strings
-			if size == DSTRING {
-				return fmt.Errorf("'%s' is an missing quotes in '%s'", token, label)
+		}
+
+		// #incbin "file" [, offset [, length]]
+		if (token == "") && (p.peekChar() == '#') {
+			p.skip(1)
+			directive := strings.ToLower(p.nextAZ_az_09())
+			if (directive != "incbin") {
+				return fmt.Errorf("#%s is not allowed inside DATA '%s'", directive, label)
+			}
+			err := p.parseIncbin(block)
+			if (err != nil) {
+				return err
+			}
+			continue
+		}
+
+		// A size changes the size of the entries that follow, e.g. u8 len, u16 ptr, str name
+		if sz, ok := dataSize(tokenLC); ok {
+			size = sz
+			continue
+		}
+
+		// A label names the address of the next entry, e.g. name: "Apple II"
+		if (token != "") && (p.peekChar() == ':') {
+			p.skip(1)
+			_, err := p.lookupDataName(token)
+			if (err == nil) || (p.lookupSubroutineName(token) != nil) {
+				return fmt.Errorf("'%s' in '%s' is already defined", token, label)
 			}
+			e := block.addData(DLABEL, 0, "", 0)
+			e.label = token
+			e.line = p.n
+			continue
+		}
 
-			// Lookup value as contant, subroutine, or data block name
-			val, err := p.lookupConstant(token)
+		// FILL count, value
+		if (tokenLC == "fill") {
+			count, _, err := p.parseDataExpression("", label)
 			if (err != nil) {
-				sub := p.lookupSubroutineName(token)
-				if (sub != nil) {
-					val = sub.startAddr
-				} else {
-					data := p.lookupDataName(token)
-					if (data != nil) {
-						val = data.startAddr
-					} else {
-						return fmt.Errorf("'%s' is an unknown data value in '%s'", token, label)
-					}
-				}
+				return err
+			}
+			p.skipWhitespace()
+			if (p.peekChar() != ',') {
+				return fmt.Errorf("FILL is missing the ', value' (in '%s')", label)
 			}
+			p.skip(1)
+			val, _, err := p.parseDataExpression("", label)
+			if (err != nil) {
+				return err
+			}
+			err = p.addDataValue(block, R08, val, "", "", count, label)
+			if (err != nil) {
+				return err
+			}
+			continue
+		}
 
-			switch size {
-			default:
-				if val > 0x0FF {
-					return fmt.Errorf("%d is bigger than 8-bits (in '%s')", val, label)
-				}
-				block.addData(R08, val, "", 1)
-			case R16:
-				if val > 0x0FFFF {
-					return fmt.Errorf("%d is bigger than 16-bits (in '%s')", val, label)
-				}
-				block.addData(R16, val, "", 2)
-			case R24:
-				if val > 0x0FFFFFF {
-					return fmt.Errorf("%d is bigger than 24-bits (in '%s')", val, label)
-				}
-				block.addData(R24, val, "", 3)
+		// [count] value
+		count := 1
+		if (token == "") && (p.peekChar() == '[') {
+			p.skip(1)
+			var err error
+			count, _, err = p.parseDataExpression("", label)
+			if (err != nil) {
+				return err
+			}
+			p.skipWhitespace()
+			if (p.peekChar() != ']') {
+				return fmt.Errorf("missing ']' after the repeat count (in '%s')", label)
 			}
+			p.skip(1)
+			p.skipWhitespace()
+			token = ""
+		}
+
+		// Strings
+		if (size == DSTRING) {
+			if (token != "") {
+				return fmt.Errorf("'%s' is an missing quotes in '%s'", token, label)
+			}
+			if (p.peekChar() != '"') {
+				return fmt.Errorf("was expecting quoted string in '%s'", label)
+			}
+			str, err := p.nextQuotedString()
+			if (err != nil) {
+				return fmt.Errorf("%s (in '%s')", err, label)
+			}
+			mods, err := p.parseStringModifiers()
+			if (err != nil) {
+				return fmt.Errorf("%s (in '%s')", err, label)
+			}
+			str, err = encodeString(str, mods)
+			if (err != nil) {
+				return fmt.Errorf("%s (in '%s')", err, label)
+			}
+			err = p.addDataValue(block, DSTRING, 0, str, "", count, label)
+			if (err != nil) {
+				return err
+			}
+			continue
+		}
 
+		// Numbers, constants, subroutines, or data (with optional arithmetic)
+		val, symbol, err := p.parseDataExpression(token, label)
+		if (err != nil) {
+			return err
+		}
+		err = p.addDataValue(block, size, val, "", symbol, count, label)
+		if (err != nil) {
+			return err
 		}
 	}
 
 	return errors.New("unexpected end of file within {...}")
 }
 
+/*
+ *  Lookup the size of the data entries
+ */
+func dataSize(token string) (int, bool) {
+	switch (token) {
+	case "byte", "u8":
+		return R08, true
+	case "word", "u16":
+		return R16, true
+	case "trip", "u24":
+		return R24, true
+	case "str", "string":
+		return DSTRING, true
+	}
+
+	return 0, false
+}
+
+/*
+ *  Add a value (repeated count times) to the block of data
+ */
+func (p *parser) addDataValue(block *dataBlock, size int, val int, str string, symbol string, count int, label string) error {
+	if (count < 1) {
+		return fmt.Errorf("the repeat count %d must be at least 1 (in '%s')", count, label)
+	}
+
+	var elemLen int
+	switch (size) {
+	case R08:
+		if (symbol == "") && (val > 0x0FF) {
+			return fmt.Errorf("%d is bigger than 8-bits (in '%s')", val, label)
+		} else if (symbol == "") && (val < -0x080) {
+			return fmt.Errorf("%d is more negative than 8-bits (in '%s')", val, label)
+		}
+		elemLen = 1
+	case R16:
+		if (symbol == "") && (val > 0x0FFFF) {
+			return fmt.Errorf("%d is bigger than 16-bits (in '%s')", val, label)
+		} else if (symbol == "") && (val < -0x08000) {
+			return fmt.Errorf("%d is more negative than 16-bits (in '%s')", val, label)
+		}
+		elemLen = 2
+	case R24:
+		if (symbol == "") && (val > 0x0FFFFFF) {
+			return fmt.Errorf("%d is bigger than 24-bits (in '%s')", val, label)
+		} else if (symbol == "") && (val < -0x0800000) {
+			return fmt.Errorf("%d is more negative than 24-bits (in '%s')", val, label)
+		}
+		elemLen = 3
+	case DSTRING:
+		elemLen = len(str) // already has any length or terminator
+	}
+
+	e := block.addData(size, val, str, elemLen * count)
+	e.symbol = symbol
+	e.count = count
+
+	return nil
+}
+
+/*
+ *  Parse the #incbin directive, e.g. #incbin "font.bin" or #incbin "rom.bin", $100, 256
+ *  (adding the bytes of the file to the block of data)
+ */
+func (p *parser) parseIncbin(block *dataBlock) error {
+	// Parse the filename, relative to the file being parsed (or an -I folder)
+	p.skipWhitespace()
+	if (p.peekChar() != '"') {
+		return fmt.Errorf("#incbin is missing the opening \"")
+	}
+	p.skip(1)
+	filename := p.untilQuote()
+	if (p.peekChar() != '"') {
+		return fmt.Errorf("#incbin is missing the closing \"")
+	}
+	p.skip(1)
+	path, err := p.findInclude(filename)
+	if (err != nil) {
+		return fmt.Errorf("#incbin %s", err)
+	}
+
+	// Load the file
+	bytes, err := readFile(path)
+	if (err != nil) {
+		return fmt.Errorf("#incbin can't read '%s' -- %s", path, err)
+	}
+
+	// Optional offset and length
+	offset := 0
+	length := len(bytes)
+	p.skipWhitespace()
+	if (p.peekChar() == ',') {
+		p.skip(1)
+		var symbol string
+		offset, symbol, err = p.parseDataExpression("", filename)
+		if (err != nil) {
+			return err
+		} else if (symbol != "") {
+			return fmt.Errorf("#incbin offset can't use '%s', only numbers and constants", symbol)
+		}
+		length = len(bytes) - offset
+		p.skipWhitespace()
+		if (p.peekChar() == ',') {
+			p.skip(1)
+			length, symbol, err = p.parseDataExpression("", filename)
+			if (err != nil) {
+				return err
+			} else if (symbol != "") {
+				return fmt.Errorf("#incbin length can't use '%s', only numbers and constants", symbol)
+			}
+		}
+	}
+	if (offset < 0) || (offset > len(bytes)) {
+		return fmt.Errorf("#incbin offset %d is outside of '%s' (%d bytes)", offset, filename, len(bytes))
+	}
+	if (length < 0) || (offset + length > len(bytes)) {
+		return fmt.Errorf("#incbin length %d from offset %d is past the end of '%s' (%d bytes)", length, offset, filename, len(bytes))
+	}
+
+	// Top-level blocks are named after the file
+	if (block.name == "") {
+		name := incbinName(filename)
+		err = p.checkDataName(name)
+		if (err != nil) {
+			return err
+		}
+		block.name = name
+		block.nameLC = strings.ToLower(name)
+	}
+
+	e := block.addData(DBINARY, 0, filename, length)
+	e.bytes = bytes[offset:offset+length]
+
+	p.skipWhitespaceAndEOL()
+	return nil
+}
+
+/*
+ *  Turn the filename into a name for the block of data, e.g. "art/Font 8x8.bin" is Font_8x8
+ */
+func incbinName(filename string) string {
+	base := filepath.Base(filename)
+	base = strings.TrimSuffix(base, filepath.Ext(base))
+
+	name := []byte(base)
+	for k, c := range name {
+		if !(((c >= 'A') && (c <= 'Z')) || ((c >= 'a') && (c <= 'z')) || ((c >= '0') && (c <= '9')) || (c == '_')) {
+			name[k] = '_'
+		}
+	}
+	if (len(name) == 0) || ((name[0] >= '0') && (name[0] <= '9')) {
+		name = append([]byte("_"), name...)
+	}
+
+	return string(name)
+}
+
+/*
+ *  Parse a data value, e.g. 123 or $FF or FIVE * 2 or table + 4 or (WIDTH * HEIGHT) - 1
+ *  (* / << >> & ^ | before + -, returning the value and any subroutine or data name to resolve later)
+ */
+func (p *parser) parseDataExpression(first string, label string) (int, string, error) {
+	return p.parseDataOperators(first, label, 1)
+}
+
+/*
+ *  Parse the terms joined by operators of at least the precedence, e.g. 2 * 3 in 1 + 2 * 3
+ */
+func (p *parser) parseDataOperators(first string, label string, precedence int) (int, string, error) {
+	value, symbol, err := p.parseDataTerm(first, label)
+	if (err != nil) {
+		return 0, "", err
+	}
+
+	for {
+		p.skipWhitespace()
+		sym1 := p.peekChar()
+		sym2 := p.peekAhead(1)
+		op := ""
+		switch {
+		case (sym1 == '<') && (sym2 == '<'), (sym1 == '>') && (sym2 == '>'):
+			op = string([]uint8{sym1, sym2})
+		case (sym1 == '+'), (sym1 == '-'), (sym1 == '*'), (sym1 == '/'), (sym1 == '&'), (sym1 == '|'), (sym1 == '^'):
+			op = string(sym1)
+		default:
+			return value, symbol, nil
+		}
+		if (dataOpPrecedence(op) < precedence) {
+			return value, symbol, nil
+		}
+		p.skip(len(op))
+
+		v, s, err := p.parseDataOperators("", label, dataOpPrecedence(op)+1)
+		if (err != nil) {
+			return 0, "", err
+		}
+
+		// A name that is resolved later can only be offset, e.g. sub + 3
+		if (s != "") {
+			if (symbol != "") || (op != "+") {
+				return 0, "", fmt.Errorf("'%s' isn't known yet, so can only be added to (in '%s')", s, label)
+			}
+			symbol = s
+		} else if (symbol != "") && (op != "+") && (op != "-") {
+			return 0, "", fmt.Errorf("'%s' isn't known yet, so can only be offset with + or - (in '%s')", symbol, label)
+		}
+
+		switch (op) {
+		case "+": value += v
+		case "-": value -= v
+		case "*": value *= v
+		case "/":
+			if (v == 0) {
+				return 0, "", fmt.Errorf("divide by zero (in '%s')", label)
+			}
+			value /= v
+		case "&": value &= v
+		case "|": value |= v
+		case "^": value ^= v
+		case "<<": value <<= uint(v)
+		case ">>": value >>= uint(v)
+		}
+	}
+}
+
+/*
+ *  The precedence of an operator in a data value (+ and - are applied last)
+ */
+func dataOpPrecedence(op string) int {
+	if (op == "+") || (op == "-") {
+		return 1
+	}
+	return 2
+}
+
+/*
+ *  Parse a number, name, or (expression) in a data value
+ */
+func (p *parser) parseDataTerm(token string, label string) (int, string, error) {
+	p.skipWhitespace()
+
+	if (token == "") {
+		switch {
+		case (p.peekChar() == '('):
+			p.skip(1)
+			value, symbol, err := p.parseDataExpression("", label)
+			if (err != nil) {
+				return 0, "", err
+			}
+			p.skipWhitespace()
+			if (p.peekChar() != ')') {
+				return 0, "", fmt.Errorf("missing ')' (in '%s')", label)
+			}
+			p.skip(1)
+			return value, symbol, nil
+		case (p.peekChar() == '-'):
+			p.skip(1)
+			value, symbol, err := p.parseDataTerm("", label)
+			if (symbol != "") {
+				return 0, "", fmt.Errorf("'%s' isn't known yet, so can't be negated (in '%s')", symbol, label)
+			}
+			return -value, "", err
+		case (p.peekChar() == '$') || p.isNext09():
+			value, err := p.nextValue()
+			if (err != nil) {
+				return 0, "", fmt.Errorf("was expecting a numeric value in '%s'", label)
+			}
+			return value, "", nil
+		case p.isNextAZ():
+			token = p.nextAZ_az_09()
+		default:
+			return 0, "", fmt.Errorf("was expecting a numeric value in '%s'", label)
+		}
+	}
+
+	// Lookup value as contant, otherwise a subroutine or data name (resolved after parsing)
+	// (any + or - after it is an operator, e.g. 2 * FIVE + 1)
+	if c := p.lookupConstantName(token); (c != nil) {
+		return c.value, "", nil
+	}
+
+	return 0, token, nil
+}
+
 /*
  *  Add the opcode to the (latest) block of code
  */
-func (b *dataBlock) addData(size int, value int, str string, len int) {
+func (b *dataBlock) addData(size int, value int, str string, len int) *data {
 	data := new(data)
 	if (b.data == nil) {
 		b.data = data
@@ -703,6 +1246,8 @@ func (b *dataBlock) addData(size int, value int, str string, len int) {
 		data.address = data.prev.address + data.prev.len
 		b.endAddr = data.address + len
 	}
+
+	return data
 }
 
 
@@ -0,0 +1,358 @@
+package aCCembler
+
+import (
+	"fmt"
+	"os"
+)
+
+// A rule in the peephole optimizer
+type peephole struct {
+	name		string			// short name for the listing
+	about		string			// what the rule removes
+	f			peepholeFunc	// returns the index of the instruction to remove (or -1)
+}
+type peepholeFunc func(*parser, []peepItem, int, map[string]int) int
+
+var peepholes = []peephole {
+	{"bra-next", "BRA/JMP to the very next instruction", optBranchToNext},
+	{"store-load", "LDA/LDX/LDY right after STA/STX/STY to the same zero page or VAR address", optStoreThenLoad},
+	{"cmp-zero", "CMP/CPX/CPY #0 right after a load of the same register", optCompareZero},
+	{"repeat-prefix", "prefix code repeating the width the next instruction already has", optRepeatPrefix},
+}
+
+// A label or instruction, in the order it will be output
+type peepItem struct {
+	b			*codeBlock
+	i			*instruction
+}
+
+// Status flags read or written by an instruction
+const (
+	FLAG_N = 1 << iota
+	FLAG_V
+	FLAG_Z
+	FLAG_C
+	FLAG_ALL = FLAG_N | FLAG_V | FLAG_Z | FLAG_C
+)
+type flagUse struct {
+	reads		int
+	writes		int
+}
+var flagUses = map[string]flagUse {
+	"lda": {0, FLAG_N|FLAG_Z}, "ldx": {0, FLAG_N|FLAG_Z}, "ldy": {0, FLAG_N|FLAG_Z},
+	"sta": {0, 0}, "stx": {0, 0}, "sty": {0, 0}, "stz": {0, 0},
+	"tax": {0, FLAG_N|FLAG_Z}, "tay": {0, FLAG_N|FLAG_Z}, "txa": {0, FLAG_N|FLAG_Z},
+	"tya": {0, FLAG_N|FLAG_Z}, "tsx": {0, FLAG_N|FLAG_Z}, "txs": {0, 0},
+	"pha": {0, 0}, "phx": {0, 0}, "phy": {0, 0}, "php": {FLAG_ALL, 0},
+	"pla": {0, FLAG_N|FLAG_Z}, "plx": {0, FLAG_N|FLAG_Z}, "ply": {0, FLAG_N|FLAG_Z}, "plp": {0, FLAG_ALL},
+	"ora": {0, FLAG_N|FLAG_Z}, "and": {0, FLAG_N|FLAG_Z}, "eor": {0, FLAG_N|FLAG_Z},
+	"adc": {FLAG_C, FLAG_ALL}, "sbc": {FLAG_C, FLAG_ALL},
+	"cmp": {0, FLAG_N|FLAG_Z|FLAG_C}, "cpx": {0, FLAG_N|FLAG_Z|FLAG_C}, "cpy": {0, FLAG_N|FLAG_Z|FLAG_C},
+	"bit": {0, FLAG_N|FLAG_V|FLAG_Z}, "trb": {0, FLAG_Z}, "tsb": {0, FLAG_Z},
+	"inc": {0, FLAG_N|FLAG_Z}, "dec": {0, FLAG_N|FLAG_Z},
+	"inx": {0, FLAG_N|FLAG_Z}, "iny": {0, FLAG_N|FLAG_Z}, "dex": {0, FLAG_N|FLAG_Z}, "dey": {0, FLAG_N|FLAG_Z},
+	"asl": {0, FLAG_N|FLAG_Z|FLAG_C}, "lsr": {0, FLAG_N|FLAG_Z|FLAG_C},
+	"rol": {FLAG_C, FLAG_N|FLAG_Z|FLAG_C}, "ror": {FLAG_C, FLAG_N|FLAG_Z|FLAG_C},
+	"clc": {0, FLAG_C}, "sec": {0, FLAG_C}, "clv": {0, FLAG_V},
+	"cld": {0, 0}, "sed": {0, 0}, "cli": {0, 0}, "sei": {0, 0}, "nop": {0, 0},
+	"beq": {FLAG_Z, 0}, "bne": {FLAG_Z, 0}, "bmi": {FLAG_N, 0}, "bpl": {FLAG_N, 0},
+	"bcc": {FLAG_C, 0}, "bcs": {FLAG_C, 0}, "bge": {FLAG_C, 0}, "blt": {FLAG_C, 0},
+	"bvc": {FLAG_V, 0}, "bvs": {FLAG_V, 0}, "bra": {0, 0}, "jmp": {0, 0},
+}
+
+
+/*
+ *  Run the peephole rules over the block until none of them apply
+ */
+func (p *parser) optimizeBlock(b *codeBlock) {
+	if (p.peepCount == nil) {
+		p.peepCount = make([]int, len(peepholes))
+		p.peepBytes = make([]int, len(peepholes))
+	}
+
+	items := flattenCodeBlock(b, nil)
+	labels := labelIndexes(items)
+	changed := false
+	for k := 0; k < len(items); k++ {
+		for r := range peepholes {
+			if (items[k].i.noopt) {
+				break
+			}
+
+			x := peepholes[r].f(p, items, k, labels)
+			if (x < 0) || (items[x].i.noopt) {
+				continue
+			}
+
+			// Remove the instruction, and look again from just before it
+			p.peepCount[r] += 1
+			p.peepBytes[r] += items[x].i.len
+			items[x].b.removeInstruction(items[x].i)
+			items = append(items[:x], items[x+1:]...)
+			labels = labelIndexes(items)
+			changed = true
+			k = x - 2
+			if (k < -1) {
+				k = -1
+			}
+			break
+		}
+	}
+
+	// Recompute the address of every instruction
+	if (changed) {
+		b.endAddr = relocateCodeBlock(b.instr, b.startAddr)
+	}
+}
+
+/*
+ *  Flatten the labels and instructions into the order they are output
+ *  (skipping comments and expressions, which output no code)
+ */
+func flattenCodeBlock(b *codeBlock, items []peepItem) []peepItem {
+	for i := b.instr; i != nil; i = i.next {
+		if (i.subBlock != nil) {
+			items = flattenCodeBlock(i.subBlock.block, items)
+			continue
+		}
+		if (i.comment != nil) || (i.expr != nil) {
+			continue
+		}
+		items = append(items, peepItem{b, i})
+	}
+
+	return items
+}
+
+/*
+ *  Map each label to its place in the flattened instructions
+ */
+func labelIndexes(items []peepItem) map[string]int {
+	labels := make(map[string]int)
+	for k := range items {
+		if (items[k].i.mnemonic == 0) {
+			labels[items[k].i.symbolLC] = k
+		}
+	}
+
+	return labels
+}
+
+/*
+ *  Remove the instruction from the block
+ */
+func (b *codeBlock) removeInstruction(i *instruction) {
+	if (i.prev != nil) {
+		i.prev.next = i.next
+	} else {
+		b.instr = i.next
+	}
+	if (i.next != nil) {
+		i.next.prev = i.prev
+	} else {
+		b.lastInstr = i.prev
+	}
+}
+
+/*
+ *  Could any of the flags be read (before they are written) starting at items[k]?
+ *  (erring on the side of yes whenever the code goes somewhere unknown)
+ */
+func flagsLive(items []peepItem, k int, flags int, labels map[string]int, visited map[int]int) bool {
+	for ; k < len(items); k++ {
+		if (flags &^ visited[k] == 0) {
+			return false // already followed this path looking for these flags
+		}
+		visited[k] |= flags
+
+		i := items[k].i
+		if (i.mnemonic == 0) {
+			continue
+		}
+
+		name := mnemonics[i.mnemonic].name
+		use, ok := flagUses[name]
+		if (!ok) {
+			return true // JSR, RTS, RTI, BRK, and the 65C2402 extras
+		}
+		if (use.reads & flags != 0) {
+			return true
+		}
+		flags &^= use.writes
+		if (flags == 0) {
+			return false
+		}
+
+		// Follow the branches and jumps
+		if (i.addressMode == modeRelative) || (name == "jmp") {
+			if (i.hasValue) || (i.addressMode != modeRelative && i.addressMode != modeAbsolute) {
+				return true // a numeric distance or indirect JMP
+			}
+			target, ok := labels[i.symbolLC]
+			if (!ok) {
+				return true
+			}
+			if flagsLive(items, target, flags, labels, visited) {
+				return true
+			}
+			if (name == "bra") || (name == "jmp") {
+				return false
+			}
+		}
+	}
+
+	// Falls off the end of the block
+	return true
+}
+
+/*
+ *  The next label or instruction is the target of the BRA or JMP
+ */
+func optBranchToNext(p *parser, items []peepItem, k int, labels map[string]int) int {
+	i := items[k].i
+	if (i.mnemonic == 0) || i.hasValue || (i.symbol == "") {
+		return -1
+	}
+	name := mnemonics[i.mnemonic].name
+	if (name != "bra") && !((name == "jmp") && (i.addressMode == modeAbsolute)) {
+		return -1
+	}
+
+	for n := k+1; (n < len(items)) && (items[n].i.mnemonic == 0); n++ {
+		if (items[n].i.symbolLC == i.symbolLC) {
+			return k
+		}
+	}
+
+	return -1
+}
+
+/*
+ *  STA $aaaa then LDA $aaaa (with no label in between, and only to zero page or a VAR or GLOBAL)
+ */
+func optStoreThenLoad(p *parser, items []peepItem, k int, labels map[string]int) int {
+	if (k+1 >= len(items)) {
+		return -1
+	}
+	st := items[k].i
+	ld := items[k+1].i
+	if (st.mnemonic == 0) || (ld.mnemonic == 0) {
+		return -1
+	}
+
+	var load string
+	switch (mnemonics[st.mnemonic].name) {
+	case "sta": load = "lda"
+	case "stx": load = "ldx"
+	case "sty": load = "ldy"
+	default: return -1
+	}
+	if (mnemonics[ld.mnemonic].name != load) || (ld.addressMode != st.addressMode) || (ld.prefix != st.prefix) {
+		return -1
+	}
+	if !ld.hasValue || !st.hasValue || (ld.value != st.value) || (ld.symbolLC != st.symbolLC) {
+		return -1
+	}
+
+	// Only memory that reads back what was stored, i.e. zero page or a VAR or GLOBAL (not I/O)
+	switch (ld.addressMode) {
+	case modeZeroPage, modeZeroPageX, modeZeroPageY:
+	case modeAbsolute, modeAbsoluteX, modeAbsoluteY:
+		if (!p.isVariableAddress(items[k+1].b, ld.value)) {
+			return -1
+		}
+	default:
+		return -1
+	}
+
+	// The load sets N and Z, so only remove it if nothing needs them
+	if flagsLive(items, k+2, FLAG_N|FLAG_Z, labels, make(map[int]int)) {
+		return -1
+	}
+
+	return k+1
+}
+
+/*
+ *  LDA then CMP #0 (with no label in between)
+ */
+func optCompareZero(p *parser, items []peepItem, k int, labels map[string]int) int {
+	if (k+1 >= len(items)) {
+		return -1
+	}
+	ld := items[k].i
+	cmp := items[k+1].i
+	if (ld.mnemonic == 0) || (cmp.mnemonic == 0) {
+		return -1
+	}
+	if (cmp.addressMode != modeImmediate) || !cmp.hasValue || (cmp.value != 0) {
+		return -1
+	}
+
+	// The load must set N and Z from the register being compared
+	var reg int
+	switch (mnemonics[cmp.mnemonic].name) {
+	case "cmp": reg = REG_A
+	case "cpx": reg = REG_X
+	case "cpy": reg = REG_Y
+	default: return -1
+	}
+	switch (mnemonics[ld.mnemonic].name) {
+	case "lda", "txa", "tya", "pla", "ldx", "tax", "tsx", "plx", "ldy", "tay", "ply":
+	default: return -1
+	}
+	if (mnemonics[ld.mnemonic].reg != reg) || (ld.prefix & R32 != cmp.prefix & R32) {
+		return -1
+	}
+
+	// CMP #0 also sets the carry, so only remove it if nothing needs that
+	if flagsLive(items, k+2, FLAG_C, labels, make(map[int]int)) {
+		return -1
+	}
+
+	return k+1
+}
+
+/*
+ *  A24/R16/R24/W16/W24 then an instruction that already has that prefix code
+ */
+func optRepeatPrefix(p *parser, items []peepItem, k int, labels map[string]int) int {
+	if (k+1 >= len(items)) {
+		return -1
+	}
+	pfx := items[k].i
+	next := items[k+1].i
+	if (pfx.mnemonic == 0) || (next.mnemonic == 0) {
+		return -1
+	}
+
+	switch (mnemonics[pfx.mnemonic].name) {
+	case "a24", "r16", "r24", "w16", "w24":
+		if (next.prefix == pfx.opcode) {
+			return k
+		}
+	}
+
+	return -1
+}
+
+
+/*
+ *  Write the statistics for each rule to the listing
+ */
+func (p *parser) outputOptimizerStats(listing *os.File) {
+	listing.WriteString("\n; PEEPHOLE OPTIMIZER\n")
+	total := 0
+	for r := range peepholes {
+		count, bytes := 0, 0
+		if (p.peepCount != nil) {
+			count = p.peepCount[r]
+			bytes = p.peepBytes[r]
+		}
+		total += bytes
+		line := fmt.Sprintf(";   %-14s %5d removed, %6d bytes   (%s)\n", peepholes[r].name, count, bytes, peepholes[r].about)
+		listing.WriteString(line)
+	}
+	listing.WriteString(fmt.Sprintf(";   %-14s               %6d bytes\n", "TOTAL", total))
+	fmt.Printf("+ %6d bytes ($%x) removed by the OPTIMIZER\n", total, total)
+}
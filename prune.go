@@ -0,0 +1,262 @@
+package aCCembler
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// A SUB or DATA block dropped by -prune
+type prunedBlock struct {
+	kind		string			// SUB or DATA
+	name		string
+	nameLC		string
+	bytes		int				// the bytes it would have taken
+}
+
+// A #keep name, and where it was (for the error if there is no SUB or DATA with the name)
+type keepName struct {
+	nameLC		string
+	filename	string
+	line		int
+}
+
+// The blocks reached so far from the roots
+type reachable struct {
+	code		map[*codeBlock]bool
+	data		map[*dataBlock]bool
+	codeWork	[]*codeBlock	// reached, but not yet followed
+	dataWork	[]*dataBlock
+}
+
+
+/*
+ *  Parse the #keep directive, e.g. #keep print_hex, font
+ *  (the SUBs and DATA that -prune never drops)
+ */
+func (p *parser) parseKeep() error {
+	for {
+		p.skipWhitespace()
+		name := p.nextAZ_az_09()
+		if (name == "") {
+			return fmt.Errorf("#keep is missing the name of a SUB or DATA")
+		}
+		p.keep = append(p.keep, keepName{strings.ToLower(name), p.filename, p.n})
+
+		p.skipWhitespace()
+		if (p.peekChar() != ',') {
+			break
+		}
+		p.skip(1)
+	}
+
+	p.skipWhitespaceAndEOL()
+	return nil
+}
+
+/*
+ *  Find the SUB and DATA blocks that can't be reached from the roots: the VECTORS, every ISR, NMI,
+ *  and THREAD, every block at an @address, each #keep, and (without VECTORS) the first block of code
+ *  (following the symbols and addresses of every instruction and data entry)
+ */
+func (p *parser) findUnreachable() ([]prunedBlock, error) {
+	// Every symbol is needed to follow the code
+	err := p.resolveSymbols()
+	if (err != nil) {
+		return nil, err
+	}
+
+	r := &reachable{make(map[*codeBlock]bool), make(map[*dataBlock]bool), nil, nil}
+	vectors := false
+	for d := p.data; d != nil; d = d.next {
+		if (d.placed) {
+			r.reachData(d)
+		}
+		if (d.nameLC == "vectors") {
+			vectors = true
+		}
+	}
+	for b := p.code; b != nil; b = b.next {
+		if (b.placed) || (b.kind != BLK_SUB) {
+			r.reachCode(b)
+		}
+	}
+	if (!vectors) && (p.code != nil) {
+		r.reachCode(p.code)
+	}
+	for _, k := range p.keep {
+		if (!p.reachName(r, k.nameLC)) {
+			return nil, &sourceError{k.filename, k.line, fmt.Errorf("#keep '%s' is not a SUB or DATA", k.nameLC)}
+		}
+	}
+
+	// Follow everything reached until there is nothing new
+	for (len(r.codeWork) > 0) || (len(r.dataWork) > 0) {
+		if (len(r.codeWork) > 0) {
+			b := r.codeWork[len(r.codeWork)-1]
+			r.codeWork = r.codeWork[:len(r.codeWork)-1]
+			p.followCode(r, b)
+		} else {
+			d := r.dataWork[len(r.dataWork)-1]
+			r.dataWork = r.dataWork[:len(r.dataWork)-1]
+			for e := d.data; e != nil; e = e.next {
+				if (e.symbol != "") {
+					p.reachName(r, strings.ToLower(e.symbol))
+				}
+			}
+		}
+	}
+
+	// In the order they were parsed
+	var pruned []prunedBlock
+	for b := p.code; b != nil; b = b.next {
+		if (!r.code[b]) {
+			pruned = append(pruned, prunedBlock{"SUB", b.name, b.nameLC, b.endAddr - b.startAddr})
+		}
+	}
+	for d := p.data; d != nil; d = d.next {
+		if (!r.data[d]) {
+			pruned = append(pruned, prunedBlock{"DATA", d.name, d.nameLC, d.endAddr - d.startAddr})
+		}
+	}
+
+	return pruned, nil
+}
+
+/*
+ *  Follow the symbols and addresses of every instruction in the block (and its sub-blocks)
+ */
+func (p *parser) followCode(r *reachable, b *codeBlock) {
+	for i := b.instr; i != nil; i = i.next {
+		if (i.subBlock != nil) {
+			p.followCode(r, i.subBlock.block)
+			continue
+		}
+		if (i.expr != nil) {
+			for _, u := range []eunit{i.expr.dest, i.expr.src1, i.expr.src2} {
+				if (u.location == MEMORY) || (u.location == VARIABLE) {
+					p.reachAddress(r, u.addrval)
+				}
+			}
+			continue
+		}
+		if (i.mnemonic == 0) || (i.comment != nil) {
+			continue
+		}
+
+		if (i.symbol != "") {
+			p.reachName(r, strings.ToLower(i.symbol))
+		}
+		switch (i.addressMode) {
+		case modeImplicit, modeImmediate, modeRelative, modeZeroPageRelative, modeX, modeXY:
+		default:
+			p.reachAddress(r, i.value)
+		}
+	}
+}
+
+/*
+ *  Reach the SUB or DATA with the name (or a label inside a DATA), returning whether there is one
+ */
+func (p *parser) reachName(r *reachable, nameLC string) bool {
+	for b := p.code; b != nil; b = b.next {
+		if (b.nameLC == nameLC) {
+			r.reachCode(b)
+			return true
+		}
+	}
+	for d := p.data; d != nil; d = d.next {
+		if (d.nameLC == nameLC) {
+			r.reachData(d)
+			return true
+		}
+		for e := d.data; e != nil; e = e.next {
+			if (e.size == DLABEL) && (strings.ToLower(e.label) == nameLC) {
+				r.reachData(d)
+				return true
+			}
+		}
+	}
+	return false
+}
+
+/*
+ *  Reach the SUB or DATA at the address
+ */
+func (p *parser) reachAddress(r *reachable, address int) {
+	for b := p.code; b != nil; b = b.next {
+		if (address >= b.startAddr) && (address < b.endAddr) {
+			r.reachCode(b)
+		}
+	}
+	for d := p.data; d != nil; d = d.next {
+		if (address >= d.startAddr) && (address < d.endAddr) {
+			r.reachData(d)
+		}
+	}
+}
+
+func (r *reachable) reachCode(b *codeBlock) {
+	if (!r.code[b]) {
+		r.code[b] = true
+		r.codeWork = append(r.codeWork, b)
+	}
+}
+
+func (r *reachable) reachData(d *dataBlock) {
+	if (!r.data[d]) {
+		r.data[d] = true
+		r.dataWork = append(r.dataWork, d)
+	}
+}
+
+/*
+ *  Whether -prune drops the SUB or DATA
+ */
+func (p *parser) isPruned(nameLC string) bool {
+	for _, pb := range p.pruned {
+		if (pb.nameLC == nameLC) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+ *  Remove the last code block, once it has been parsed, so the next block takes its address
+ */
+func (p *parser) unlinkCodeBlock(b *codeBlock) {
+	if (b.prev == nil) {
+		p.code = nil
+	} else {
+		b.prev.next = nil
+	}
+	p.lastCode = b.prev
+	p.currentCode = b.prev
+}
+
+/*
+ *  Remove the last data block, once it has been parsed, so the next block takes its address
+ */
+func (p *parser) unlinkDataBlock(d *dataBlock) {
+	if (d.prev == nil) {
+		p.data = nil
+	} else {
+		d.prev.next = nil
+	}
+	p.lastData = d.prev
+}
+
+/*
+ *  Write the SUB and DATA blocks dropped by -prune to the listing
+ */
+func (p *parser) outputPruned(listing *os.File) {
+	listing.WriteString("\n; PRUNED (the SUBs and DATA that can't be reached)\n")
+	total := 0
+	for _, pb := range p.pruned {
+		total += pb.bytes
+		listing.WriteString(fmt.Sprintf(";   %-4s %-20s %6d bytes\n", pb.kind, pb.name, pb.bytes))
+	}
+	listing.WriteString(fmt.Sprintf(";   %-25s %6d bytes\n", "TOTAL", total))
+	fmt.Printf("+ %6d bytes ($%x) removed by -prune\n", total, total)
+}
@@ -3,6 +3,7 @@ package aCCembler
 import (
 	"fmt"
 	"strconv"
+	"strings"
 )
 
 // All the valid assembly language mnemonics
@@ -77,247 +78,665 @@ var psedomnemonics = []psedomnemonic {
  *  Lookup the pseudo-register mnemonic
  */
 func (p *parser) isRegisterMnemonic(mnemonic string) bool {
-	if (len(mnemonic) < 4) {
-		return false
-	}
+	n, _ := registerMnemonicIndex(mnemonic)
+	return (n >= 0)
+}
 
-	// Find the table entry for the pseudo-mnemonic
-	for p := range psedomnemonics {
-		if (mnemonic[:4] == psedomnemonics[p].name) {
-			return true
+/*
+ *  Find the table entry for the pseudo-mnemonic, and whether it is followed by the name of a REG
+ *  e.g. LD_W4 (numbered) or LD_ count or LD_W count (named)
+ */
+func registerMnemonicIndex(mnemonic string) (int, bool) {
+	for n := range psedomnemonics {
+		name := psedomnemonics[n].name
+		switch {
+		case (mnemonic == strings.TrimSuffix(name[:3], "_") + "_"):
+			return n, true
+		case (mnemonic == name):
+			// MV_W by itself copies memory to memory
+			return n, (psedomnemonics[n].mnemonic != "mv_")
+		case (len(mnemonic) > 4) && (mnemonic[:4] == name):
+			return n, false
 		}
 	}
 
-	return false
+	return -1, false
 }
 
 /*
  *  Parse a pseudo-register mnemonic
- *  e.g. LDR0 #123, LDW4 #123456
+ *  e.g. LDR0 #123, LDW4 #123456, LD_ count #0
  */
 func (p *parser) parseRegister(mnemonic string) error {
 	// Find the table entry for the pseudo-mnemonic
-	for n := range psedomnemonics {
-		if (mnemonic[:4] == psedomnemonics[n].name) {
-			var err error
-			reg64 := int64(0)
-			if (psedomnemonics[n].mnemonic != "mv_") {
-				reg64, err = strconv.ParseInt(mnemonic[4:], 10, 16)
-				if (err != nil) {
-					return fmt.Errorf("invalid register number (%s)", err)
-				} else if (reg64 < 0) || (reg64 > 255) {
-					return fmt.Errorf("registers must be 0-255, not %d", reg64)
-				}
-			}
-			reg := int(reg64 & 0xffff)
+	n, named := registerMnemonicIndex(mnemonic)
+	if (n < 0) {
+		return fmt.Errorf("invalid psedomnemonic %s", mnemonic)
+	}
+
+	sz := R08
+	switch (psedomnemonics[n].name[3:4]) {
+	case "w": sz = R16
+	case "t": sz = R24
+	}
 
-			// Parse the/any args
-			args, err := p.parseArgs()
+	var err error
+	var r *rgstr
+	reg := 0
+	if (named) {
+		// The width comes from the REG (and must match the mnemonic's, if any)
+		p.skipWhitespace()
+		regName := p.nextAZ_az_09()
+		r = p.lookupRegisterName(p.currentCode, regName)
+		if (r == nil) {
+			return fmt.Errorf("%s needs the name of a REG, not '%s'", mnemonic, regName)
+		}
+		if (mnemonic == psedomnemonics[n].name) && (sz != r.size) {
+			return fmt.Errorf("REG %s is %d-bit, not %s", r.name, prefixToWidth(r.size), mnemonic)
+		}
+		p.useRegisterName(r)
+		sz = r.size
+		reg = r.address
+
+		p.skipWhitespace()
+		if (p.peekChar() == ',') {
+			p.skip(1)
+		}
+	} else if (psedomnemonics[n].mnemonic != "mv_") {
+		reg64, err := strconv.ParseInt(mnemonic[4:], 10, 16)
+		if (err != nil) {
+			return fmt.Errorf("invalid register number (%s)", err)
+		}
+		reg, err = p.registerAddress(int(reg64), registerBytes(sz))
+		if (err != nil) {
+			return err
+		}
+	}
+	nb := registerBytes(sz)
+
+	// Parse the/any args
+	args, err := p.parseArgs()
+	if (err != nil) {
+		return err
+	}
+
+	// Arguments
+	comment := fmt.Sprintf("%s", mnemonic)
+	if (named) {
+		comment += " " + r.name
+	}
+	switch (args.mode) {
+	default: comment += fmt.Sprintf(" ???%d/%x", args.mode, args.value)
+	case modeImplicit:
+	case modeImmediate:
+		comment += fmt.Sprintf(" #$%x", args.value)
+	case modeZeroPage:
+		comment += fmt.Sprintf(" $%02x", args.value)
+	case modeZeroPageX:
+		comment += fmt.Sprintf(" $%02x,X", args.value)
+	case modeZeroPageY:
+		comment += fmt.Sprintf(" $%02x,Y", args.value)
+	case modeRelative:
+		return fmt.Errorf("%s can not specify a relative address", mnemonic)
+	case modeAbsolute:
+		if (!args.hasValue) {
+			comment += " " + args.symbol
+		} else if (args.size == A16) {
+			comment += fmt.Sprintf(" $%04x", args.value)
+		} else {
+			comment += fmt.Sprintf(" $%06x", args.value)
+		}
+	case modeAbsoluteX:
+		if (args.size == A16) {
+			comment += fmt.Sprintf(" $%04x,X", args.value)
+		} else {
+			comment += fmt.Sprintf(" $%06x,X", args.value)
+		}
+	case modeAbsoluteY:
+		if (args.size == A16) {
+			comment += fmt.Sprintf(" $%04x,Y", args.value)
+		} else {
+			comment += fmt.Sprintf(" $%06x,Y", args.value)
+		}
+	case modeIndirect:
+		if (args.size == A16) {
+			comment += fmt.Sprintf(" ($%04x)", args.value)
+		} else {
+			comment += fmt.Sprintf(" ($%06x)", args.value)
+		}
+	case modeIndexedIndirectX:
+		comment += fmt.Sprintf(" ($%02x,X)", args.value & 0xff)
+	case modeIndirectIndexedY:
+		comment += fmt.Sprintf(" ($%02x),Y", args.value & 0xff)
+	case modeIndirectZeroPage:
+		comment += fmt.Sprintf(" ($%02x)", args.value & 0xff)
+	case modeAbsoluteIndexedIndirectX:
+		if (args.size == A16) {
+			comment += fmt.Sprintf(" ($%04x,X)", args.value)
+		} else {
+			comment += fmt.Sprintf(" ($%06x,X)", args.value)
+		}
+	case modeX:
+		comment += fmt.Sprintf(" X")
+	case modeXY:
+		comment += fmt.Sprintf(" XY")
+	}
+	p.addInstructionComment(comment)
+
+	name := p.constructName(mnemonic + "_")
+
+	switch (psedomnemonics[n].mnemonic) {
+	case "pha":
+		if (args.mode != modeImplicit) {
+			return fmt.Errorf("%s doesn't take an argument", mnemonic)
+		}
+		// High byte first, so the low byte is on the top of the stack (through A)
+		for k := nb-1; k >= 0; k-- {
+			p.addRegisterInstruction("lda", modeZeroPage, R08, reg+k)
+			p.addRegisterInstruction("pha", modeImplicit, R08, 0)
+		}
+	case "pla":
+		if (args.mode != modeImplicit) {
+			return fmt.Errorf("%s doesn't take an argument", mnemonic)
+		}
+		// Low byte first (through A)
+		for k := 0; k < nb; k++ {
+			p.addRegisterInstruction("pla", modeImplicit, R08, 0)
+			p.addRegisterInstruction("sta", modeZeroPage, R08, reg+k)
+		}
+	case "ora", "and", "eor", "adc", "sbc":
+		// e.g. ADCR4 is ADC $04, the same as CMPR4
+		mmm := psedomnemonics[n].mnemonic
+		if (args.mode == modeImplicit) {
+			if (sz != R08) {
+				return fmt.Errorf("%s needs an argument", mnemonic)
+			}
+			p.addRegisterInstruction(mmm, modeZeroPage, R08, reg)
+			break
+		}
+		args, err = p.registerOperand(mnemonic, args, nb)
+		if (err != nil) {
+			return err
+		}
+		// Low byte first, so the carry ripples up through ADC and SBC
+		for k := 0; k < nb; k++ {
+			p.addRegisterInstruction("lda", modeZeroPage, R08, reg+k)
+			p.addRegisterOperand(mmm, args, k)
+			p.addRegisterInstruction("sta", modeZeroPage, R08, reg+k)
+		}
+	case "bit":
+		if (args.mode == modeImplicit) {
+			if (sz != R08) {
+				return fmt.Errorf("%s needs an argument", mnemonic)
+			}
+			p.addRegisterInstruction("bit", modeZeroPage, R08, reg)
+			break
+		}
+		args, err = p.registerOperand(mnemonic, args, nb)
+		if (err != nil) {
+			return err
+		}
+		if (args.mode == modeZeroPage) || (args.mode == modeAbsolute) {
+			p.addRegisterBit(reg, args, nb, name)
+			break
+		} else if (args.mode != modeImmediate) {
+			return fmt.Errorf("%s can only use a #value, an address, or another register", mnemonic)
+		}
+		// With a #value, only Z is set (like BIT # on the 65C02), when no byte has a bit in common
+		for k := nb-1; k >= 0; k-- {
+			p.addRegisterInstruction("lda", modeZeroPage, R08, reg+k)
+			p.addRegisterOperand("and", args, k)
+			if (k > 0) {
+				p.addExprInstructionWithSymbol("bne", modeRelative, A16, 0, name, false)
+			}
+		}
+		if (nb > 1) {
+			p.addInstructionLabel(name)
+		}
+	case "cmp":
+		if (args.mode == modeImplicit) {
+			if (sz != R08) {
+				return fmt.Errorf("%s needs an argument", mnemonic)
+			}
+			p.addRegisterInstruction("cmp", modeZeroPage, R08, reg)
+			break
+		}
+		args, err = p.registerOperand(mnemonic, args, nb)
+		if (err != nil) {
+			return err
+		}
+		p.addRegisterCompare(reg, args, nb, name)
+	case "ccc":
+		args, err = p.registerOperand(mnemonic, args, nb)
+		if (err != nil) {
+			return err
+		} else if (args.mode != modeZeroPage) {
+			return fmt.Errorf("%s compares two registers, e.g. CCCT0 t3", mnemonic)
+		}
+		p.addRegisterCompare(reg, args, nb, name)
+	case "rol", "asl":
+		if (args.mode != modeImplicit) {
+			return fmt.Errorf("%s doesn't take an argument", mnemonic)
+		}
+		// Low byte first, rotating the carry up into the next byte
+		p.addRegisterInstruction(psedomnemonics[n].mnemonic, modeZeroPage, R08, reg)
+		for k := 1; k < nb; k++ {
+			p.addRegisterInstruction("rol", modeZeroPage, R08, reg+k)
+		}
+	case "ror", "lsr":
+		if (args.mode != modeImplicit) {
+			return fmt.Errorf("%s doesn't take an argument", mnemonic)
+		}
+		// High byte first, rotating the carry down into the next byte
+		p.addRegisterInstruction(psedomnemonics[n].mnemonic, modeZeroPage, R08, reg+nb-1)
+		for k := nb-2; k >= 0; k-- {
+			p.addRegisterInstruction("ror", modeZeroPage, R08, reg+k)
+		}
+	case "inc":
+		if (args.mode != modeImplicit) {
+			return fmt.Errorf("%s doesn't take an argument", mnemonic)
+		}
+		// Only carry into the next byte when this one wraps to zero
+		for k := 0; k < nb; k++ {
+			p.addRegisterInstruction("inc", modeZeroPage, R08, reg+k)
+			if (k < nb-1) {
+				p.addExprInstructionWithSymbol("bne", modeRelative, A16, 0, name, false)
+			}
+		}
+		if (nb > 1) {
+			p.addInstructionLabel(name)
+		}
+	case "dec":
+		if (args.mode != modeImplicit) {
+			return fmt.Errorf("%s doesn't take an argument", mnemonic)
+		}
+		// Only borrow from the next byte when this one is zero (uses A)
+		for k := 0; k < nb-1; k++ {
+			p.addRegisterInstruction("lda", modeZeroPage, R08, reg+k)
+			p.addExprInstructionWithSymbol("bne", modeRelative, A16, 0, fmt.Sprintf("%s_%d", name, k), false)
+		}
+		for k := nb-1; k >= 0; k-- {
+			if (k < nb-1) {
+				p.addInstructionLabel(fmt.Sprintf("%s_%d", name, k))
+			}
+			p.addRegisterInstruction("dec", modeZeroPage, R08, reg+k)
+		}
+	case "lda":
+		switch (args.mode) {
+		case modeImplicit:
+			switch (sz) {
+			case R08:
+				p.addRegisterInstruction("lda", modeZeroPage, R08, reg)
+			default:
+				return fmt.Errorf("ld_w and ld_t with makes no sense")
+			}
+		case modeImmediate:
+			if (!fitsRegister(args.value, nb)) {
+				return fmt.Errorf("#$%x is too wide for the %d-bit %s", args.value, nb*8, mnemonic)
+			}
+			p.addRegisterInstruction("lda", modeImmediate, R08, args.value & 0x0FF)
+			p.addRegisterInstruction("sta", modeZeroPage, R08, reg)
+			if (sz != R08) {
+				p.addRegisterInstruction("lda", modeImmediate, R08, (args.value >> 8) & 0x0FF)
+				p.addRegisterInstruction("sta", modeZeroPage, R08, reg+1)
+			}
+			if (sz == R24) {
+				p.addRegisterInstruction("lda", modeImmediate, R08, (args.value >> 16) & 0x0FF)
+				p.addRegisterInstruction("sta", modeZeroPage, R08, reg+2)
+			}
+		default:
+			p.addRegisterInstruction("lda", args.mode, R08, args.value)
+			p.addRegisterInstruction("sta", modeZeroPage, R08, reg)
+			if (sz != R08) {
+				p.addRegisterInstruction("lda", args.mode, R08, args.value+1)
+				p.addRegisterInstruction("sta", modeZeroPage, R08, reg+1)
+			}
+			if (sz == R24) {
+				p.addRegisterInstruction("lda", args.mode, R08, args.value+2)
+				p.addRegisterInstruction("sta", modeZeroPage, R08, reg+2)
+			}
+		}
+	case "sta":
+		if (args.mode == modeImmediate) {
+			return fmt.Errorf("You mean to ld_r, not st_r with that #immediate value")
+		}
+		p.addRegisterInstruction("lda", modeZeroPage, R08, reg)
+		p.addRegisterInstruction("sta", args.mode, R08, args.value)
+		if (sz != R08) {
+			p.addRegisterInstruction("lda", modeZeroPage, R08, reg+1)
+			p.addRegisterInstruction("sta", args.mode, R08, args.value+1)
+		}
+		if (sz == R24) {
+			p.addRegisterInstruction("lda", modeZeroPage, R08, reg+2)
+			p.addRegisterInstruction("sta", args.mode, R08, args.value+2)
+		}
+	case "mv_":
+		if (args.mode == modeImmediate) {
+			return fmt.Errorf("You mean to ld_r, not mv_r with that #immediate value")
+		}
+		if (named) {
+			// Copy the REG to the address (or to another REG)
+			args, err = p.registerOperand(mnemonic, args, nb)
 			if (err != nil) {
 				return err
 			}
-
-			// Arguments
-			comment := fmt.Sprintf("%s", mnemonic)
-			switch (args.mode) {
-			default: comment += fmt.Sprintf(" ???%d/%x", args.mode, args.value)
-			case modeImplicit:
-			case modeImmediate:
-				comment += fmt.Sprintf(" #$%x", args.value)
-			case modeZeroPage:
-				comment += fmt.Sprintf(" $%02x", args.value)
-			case modeZeroPageX:
-				comment += fmt.Sprintf(" $%02x,X", args.value)
-			case modeZeroPageY:
-				comment += fmt.Sprintf(" $%02x,Y", args.value)
-			case modeRelative:
-				return fmt.Errorf("%s can not specify a relative address", mnemonic)
-			case modeAbsolute:
-				if (args.size == A16) {
-					comment += fmt.Sprintf(" $%04x", args.value)
-				} else {
-					comment += fmt.Sprintf(" $%06x", args.value)
-				}
-			case modeAbsoluteX:
-				if (args.size == A16) {
-					comment += fmt.Sprintf(" $%04x,X", args.value)
-				} else {
-					comment += fmt.Sprintf(" $%06x,X", args.value)
-				}
-			case modeAbsoluteY:
-				if (args.size == A16) {
-					comment += fmt.Sprintf(" $%04x,Y", args.value)
-				} else {
-					comment += fmt.Sprintf(" $%06x,Y", args.value)
-				}
-			case modeIndirect:
-				if (args.size == A16) {
-					comment += fmt.Sprintf(" ($%04x)", args.value)
-				} else {
-					comment += fmt.Sprintf(" ($%06x)", args.value)
-				}
-			case modeIndexedIndirectX:
-				comment += fmt.Sprintf(" ($%02x,X)", args.value & 0xff)
-			case modeIndirectIndexedY:
-				comment += fmt.Sprintf(" ($%02x),Y", args.value & 0xff)
-			case modeIndirectZeroPage:
-				comment += fmt.Sprintf(" ($%02x)", args.value & 0xff)
-			case modeAbsoluteIndexedIndirectX:
-				if (args.size == A16) {
-					comment += fmt.Sprintf(" ($%04x,X)", args.value)
-				} else {
-					comment += fmt.Sprintf(" ($%06x,X)", args.value)
-				}
-			case modeX:
-				comment += fmt.Sprintf(" X")
-			case modeXY:
-				comment += fmt.Sprintf(" XY")
+			for k := 0; k < nb; k++ {
+				p.addRegisterInstruction("lda", modeZeroPage, R08, reg+k)
+				p.addRegisterOperand("sta", args, k)
 			}
-			p.addInstructionComment(comment)
+			break
+		}
+		// Parse the second set of args
+		args2, err2 := p.parseArgs()
+		if (err2 != nil) {
+			return err2
+		}
+		p.addRegisterInstruction("lda", args.mode, R08, args.value)
+		p.addRegisterInstruction("sta", args2.mode, R08, args2.value)
+		if (sz != R08) {
+			p.addRegisterInstruction("lda", args.mode, R08, args.value+1)
+			p.addRegisterInstruction("sta", args2.mode, R08, args2.value+1)
+		}
+		if (sz == R24) {
+			p.addRegisterInstruction("lda", args.mode, R08, args.value+2)
+			p.addRegisterInstruction("sta", args2.mode, R08, args2.value+2)
+		}
+	}
+	return nil
+}
 
-			sz := R08
-			switch (mnemonic[3:4]) {
-			case "w": sz = R16
-			case "t": sz = R24
-			}
 
-			switch (psedomnemonics[n].mnemonic) {
-			case "pha":
-				return fmt.Errorf("instruction not yet implemented")
-			case "pla":
-				return fmt.Errorf("instruction not yet implemented")
-			case "ora":
-				return fmt.Errorf("instruction not yet implemented")
-			case "and":
-				return fmt.Errorf("instruction not yet implemented")
-			case "eor":
-				return fmt.Errorf("instruction not yet implemented")
-			case "adc":
-				return fmt.Errorf("instruction not yet implemented")
-			case "sbc":
-				return fmt.Errorf("instruction not yet implemented")
-			case "bit":
-				return fmt.Errorf("instruction not yet implemented")
-			case "cmp":
-				switch (sz) {
-				case R08:
-					p.addRegisterInstruction("cmp", modeZeroPage, R08, reg)
-				default:
-					return fmt.Errorf("cmpw and cmpt are not allowed")
-				}
-			case "zzz":
-			case "ccc":
-				reg64, err = strconv.ParseInt(args.symbol[1:], 10, 16)
-				if (err != nil) {
-					return fmt.Errorf("invalid register number (%s)", err)
-				} else if (reg64 < 0) || (reg64 > 255) {
-					return fmt.Errorf("registers must be 0-255, not %d", reg64)
-				}
-				reg2 := int(reg64)
-				switch (sz) {
-				case R08:
-					p.addRegisterInstruction("cmp", modeZeroPage, R08, reg2)
-				case R16:
-					p.addRegisterInstruction("sec", modeImplicit, R08, 0)
-					p.addRegisterInstruction("lda", modeZeroPage, R08, reg)
-					p.addRegisterInstruction("sbc", modeZeroPage, R08, reg2)
-					p.addRegisterInstruction("lda", modeZeroPage, R08, reg+1)
-					p.addRegisterInstruction("sbc", modeZeroPage, R08, reg2+1)
-				case R24:
-					// Only sets the C bit correctly
-					p.addRegisterInstruction("sec", modeImplicit, R08, 0)
-					p.addRegisterInstruction("lda", modeZeroPage, R08, reg)
-					p.addRegisterInstruction("sbc", modeZeroPage, R08, reg2)
-					p.addRegisterInstruction("lda", modeZeroPage, R08, reg+1)
-					p.addRegisterInstruction("sbc", modeZeroPage, R08, reg2+1)
-					p.addRegisterInstruction("lda", modeZeroPage, R08, reg+2)
-					p.addRegisterInstruction("sbc", modeZeroPage, R08, reg2+2)
-				}
-			case "rol":
-				return fmt.Errorf("instruction not yet implemented")
-			case "ror":
-				return fmt.Errorf("instruction not yet implemented")
-			case "asl":
-				return fmt.Errorf("instruction not yet implemented")
-			case "lsr":
-				return fmt.Errorf("instruction not yet implemented")
-			case "inc":
-				return fmt.Errorf("instruction not yet implemented")
-			case "dec":
-				return fmt.Errorf("instruction not yet implemented")
-			case "lda":
-				switch (args.mode) {
-				case modeImplicit:
-					switch (sz) {
-					case R08:
-					p.addRegisterInstruction("lda", modeZeroPage, R08, reg)
-					default:
-						return fmt.Errorf("ld_w and ld_t with makes no sense")
-					}
-					case modeImmediate:
-					p.addRegisterInstruction("lda", modeImmediate, R08, args.value & 0x0FF)
-					p.addRegisterInstruction("sta", modeZeroPage, R08, reg)
-					if (sz != R08) {
-						p.addRegisterInstruction("lda", modeImmediate, R08, (args.value >> 8) & 0x0FF)
-						p.addRegisterInstruction("sta", modeZeroPage, R08, reg+1)
-					}
-					if (sz == R24) {
-						p.addRegisterInstruction("lda", modeImmediate, R08, (args.value >> 16) & 0x0FF)
-						p.addRegisterInstruction("sta", modeZeroPage, R08, reg+2)
-					}
-				default:
-					p.addRegisterInstruction("lda", args.mode, R08, args.value)
-					p.addRegisterInstruction("sta", modeZeroPage, R08, reg)
-					if (sz != R08) {
-						p.addRegisterInstruction("lda", args.mode, R08, args.value+1)
-						p.addRegisterInstruction("sta", modeZeroPage, R08, reg+1)
-					}
-					if (sz == R24) {
-						p.addRegisterInstruction("lda", args.mode, R08, args.value+2)
-						p.addRegisterInstruction("sta", modeZeroPage, R08, reg+2)
-					}
-				}
-			case "sta":
-				if (args.mode == modeImmediate) {
-					return fmt.Errorf("You mean to ld_r, not st_r with that #immediate value")
-				}
-				p.addRegisterInstruction("lda", modeZeroPage, R08, reg)
-				p.addRegisterInstruction("sta", args.mode, R08, args.value)
-				if (sz != R08) {
-					p.addRegisterInstruction("lda", modeZeroPage, R08, reg+1)
-					p.addRegisterInstruction("sta", args.mode, R08, args.value+1)
-				}
-				if (sz == R24) {
-					p.addRegisterInstruction("lda", modeZeroPage, R08, reg+2)
-					p.addRegisterInstruction("sta", args.mode, R08, args.value+2)
-				}
-			case "mv_":
-				if (args.mode == modeImmediate) {
-					return fmt.Errorf("You mean to ld_r, not mv_r with that #immediate value")
-				}
-				// Parse the second set of args
-				args2, err2 := p.parseArgs()
-				if (err2 != nil) {
-					return err2
-				}
-				p.addRegisterInstruction("lda", args.mode, R08, args.value)
-				p.addRegisterInstruction("sta", args2.mode, R08, args2.value)
-				if (sz != R08) {
-					p.addRegisterInstruction("lda", args.mode, R08, args.value+1)
-					p.addRegisterInstruction("sta", args2.mode, R08, args2.value+1)
-				}
-				if (sz == R24) {
-					p.addRegisterInstruction("lda", args.mode, R08, args.value+2)
-					p.addRegisterInstruction("sta", args2.mode, R08, args2.value+2)
-				}
+/*
+ *  How many bytes in the pseudo-register
+ */
+func registerBytes(sz int) int {
+	switch (sz) {
+	case R16:
+		return 2
+	case R24:
+		return 3
+	}
+
+	return 1
+}
+
+/*
+ *  Check the argument of a pseudo-register mnemonic
+ *  (changing another register, e.g. the t3 in CCCT0 t3, to its zero page address)
+ */
+func (p *parser) registerOperand(mnemonic string, args assemblyArgs, nb int) (assemblyArgs, error) {
+	if (!args.hasValue) && (p.lookupRegisterName(p.currentCode, args.symbol) != nil) {
+		r := p.lookupRegisterName(p.currentCode, args.symbol)
+		if (registerBytes(r.size) != nb) {
+			return args, fmt.Errorf("REG %s is %d-bit, but %s is %d-bit", r.name, prefixToWidth(r.size), mnemonic, nb*8)
+		}
+		p.useRegisterName(r)
+		args.mode = modeZeroPage
+		args.size = R08
+		args.value = r.address
+		args.hasValue = true
+	} else if (!args.hasValue) {
+		reg64, err := int64(0), fmt.Errorf("no register")
+		if (len(args.symbol) > 1) && strings.ContainsRune("rwtRWT", rune(args.symbol[0])) {
+			reg64, err = strconv.ParseInt(args.symbol[1:], 10, 16)
+		}
+		if (err != nil) {
+			return args, fmt.Errorf("%s can't use '%s', only a value, an address, or another register (e.g. t3)", mnemonic, args.symbol)
+		}
+		reg, err := p.registerAddress(int(reg64), nb)
+		if (err != nil) {
+			return args, err
+		}
+		args.mode = modeZeroPage
+		args.size = R08
+		args.value = reg
+		args.hasValue = true
+	}
+
+	switch (args.mode) {
+	case modeImmediate:
+		if (!fitsRegister(args.value, nb)) {
+			return args, fmt.Errorf("#$%x is too wide for the %d-bit %s", args.value, nb*8, mnemonic)
+		}
+	case modeZeroPage, modeZeroPageX, modeZeroPageY:
+	case modeAbsolute, modeAbsoluteX, modeAbsoluteY:
+	default:
+		return args, fmt.Errorf("%s can only use an immediate, zero page, or absolute (optionally indexed) argument", mnemonic)
+	}
+
+	return args, nil
+}
+
+/*
+ *  Add an instruction using byte k of the argument
+ */
+func (p *parser) addRegisterOperand(mmm string, args assemblyArgs, k int) {
+	switch (args.mode) {
+	case modeImmediate:
+		p.addRegisterInstruction(mmm, modeImmediate, R08, (args.value >> (8*k)) & 0x0FF)
+	case modeAbsolute, modeAbsoluteX, modeAbsoluteY:
+		size := A16
+		if (args.size & A24 == A24) {
+			size = A24
+		}
+		p.addRegisterInstruction(mmm, args.mode, size, args.value+k)
+	default:
+		p.addRegisterInstruction(mmm, args.mode, R08, args.value+k)
+	}
+}
+
+/*
+ *  Compare the pseudo-register to the argument, setting C, Z, and N for the whole value
+ *  (high byte first until a byte differs, then SEC/SBC low byte first for C and N of the
+ *   difference, with ORA #1 to clear Z without changing them)
+ */
+func (p *parser) addRegisterCompare(reg int, args assemblyArgs, nb int, name string) {
+	if (nb == 1) {
+		p.addRegisterInstruction("lda", modeZeroPage, R08, reg)
+		p.addRegisterOperand("cmp", args, 0)
+		return
+	}
+
+	// Equal, i.e. Z and C set and N clear
+	differ := fmt.Sprintf("%s_ne", name)
+	for k := nb-1; k >= 0; k-- {
+		p.addRegisterInstruction("lda", modeZeroPage, R08, reg+k)
+		p.addRegisterOperand("cmp", args, k)
+		if (k > 0) {
+			p.addExprInstructionWithSymbol("bne", modeRelative, A16, 0, differ, false)
+		} else {
+			p.addExprInstructionWithSymbol("beq", modeRelative, A16, 0, name, false)
+		}
+	}
+
+	// Not equal
+	p.addInstructionLabel(differ)
+	p.addRegisterInstruction("sec", modeImplicit, R08, 0)
+	for k := 0; k < nb; k++ {
+		p.addRegisterInstruction("lda", modeZeroPage, R08, reg+k)
+		p.addRegisterOperand("sbc", args, k)
+	}
+	p.addRegisterInstruction("ora", modeImmediate, R08, 1)
+	p.addInstructionLabel(name)
+}
+
+/*
+ *  BIT the pseudo-register with an address (or another register), like BIT setting Z when
+ *  no byte has a bit in common, and N and V from bits 7 and 6 of the highest byte of the argument
+ */
+func (p *parser) addRegisterBit(reg int, args assemblyArgs, nb int, name string) {
+	if (nb == 1) {
+		p.addRegisterInstruction("lda", modeZeroPage, R08, reg)
+		p.addRegisterOperand("bit", args, 0)
+		return
+	}
+
+	// No bits in common, i.e. BIT with A = 0 for Z set (and N and V)
+	common := fmt.Sprintf("%s_nz", name)
+	for k := nb-1; k >= 0; k-- {
+		p.addRegisterInstruction("lda", modeZeroPage, R08, reg+k)
+		p.addRegisterOperand("and", args, k)
+		p.addExprInstructionWithSymbol("bne", modeRelative, A16, 0, common, false)
+	}
+	p.addRegisterOperand("bit", args, nb-1)
+	p.addExprInstructionWithSymbol("beq", modeRelative, A16, 0, name, false)
+
+	// A bit in common, i.e. BIT with A = $FF for Z clear (unless the highest byte is 0,
+	// when N and V are clear, so LDA #1 clears Z)
+	p.addInstructionLabel(common)
+	p.addRegisterInstruction("lda", modeImmediate, R08, 0xFF)
+	p.addRegisterOperand("bit", args, nb-1)
+	p.addExprInstructionWithSymbol("bne", modeRelative, A16, 0, name, false)
+	p.addRegisterInstruction("lda", modeImmediate, R08, 1)
+	p.addInstructionLabel(name)
+}
+
+/*
+ *  Does the value fit in the bytes of the register (as either signed or unsigned)
+ */
+func fitsRegister(value int, nb int) bool {
+	return (value >= -(1 << (8*nb-1))) && (value < (1 << (8*nb)))
+}
+
+/*
+ *  Parse a named register, e.g. REG count = %R4.w
+ *  (at the top level when b is nil, otherwise local to the block)
+ */
+func (p *parser) parseRegisterName(b *codeBlock, name string) error {
+	if (name == "") {
+		return fmt.Errorf("reg is missing a name")
+	}
+	line := p.n
+
+	// Check for duplicate
+	if (p.lookupConstantName(name) != nil) {
+		return fmt.Errorf("reg '%s' is already defined as the name of a constant", name)
+	}
+	if (p.lookupVariableName(b, name) != nil) {
+		return fmt.Errorf("reg '%s' is already defined as a variable", name)
+	}
+	if (p.lookupRegisterName(b, name) != nil) {
+		return fmt.Errorf("reg '%s' is already defined", name)
+	}
+
+	// = %Rn.w
+	p.skipWhitespace()
+	if (p.peekChar() != '=') {
+		return fmt.Errorf("reg '%s' is missing a '='", name)
+	}
+	p.skip(1)
+	p.skipWhitespace()
+	if (p.peekChar() != '%') || ((p.peekAhead(1) != 'R') && (p.peekAhead(1) != 'r')) {
+		return fmt.Errorf("reg '%s' must be a register, e.g. %%R4.w", name)
+	}
+	p.skip(2)
+	n, err := p.nextValue()
+	if (err != nil) {
+		return fmt.Errorf("reg '%s' has an invalid register number (%s)", name, err)
+	}
+	size := p.parseOpWidth()
+	switch (size) {
+	case R08, R16, R24:
+	default:
+		return fmt.Errorf("reg '%s' can only be .b, .w, or .t", name)
+	}
+	address, err := p.registerAddress(n, registerBytes(size))
+	if (err != nil) {
+		return err
+	}
+	p.skipWhitespaceAndEOL()
+
+	// Store this register (either at the top level or local to a block)
+	r := new(rgstr)
+	if (b == nil) {
+		if p.reg == nil {
+			p.reg = r
+		} else if p.lastReg != nil {
+			p.lastReg.next = r
+		}
+		p.lastReg = r
+	} else {
+		if b.reg == nil {
+			b.reg = r
+		} else if b.lastReg != nil {
+			b.lastReg.next = r
+		}
+		b.lastReg = r
+	}
+	r.next = nil
+	r.name = name
+	r.nameLC = strings.ToLower(name)
+	r.n = n
+	r.address = address
+	r.size = size
+	r.line = line
+
+	// Declared in a SUB, so it is live there even if not (yet) used
+	if (b != nil) {
+		p.useRegisterName(r)
+	}
+
+	return nil
+}
+
+/*
+ *  Lookup a named register, in the block (and its parents) then the top level
+ */
+func (p *parser) lookupRegisterName(b *codeBlock, name string) *rgstr {
+	nameLC := strings.ToLower(name)
+	for (b != nil) {
+		for r := b.reg; r != nil; r = r.next {
+			if (r.nameLC == nameLC) {
+				return r
 			}
-			return nil
+		}
+		b = b.up
+	}
+	for r := p.reg; r != nil; r = r.next {
+		if (r.nameLC == nameLC) {
+			return r
 		}
 	}
 
-	return fmt.Errorf("invalid psedomnemonic %s", mnemonic)
+	return nil
 }
 
+/*
+ *  Remember that the named register is used in the current SUB
+ */
+func (p *parser) useRegisterName(r *rgstr) {
+	b := p.currentCode
+	for (b.up != nil) {
+		b = b.up
+	}
+	for _, used := range b.regsUsed {
+		if (used.r == r) {
+			return
+		}
+	}
+	b.regsUsed = append(b.regsUsed, rgstrUse{r, p.filename, p.line})
+}
+
+/*
+ *  Check that no two named registers used in the SUB share any bytes
+ *  (the error is at the first use of the second one)
+ */
+func (p *parser) checkRegisterOverlap(b *codeBlock) error {
+	for j, u1 := range b.regsUsed {
+		for _, u2 := range b.regsUsed[j+1:] {
+			r1, r2 := u1.r, u2.r
+			end1 := r1.address + registerBytes(r1.size)
+			end2 := r2.address + registerBytes(r2.size)
+			if (r1.address < end2) && (r2.address < end1) {
+				return &sourceError{u2.filename, u2.line, fmt.Errorf("REG %s (%%R%d.%s, line %d) and REG %s (%%R%d.%s, line %d) overlap, and are both used in %s",
+					r1.name, r1.n, widthSuffix(prefixToWidth(r1.size)), r1.line,
+					r2.name, r2.n, widthSuffix(prefixToWidth(r2.size)), r2.line, b.name)}
+			}
+		}
+	}
+
+	return nil
+}
 
 /*
  *  Add a blank instruction as a comment in the listing
@@ -333,6 +752,10 @@ func (p *parser) addInstructionComment(c string) {
 	}
 	p.currentCode.lastInstr = instr
 	instr.next = nil
+	instr.noopt = p.noopt
+	instr.line = p.line
+	instr.column = p.col
+	instr.filename = p.filename
 	instr.len = 0
 	instr.hasValue = true
 	instr.comment = new(comment)
@@ -354,6 +777,10 @@ func (p *parser) addRegisterInstruction(mmm string, addressMode int, size int, v
 	}
 	p.currentCode.lastInstr = instr
 	instr.next = nil
+	instr.noopt = p.noopt
+	instr.line = p.line
+	instr.column = p.col
+	instr.filename = p.filename
 
 	var o *opcode
 	instr.mnemonic, o, _ = lookupMnemonic(mmm, addressMode, size)
@@ -0,0 +1,199 @@
+package aCCembler
+
+import (
+	"fmt"
+	"strings"
+)
+
+// The branch with the opposite condition
+var invertedBranches = map[string]string {
+	"bcc": "bcs",
+	"bcs": "bcc",
+	"bne": "beq",
+	"beq": "bne",
+	"bpl": "bmi",
+	"bmi": "bpl",
+	"bge": "blt",
+	"blt": "bge",
+	"bvc": "bvs",
+	"bvs": "bvc",
+	"bbr0": "bbs0",
+	"bbs0": "bbr0",
+	"bbr1": "bbs1",
+	"bbs1": "bbr1",
+	"bbr2": "bbs2",
+	"bbs2": "bbr2",
+	"bbr3": "bbs3",
+	"bbs3": "bbr3",
+	"bbr4": "bbs4",
+	"bbs4": "bbr4",
+	"bbr5": "bbs5",
+	"bbs5": "bbr5",
+	"bbr6": "bbs6",
+	"bbs6": "bbr6",
+	"bbr7": "bbs7",
+	"bbs7": "bbr7",
+}
+
+
+/*
+ *  Pick the shortest form of every branch to a label in the block
+ *  (iterating until no branch changes size, as each change moves the code after it)
+ */
+func (p *parser) relaxBranches(b *codeBlock) error {
+	for pass := 0; ; pass++ {
+		changed, err := p.relaxCodeBlock(b)
+		if (err != nil) {
+			return err
+		}
+		if (!changed) {
+			return nil
+		}
+
+		// Recompute the address of every instruction
+		b.endAddr = relocateCodeBlock(b.instr, b.startAddr)
+
+		// Branches only ever grow, so this can't loop forever, but just in case...
+		if (pass > 1000) {
+			return fmt.Errorf("branches in '%s' never settled on a size", b.name)
+		}
+	}
+}
+
+/*
+ *  Grow any branch that can't reach its label
+ *  (returning whether any branch changed size)
+ */
+func (p *parser) relaxCodeBlock(b *codeBlock) (bool, error) {
+	changed := false
+
+	for i := b.instr; i != nil; i = i.next {
+		// Dive into sub-blocks
+		if (i.subBlock != nil) {
+			c, err := p.relaxCodeBlock(i.subBlock.block)
+			if (err != nil) {
+				return false, err
+			}
+			changed = changed || c
+			continue
+		}
+
+		// Only branches and jumps to a (not yet resolved) label
+		if (i.mnemonic == 0) || i.hasValue || (i.symbol == "") {
+			continue
+		}
+		if (i.addressMode != modeRelative) && (i.addressMode != modeAbsolute) && (i.addressMode != modeZeroPageRelative) {
+			continue
+		}
+		target, err := b.lookupInstructionLabel(i.symbol)
+		if (err != nil) {
+			continue // reported later by resolveCodeSymbols
+		}
+
+		// BBRn/BBSn only have an 8-bit distance, so BBxn -> BB!xn +3 JMP target
+		if (i.addressMode == modeZeroPageRelative) {
+			diff := target - (i.address + i.len)
+			if (diff < -128) || (diff > 127) {
+				jmp := newInstruction("jmp", modeAbsolute, addressToPrefix(target), 0, i.symbol, false)
+				p.changeInstruction(i, invertedBranches[mnemonics[i.mnemonic].name], modeZeroPageRelative, A16)
+				i.value = jmp.len
+				i.hasValue = true
+				i.symbol = ""
+				i.symbolLC = ""
+				b.insertInstructionAfter(i, jmp)
+				i = jmp
+				changed = true
+			}
+			continue
+		}
+
+		// A JMP to a label past $FFFF needs the 24-bit address
+		if (i.addressMode == modeAbsolute) {
+			if (mnemonics[i.mnemonic].name == "jmp") && (i.prefix == A16) && (addressToPrefix(target) == A24) {
+				p.changeInstruction(i, "jmp", modeAbsolute, A24)
+				changed = true
+			}
+			continue
+		}
+
+		diff := target - (i.address + i.len)
+		name := mnemonics[i.mnemonic].name
+		if (i.prefix == A16) && ((diff < -128) || (diff > 127)) && (p.cpu >= CPU_65C2402) {
+			// Bxx -> A24 Bxx (16-bit branch distance)
+			p.changeInstruction(i, name, modeRelative, A24)
+			changed = true
+		} else if ((i.prefix == A24) && ((diff < -32768) || (diff > 32767))) || ((i.prefix == A16) && ((diff < -128) || (diff > 127))) {
+			// Bxx -> B!xx +3 JMP target (or straight from an 8-bit distance without the 65C2402 prefix)
+			jmpSz := addressToPrefix(target)
+			if (name == "bra") {
+				p.changeInstruction(i, "jmp", modeAbsolute, jmpSz)
+			} else {
+				inverse, ok := invertedBranches[name]
+				if (!ok) {
+					return false, fmt.Errorf("%s target %s is %d bytes apart, too far for a 16-bit branch", name, i.symbol, diff)
+				}
+				jmp := newInstruction("jmp", modeAbsolute, jmpSz, 0, i.symbol, false)
+				p.changeInstruction(i, inverse, modeRelative, A16)
+				i.value = jmp.len
+				i.hasValue = true
+				i.symbol = ""
+				i.symbolLC = ""
+				b.insertInstructionAfter(i, jmp)
+				i = jmp
+			}
+			changed = true
+		}
+	}
+
+	return changed, nil
+}
+
+/*
+ *  Change the mnemonic and/or form of an instruction (keeping its place in the block)
+ */
+func (p *parser) changeInstruction(i *instruction, mmm string, addressMode int, size int) {
+	var o *opcode
+	i.mnemonic, o, _ = lookupMnemonic(mmm, addressMode, size)
+	i.prefix = o.size
+	i.opcode = o.opcode
+	i.addressMode = o.mode
+	i.len = o.len
+}
+
+/*
+ *  Create an instruction that isn't (yet) in any block
+ */
+func newInstruction(mmm string, addressMode int, size int, value int, symbol string, hasValue bool) *instruction {
+	instr := new(instruction)
+
+	var o *opcode
+	instr.mnemonic, o, _ = lookupMnemonic(mmm, addressMode, size)
+	instr.prefix = o.size
+	instr.opcode = o.opcode
+	instr.addressMode = o.mode
+	instr.len = o.len
+	instr.value = value
+	instr.symbol = symbol
+	instr.symbolLC = strings.ToLower(symbol)
+	instr.hasValue = hasValue
+
+	return instr
+}
+
+/*
+ *  Insert an instruction into the block after the specified one
+ */
+func (b *codeBlock) insertInstructionAfter(after *instruction, instr *instruction) {
+	instr.prev = after
+	instr.next = after.next
+	if (after.next != nil) {
+		after.next.prev = instr
+	} else {
+		b.lastInstr = instr
+	}
+	after.next = instr
+	instr.address = after.address + after.len
+	instr.line = after.line
+	instr.column = after.column
+	instr.filename = after.filename
+}
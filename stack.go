@@ -0,0 +1,334 @@
+package aCCembler
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// The stack usage of a SUB, ISR, NMI, or THREAD (not counting its own return address)
+type stackUse struct {
+	own			int				// the most bytes it pushes itself
+	calls		[]stackCall		// the JSRs (and JMPs to another SUB)
+	worst		int				// the most bytes, including what it calls (-1 when recursive)
+	state		int				// STACK_UNSEEN, STACK_VISITING, or STACK_DONE
+	recursion	string			// the calls that loop back, e.g. "a -> b -> a"
+	loop		[]*codeBlock	// the SUBs that JMP back to this one with nothing on the stack
+}
+type stackCall struct {
+	depth		int				// the bytes on the stack at the call
+	ret			int				//   plus the return address (0 for a JMP)
+	callee		*codeBlock		// the SUB (nil when the address isn't a SUB)
+	address		int
+	i			*instruction	// the JSR or JMP
+}
+
+// A block on the call graph walk, and the bytes its call to the next block adds
+type stackStep struct {
+	b			*codeBlock
+	grow		int
+}
+
+// Progress of the call graph walk
+const (
+	STACK_UNSEEN = iota
+	STACK_VISITING
+	STACK_DONE
+)
+
+
+/*
+ *  The bytes an instruction pushes (negative when it pulls)
+ */
+func stackBytes(i *instruction) int {
+	switch (mnemonics[i.mnemonic].name) {
+	case "pha", "phx", "phy":
+		return prefixToWidth(i.prefix) / 8
+	case "pla", "plx", "ply":
+		return -prefixToWidth(i.prefix) / 8
+	case "php":
+		return 1
+	case "plp":
+		return -1
+	}
+	return 0
+}
+
+/*
+ *  The bytes of the return address pushed by a JSR (or pulled by an RTS)
+ */
+func returnBytes(i *instruction) int {
+	if (i.prefix & A48 == A24) {
+		return 3
+	}
+	return 2
+}
+
+/*
+ *  Follow the stack through the block, warning when the paths that meet have different
+ *  depths, or when it returns with bytes still on the stack (or more pulled than pushed)
+ */
+func (p *parser) blockStackUse(b *codeBlock) *stackUse {
+	items := flattenCodeBlock(b, nil)
+	n := len(items)
+	su := new(stackUse)
+	if (n == 0) {
+		return su
+	}
+	index := make(map[int]int)
+	for k := n-1; k >= 0; k-- {
+		index[items[k].i.address] = k
+	}
+
+	// The depth before each instruction (each is followed once, from the first path to reach it)
+	reached := make([]bool, n)
+	depth := make([]int, n)
+	warned := make(map[int]bool)
+	reached[0] = true
+	work := []int{0}
+	reach := func(from *instruction, k int, d int) {
+		if (k < 0) || (k >= n) {
+			return
+		} else if (!reached[k]) {
+			reached[k] = true
+			depth[k] = d
+			work = append(work, k)
+		} else if (depth[k] != d) && (!warned[k]) {
+			warned[k] = true
+			p.warning(WARN_STACK, from.line, fmt.Sprintf("%s %s has %d bytes on the stack on one path, but %d on another path to the same place",
+				strings.ToUpper(blockKindStr(b.kind)), b.name, depth[k], d))
+		}
+	}
+	target := func(address int) int {
+		if k, found := index[address]; found {
+			return k
+		}
+		return -1
+	}
+
+	for len(work) > 0 {
+		k := work[len(work)-1]
+		work = work[:len(work)-1]
+		i := items[k].i
+		d := depth[k]
+		if (i.mnemonic == 0) {
+			reach(i, k+1, d)
+			continue
+		}
+
+		name := mnemonics[i.mnemonic].name
+		out := d + stackBytes(i)
+		if (out > su.own) {
+			su.own = out
+		}
+		if (out < 0) && (!warned[-1-k]) {
+			warned[-1-k] = true
+			p.warning(WARN_STACK, i.line, fmt.Sprintf("%s pulls %d bytes more than %s %s pushed", strings.ToUpper(name), -out, strings.ToUpper(blockKindStr(b.kind)), b.name))
+		}
+
+		switch {
+		case (i.addressMode == modeRelative) || (i.addressMode == modeZeroPageRelative):
+			reach(i, target(i.address + i.len + i.value), out)
+			if (name != "bra") {
+				reach(i, k+1, out)
+			}
+		case (name == "jsr"):
+			c := stackCall{out, returnBytes(i), nil, i.value, i}
+			if (i.addressMode == modeAbsolute) {
+				c.callee = p.lookupSubroutineAt(i.value)
+			}
+			su.calls = append(su.calls, c)
+			reach(i, k+1, out)
+		case (name == "jmp") && (i.addressMode == modeAbsolute):
+			if t := target(i.value); (t >= 0) {
+				reach(i, t, out)
+			} else if callee := p.lookupSubroutineAt(i.value); (callee != nil) {
+				su.calls = append(su.calls, stackCall{out, 0, callee, i.value, i})
+			}
+		case (name == "rts"), (name == "rti"):
+			if (out != 0) && (!warned[k]) {
+				warned[k] = true
+				if (out > 0) {
+					p.warning(WARN_STACK, i.line, fmt.Sprintf("%s %s returns with %d bytes it pushed still on the stack", strings.ToUpper(blockKindStr(b.kind)), b.name, out))
+				} else {
+					p.warning(WARN_STACK, i.line, fmt.Sprintf("%s %s returns after pulling %d bytes more than it pushed", strings.ToUpper(blockKindStr(b.kind)), b.name, -out))
+				}
+			}
+		case (name == "jmp"), (name == "brk"), (name == "stp"), (name == "thr"):
+		default:
+			reach(i, k+1, out)
+		}
+	}
+
+	return su
+}
+
+/*
+ *  The most bytes of stack the block uses, including what it calls (-1 when it recurses)
+ *  (SUBs that only JMP to each other, with nothing on the stack, aren't recursive)
+ */
+func (p *parser) worstStack(b *codeBlock, uses map[*codeBlock]*stackUse, path []stackStep) int {
+	su := uses[b]
+	switch (su.state) {
+	case STACK_DONE:
+		return su.worst
+	case STACK_VISITING:
+		// Recursion, from where b was first called back to b
+		loop := path
+		for k := range path {
+			if (path[k].b == b) {
+				loop = path[k:]
+				break
+			}
+		}
+		grow := 0
+		names := []string{}
+		for _, s := range loop {
+			grow += s.grow
+			names = append(names, s.b.name)
+		}
+		if (grow == 0) {
+			// Only JMPs back to b, so b's stack covers the loop (once b is done)
+			for _, s := range loop[1:] {
+				su.loop = append(su.loop, s.b)
+			}
+			return 0
+		}
+		names = append(names, b.name)
+		for _, s := range loop {
+			if (uses[s.b].recursion == "") {
+				uses[s.b].recursion = strings.Join(names, " -> ")
+			}
+		}
+		return -1
+	}
+
+	su.state = STACK_VISITING
+	su.worst = su.own
+	path = append(path, stackStep{b, 0})
+	for _, c := range su.calls {
+		called := 0
+		if (c.callee != nil) {
+			path[len(path)-1].grow = c.depth + c.ret
+			called = p.worstStack(c.callee, uses, path)
+			if (called < 0) && (uses[c.callee].state == STACK_VISITING) {
+				p.warning(WARN_RECURSION, c.i.line, fmt.Sprintf("%s %s is recursive (%s), so its stack use is unbounded",
+					strings.ToUpper(blockKindStr(c.callee.kind)), c.callee.name, uses[c.callee].recursion))
+			}
+		}
+		if (called < 0) {
+			su.worst = -1
+		} else if (su.worst >= 0) && (c.depth + c.ret + called > su.worst) {
+			su.worst = c.depth + c.ret + called
+		}
+	}
+	if (su.recursion != "") {
+		su.worst = -1
+	}
+	su.state = STACK_DONE
+
+	// The SUBs that JMP back here reach everything this one does
+	for _, c := range su.loop {
+		if (uses[c].worst >= 0) && ((su.worst < 0) || (su.worst > uses[c].worst)) {
+			uses[c].worst = su.worst
+		}
+	}
+
+	return su.worst
+}
+
+/*
+ *  Explain the stack bytes in a string
+ */
+func stackStr(bytes int) string {
+	if (bytes < 0) {
+		return "unbounded (recursive)"
+	}
+	return fmt.Sprintf("%d bytes", bytes)
+}
+
+/*
+ *  List the call graph and the most stack each SUB, ISR, NMI, and THREAD uses
+ *  (with each entry point, i.e. anything not called, and each ISR and NMI on top of the deepest one)
+ */
+func (p *parser) outputCallGraph(listing *os.File) {
+	uses := make(map[*codeBlock]*stackUse)
+	for b := p.code; b != nil; b = b.next {
+		uses[b] = p.blockStackUse(b)
+	}
+	called := make(map[*codeBlock]bool)
+	for b := p.code; b != nil; b = b.next {
+		p.worstStack(b, uses, nil)
+		for _, c := range uses[b].calls {
+			if (c.callee != nil) && (c.callee != b) {
+				called[c.callee] = true
+			}
+		}
+	}
+
+	listing.WriteString("\n; CALL GRAPH and STACK (the most bytes each one pushes, including the JSRs it makes)\n")
+	for b := p.code; b != nil; b = b.next {
+		su := uses[b]
+		line := fmt.Sprintf(";   %-6s %-20s %s", strings.ToUpper(blockKindStr(b.kind)), b.name, stackStr(su.worst))
+		calls := []string{}
+		jumps := []string{}
+		seen := make(map[string]bool)
+		for _, c := range su.calls {
+			name := fmt.Sprintf("$%04x", c.address)
+			if (c.callee != nil) {
+				name = c.callee.name
+			}
+			if (c.ret == 0) && (!seen["jmp " + name]) {
+				seen["jmp " + name] = true
+				jumps = append(jumps, name)
+			} else if (c.ret > 0) && (!seen[name]) {
+				seen[name] = true
+				calls = append(calls, name)
+			}
+		}
+		if (len(calls) > 0) {
+			line += " -- calls " + strings.Join(calls, ", ")
+		}
+		if (len(jumps) > 0) {
+			line += " -- jumps to " + strings.Join(jumps, ", ")
+		}
+		if (su.recursion != "") {
+			line += " -- RECURSION " + su.recursion
+		}
+		listing.WriteString(line + "\n")
+	}
+
+	// The deepest entry point that isn't recursive, which an interrupt can land on top of
+	deepest := 0
+	var deepestBlock *codeBlock
+	for b := p.code; b != nil; b = b.next {
+		if (b.kind == BLK_SUB) && (!called[b]) {
+			worst := uses[b].worst
+			listing.WriteString(fmt.Sprintf("; ENTRY  %-20s %s\n", b.name, stackStr(worst)))
+			if (worst >= 0) && ((deepestBlock == nil) || (worst > deepest)) {
+				deepest = worst
+				deepestBlock = b
+			}
+		}
+	}
+	for b := p.code; b != nil; b = b.next {
+		if (b.kind == BLK_ISR) || (b.kind == BLK_NMI) {
+			// The CPU pushes the return address (24-bits on the 65C2402 and 65C24T8) and the flags
+			interrupt := 3
+			if (p.cpu >= CPU_65C2402) {
+				interrupt = 4
+			}
+			worst := uses[b].worst
+			line := fmt.Sprintf("; %-6s %-20s %s + %d for the interrupt", strings.ToUpper(blockKindStr(b.kind)), b.name, stackStr(worst), interrupt)
+			if (deepestBlock != nil) && (worst >= 0) {
+				line += fmt.Sprintf(", %d bytes on top of %s", deepest + interrupt + worst, deepestBlock.name)
+			}
+			listing.WriteString(line + "\n")
+		}
+	}
+	for b := p.code; b != nil; b = b.next {
+		if (b.kind == BLK_THREAD) {
+			listing.WriteString(fmt.Sprintf("; THREAD %-20s %s of its own stack page\n", b.name, stackStr(uses[b].worst)))
+		}
+	}
+}
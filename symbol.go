@@ -2,39 +2,76 @@ package aCCembler
 
 import (
 	"fmt"
+	"os"
     "strings"
 )
 
 
 /*
- *  Lookup constant value
+ *  Lookup constant value (plus any +val or -val suffix), and whether the constant is defined
+ *  (the error is for an invalid suffix)
  */
-func (p *parser) lookupConstant(name string) (int, error) {
+func (p *parser) lookupConstant(name string) (int, bool, error) {
+	c := p.lookupConstantName(name)
+	if (c == nil) {
+		return 0, false, nil
+	}
+
+	offset, err := p.plusOrMinus()
+	if (err != nil) {
+		return 0, true, err
+	}
+	return c.value + offset, true, nil
+}
+
+/*
+ *  Lookup constant by name (without any +val or -val suffix)
+ */
+func (p *parser) lookupConstantName(name string) *cnst {
 	// Case insensitive
 	nameLC := strings.ToLower(name)
 
 	// Iterate through all the constants
 	for c := p.cnst; c != nil; c = c.next {
 		if (c.nameLC == nameLC) {
-			return c.value + p.plusOrMinus(), nil
+			c.used = true
+			return c
 		}
 	}
 
 	// Not found
-	return 0, fmt.Errorf("const '%s' not defined", name)
+	return nil
+}
+
+/*
+ *  Lookup variable address (plus any +val or -val suffix) and size, and whether the variable is defined
+ *  (the error is for an invalid suffix)
+ */
+func (p *parser) lookupVariable(b *codeBlock, name string) (int, int, bool, error) {
+	v := p.lookupVariableName(b, name)
+	if (v == nil) {
+		return 0, 0, false, nil
+	}
+
+	offset, err := p.plusOrMinus()
+	if (err != nil) {
+		return 0, 0, true, err
+	}
+	return v.address + offset, v.size, true, nil
 }
 
 /*
- *  Lookup variable address
+ *  Lookup variable by name, global or in the block (or its parents)
  */
-func (p *parser) lookupVariable(b *codeBlock, name string) (int, int, error) {
+func (p *parser) lookupVariableName(b *codeBlock, name string) *vrbl {
 	// Case insensitive
 	nameLC := strings.ToLower(name)
 
 	// Iterate through all the global variables
 	for v := p.global; v != nil; v = v.next {
 		if (v.nameLC == nameLC) {
-			return v.address + p.plusOrMinus(), v.size, nil
+			v.used = true
+			return v
 		}
 	}
 
@@ -42,8 +79,7 @@ func (p *parser) lookupVariable(b *codeBlock, name string) (int, int, error) {
 	for (b != nil) {
 		for v := b.vrbl; v != nil; v = v.next {
 			if (v.nameLC == nameLC) {
-				v.address += p.plusOrMinus()
-				return v.address, v.size, nil
+				return v
 			}
 		}
 
@@ -51,7 +87,29 @@ func (p *parser) lookupVariable(b *codeBlock, name string) (int, int, error) {
 	}
 
 	// Not found
-	return 0, 0, fmt.Errorf("variable '%s' not defined", name)
+	return nil
+}
+
+/*
+ *  Is the address in a global variable, or a variable in the block (or its parents)
+ */
+func (p *parser) isVariableAddress(b *codeBlock, address int) bool {
+	for v := p.global; v != nil; v = v.next {
+		if (address >= v.address) && (address < v.address + registerBytes(v.size)) {
+			return true
+		}
+	}
+	for (b != nil) {
+		for v := b.vrbl; v != nil; v = v.next {
+			if (address >= v.address) && (address < v.address + registerBytes(v.size)) {
+				return true
+			}
+		}
+
+		b = b.up
+	}
+
+	return false
 }
 
 /*
@@ -96,20 +154,63 @@ func (b *codeBlock) lookupInstructionLabel(symbol string) (int, error) {
 }
 
 /*
- *  Lookup symbol value as a data block name
+ *  Lookup symbol value as a data block name or the label of an entry in a data block
  */
-func (p *parser) lookupDataName(name string) *dataBlock {
+func (p *parser) lookupDataName(name string) (int, error) {
 	// Case insensitive
 	nameLC := strings.ToLower(name)
 
 	// Try all the data blocks
 	for d := p.data; d != nil; d = d.next {
 		if d.nameLC == nameLC {
-			return d
+			return d.startAddr, nil
+		}
+
+		// and all the labels in the block
+		for e := d.data; e != nil; e = e.next {
+			if (e.size == DLABEL) && (strings.ToLower(e.label) == nameLC) {
+				return e.address, nil
+			}
 		}
 	}
 
 	// Not found
-	return nil
+	return 0, fmt.Errorf("data '%s' not defined", name)
 }
 
+/*
+ *  Write every top-level symbol, one per line as the address, the kind, and the name
+ *  e.g. 001000 SUB main, or 001200 THREAD blink 1 STACK 000700
+ */
+func (p *parser) outputSymbols(symbols *os.File) {
+	symbols.WriteString(fmt.Sprintf("; aCCembler symbols for %s\n", p.filename))
+	for c := p.cnst; c != nil; c = c.next {
+		symbols.WriteString(fmt.Sprintf("%06x CONST %s\n", c.value, c.name))
+	}
+	for v := p.global; v != nil; v = v.next {
+		symbols.WriteString(fmt.Sprintf("%06x GLOBAL %s%s\n", v.address, v.name, sizeToSuffix(v.size)))
+	}
+	for r := p.reg; r != nil; r = r.next {
+		symbols.WriteString(fmt.Sprintf("%06x REG %s.%s\n", r.address, r.name, widthSuffix(prefixToWidth(r.size))))
+	}
+	for b := p.code; b != nil; b = b.next {
+		if (b.kind == BLK_THREAD) {
+			symbols.WriteString(fmt.Sprintf("%06x THREAD %s %d STACK %06x\n", b.startAddr, b.name, b.thread, b.stack))
+		} else {
+			symbols.WriteString(fmt.Sprintf("%06x %s %s\n", b.startAddr, strings.ToUpper(blockKindStr(b.kind)), b.name))
+		}
+		for i := b.instr; i != nil; i = i.next {
+			if (i.mnemonic == 0) && (i.symbol != "") {
+				symbols.WriteString(fmt.Sprintf("%06x LABEL %s\n", i.address, i.symbol))
+			}
+		}
+	}
+	for d := p.data; d != nil; d = d.next {
+		symbols.WriteString(fmt.Sprintf("%06x DATA %s\n", d.startAddr, d.name))
+		for e := d.data; e != nil; e = e.next {
+			if (e.size == DLABEL) {
+				symbols.WriteString(fmt.Sprintf("%06x LABEL %s\n", e.address, e.label))
+			}
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package aCCembler
+
+import (
+	"fmt"
+)
+
+// How a string in a DATA block is stored
+const (
+	STR_HIGH = 1 << iota	// h - high-bit ASCII, i.e. Apple II normal text
+	STR_INVERSE				// i - Apple II inverse text
+	STR_FLASH				// f - Apple II flashing text
+	STR_PASCAL				// p - length byte first, no terminator
+	STR_LAST_HIGH			// d - last character has its high bit flipped, no terminator
+	STR_NO_TERM				// n - no terminator
+)
+
+
+/*
+ *  Parse a quoted string, e.g. "Hello\n" (with the index on the opening quote)
+ *  (returning the string with the escape sequences replaced)
+ */
+func (p *parser) nextQuotedString() (string, error) {
+	if (p.peekChar() != '"') {
+		return "", fmt.Errorf("was expecting a quoted string")
+	}
+	p.skip(1)
+
+	var str []uint8
+	for p.i < p.end {
+		c := p.nextChar()
+		switch (c) {
+		case '"':
+			return string(str), nil
+		case '\n':
+			return "", fmt.Errorf("missing the closing quote")
+		case '\\':
+			e := p.nextChar()
+			switch (e) {
+			case '"', '\'', '\\':
+				str = append(str, e)
+			case 'n':
+				str = append(str, '\n')
+			case 'r':
+				str = append(str, '\r')
+			case 't':
+				str = append(str, '\t')
+			case '0':
+				str = append(str, 0)
+			case 'x':
+				hi, ok1 := hexDigit(p.nextChar())
+				lo, ok2 := hexDigit(p.nextChar())
+				if (!ok1) || (!ok2) {
+					return "", fmt.Errorf("\\x must be followed by two hexadecimal digits")
+				}
+				str = append(str, uint8(hi << 4 | lo))
+			default:
+				return "", fmt.Errorf("'\\%c' is not a valid escape sequence", e)
+			}
+		default:
+			str = append(str, c)
+		}
+	}
+
+	return "", fmt.Errorf("missing the closing quote")
+}
+
+/*
+ *  Parse the letters right after the closing quote, e.g. "HELLO"hd
+ */
+func (p *parser) parseStringModifiers() (int, error) {
+	mods := 0
+	for p.i < p.end {
+		var m int
+		switch (p.peekChar()) {
+		case 'h', 'H': m = STR_HIGH
+		case 'i', 'I': m = STR_INVERSE
+		case 'f', 'F': m = STR_FLASH
+		case 'p', 'P': m = STR_PASCAL
+		case 'd', 'D': m = STR_LAST_HIGH
+		case 'n', 'N': m = STR_NO_TERM
+		default:
+			c := p.peekChar()
+			if ((c >= 'A') && (c <= 'Z')) || ((c >= 'a') && (c <= 'z')) || ((c >= '0') && (c <= '9')) {
+				return 0, fmt.Errorf("'%c' is not a valid string modifier (h, i, f, p, d, or n)", p.peekChar())
+			}
+			return mods, nil
+		}
+		if (mods & m != 0) {
+			return 0, fmt.Errorf("the string modifier '%c' is repeated", p.peekChar())
+		}
+		mods |= m
+		p.skip(1)
+	}
+
+	return mods, nil
+}
+
+/*
+ *  Encode the string into the bytes to output (including any length or terminator)
+ */
+func encodeString(str string, mods int) (string, error) {
+	// Only one of each kind
+	if (bitCount(mods & (STR_HIGH|STR_INVERSE|STR_FLASH)) > 1) {
+		return "", fmt.Errorf("a string can only be one of high-bit (h), inverse (i), or flash (f)")
+	}
+	if (bitCount(mods & (STR_PASCAL|STR_LAST_HIGH|STR_NO_TERM)) > 1) {
+		return "", fmt.Errorf("a string can only be one of Pascal (p), last-high (d), or no terminator (n)")
+	}
+
+	bytes := []uint8(str)
+	for k, c := range bytes {
+		switch {
+		case (mods & STR_HIGH != 0):
+			bytes[k] = c | 0x80
+		case (mods & STR_INVERSE != 0), (mods & STR_FLASH != 0):
+			// Apple II inverse is $00-$3F and flash is $40-$7F (uppercase only)
+			if (c >= 'a') && (c <= 'z') {
+				c -= 'a' - 'A'
+			}
+			if (c < 0x20) || (c > 0x5F) {
+				return "", fmt.Errorf("'%c' can't be shown as inverse or flashing text", c)
+			}
+			c &= 0x3F
+			if (mods & STR_FLASH != 0) {
+				c |= 0x40
+			}
+			bytes[k] = c
+		}
+	}
+
+	switch {
+	case (mods & STR_PASCAL != 0):
+		if (len(bytes) > 0x0FF) {
+			return "", fmt.Errorf("a Pascal string can't be longer than 255 characters")
+		}
+		bytes = append([]uint8{uint8(len(bytes))}, bytes...)
+	case (mods & STR_LAST_HIGH != 0):
+		if (len(bytes) == 0) {
+			return "", fmt.Errorf("an empty string can't have its last character marked")
+		}
+		bytes[len(bytes)-1] ^= 0x80
+	case (mods & STR_NO_TERM != 0):
+		// nothing to add
+	default:
+		bytes = append(bytes, 0)
+	}
+
+	return string(bytes), nil
+}
+
+/*
+ *  The value of a hexadecimal digit
+ */
+func hexDigit(c uint8) (int, bool) {
+	switch {
+	case (c >= '0') && (c <= '9'):
+		return int(c - '0'), true
+	case (c >= 'A') && (c <= 'F'):
+		return int(c - 'A' + 10), true
+	case (c >= 'a') && (c <= 'f'):
+		return int(c - 'a' + 10), true
+	}
+
+	return 0, false
+}
+
+/*
+ *  How many bits are set
+ */
+func bitCount(v int) int {
+	count := 0
+	for ; v != 0; v &= v - 1 {
+		count += 1
+	}
+
+	return count
+}
@@ -0,0 +1,190 @@
+package aCCembler
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// The 65C24T8 has 8 hardware threads, and thread 0 runs the main program (with the stack in page $01)
+const THREAD_COUNT = 8
+const THREAD_MAIN_STACK = 0x0100
+
+// Each SPAWN, to fill in once the THREAD is known
+type spawn struct {
+	name		string			// name of the THREAD
+	line		int				// line of the SPAWN
+	id			*instruction	// LDA #id
+	stack		*instruction	// LDA #stack
+}
+
+
+/*
+ *  Parse the stack of a THREAD, e.g. THREAD blink @$1200 STACK @$0700 { ... }
+ *  (and allocate the next thread ID)
+ */
+func (p *parser) parseThreadStack(b *codeBlock, label string) error {
+	err := p.requireCPU(CPU_65C24T8, "THREAD")
+	if (err != nil) {
+		return err
+	}
+	if (strings.ToLower(p.nextAZ_az_09()) != "stack") {
+		return fmt.Errorf("THREAD %s is missing its STACK @address", label)
+	}
+	p.skipWhitespace()
+	if (p.peekChar() != '@') {
+		return fmt.Errorf("THREAD %s STACK is missing the '@' before the address", label)
+	}
+	p.skip(1)
+	stack, err := p.nextValue()
+	if (err != nil) {
+		return fmt.Errorf("THREAD %s STACK does not specify an address value", label)
+	}
+	p.skipWhitespace()
+
+	// One page per thread
+	if (stack & 0xFF != 0) {
+		return fmt.Errorf("THREAD %s STACK @$%x must be the start of a page, e.g. @$%x", label, stack, stack & ^0xFF)
+	}
+	if (stack == THREAD_MAIN_STACK) {
+		return fmt.Errorf("THREAD %s can't use the stack page $%04x of the main program", label, stack)
+	}
+	for t := p.code; t != nil; t = t.next {
+		if (t.kind == BLK_THREAD) && (t.stack == stack) {
+			return fmt.Errorf("THREAD %s STACK @$%04x is already the stack of THREAD %s", label, stack, t.name)
+		}
+	}
+
+	// The thread IDs are handed out in order, after the main program's 0
+	p.threadCount += 1
+	if (p.threadCount >= THREAD_COUNT) {
+		return fmt.Errorf("THREAD %s is one too many, as the 65C24T8 only has %d threads (including the main program)", label, THREAD_COUNT)
+	}
+	b.thread = p.threadCount
+	b.stack = stack
+
+	return nil
+}
+
+/*
+ *  Does the THREAD already end with RTS, RTI, JMP, or THR (so it can't run off the end of its block)?
+ */
+func (b *codeBlock) endsThread() bool {
+	i := b.lastInstr
+	for (i != nil) && (i.mnemonic == 0) && (i.symbol == "") && (i.subBlock == nil) {
+		i = i.prev		// skip over comments
+	}
+	if (i == nil) || (i.mnemonic == 0) {
+		return false
+	}
+
+	switch (mnemonics[i.mnemonic].name) {
+	case "rts", "rti", "jmp", "thr":
+		return true
+	}
+	return false
+}
+
+/*
+ *  Parse the 'spawn' keyword, e.g. SPAWN blink
+ *  (LDA #id, TAT, LDA #stack, TTS, THI blink)
+ */
+func (p *parser) parseSpawn(token string) error {
+	err := p.requireCPU(CPU_65C24T8, "SPAWN")
+	if (err != nil) {
+		return err
+	}
+	p.skipWhitespace()
+	name := p.nextAZ_az_09()
+	if (name == "") {
+		return fmt.Errorf("SPAWN is missing the name of a THREAD")
+	}
+
+	// The stack is as wide as the block's addresses, unless the THREAD is already known
+	stackSz := R16
+	if (p.abWidth == A24) {
+		stackSz = R24
+	}
+	if t := p.lookupSubroutineName(name); (t != nil) && (t.kind == BLK_THREAD) {
+		stackSz = R16
+		if ((t.stack | 0xFF) > 0xFFFF) {
+			stackSz = R24
+		}
+	}
+
+	// Select the thread, point its stack at the top of its page, then start it
+	// (the thread ID and stack are filled in once every THREAD is parsed)
+	s := new(spawn)
+	s.name = name
+	s.line = p.line
+	p.addInstructionComment(fmt.Sprintf("SPAWN %s", name))
+	s.id = p.addExprInstructionWithSymbol("lda", modeImmediate, R08, 0, name, false)
+	p.addExprInstruction("tat", modeImplicit, R08, 0)
+	s.stack = p.addExprInstructionWithSymbol("lda", modeImmediate, stackSz, 0, name, false)
+	p.addExprInstruction("tts", modeImplicit, stackSz, 0)
+	p.addExprInstructionWithSymbol("thi", modeAbsolute, p.abWidth, 0, name, false)
+	p.spawns = append(p.spawns, s)
+
+	return nil
+}
+
+/*
+ *  Fill in the thread ID and stack of each SPAWN
+ */
+func (p *parser) resolveSpawns() error {
+	for _, s := range p.spawns {
+		t := p.lookupSubroutineName(s.name)
+		if (t == nil) {
+			return fmt.Errorf("SPAWN %s [line %d] -- there is no THREAD '%s'", s.name, s.line, s.name)
+		} else if (t.kind != BLK_THREAD) {
+			return fmt.Errorf("SPAWN %s [line %d] -- '%s' is a %s, not a THREAD", s.name, s.line, s.name, strings.ToUpper(blockKindStr(t.kind)))
+		}
+
+		top := t.stack | 0xFF
+		if (s.stack.prefix & R32 == R16) && (top > 0xFFFF) {
+			return fmt.Errorf("SPAWN %s [line %d] -- the stack @$%06x of THREAD %s needs 24-bits, so define the THREAD before this SPAWN", s.name, s.line, t.stack, s.name)
+		}
+		s.id.value = t.thread
+		s.id.hasValue = true
+		s.stack.value = top
+		s.stack.hasValue = true
+	}
+
+	return nil
+}
+
+/*
+ *  Parse the 'yield' keyword
+ */
+func (p *parser) parseYield(token string) error {
+	err := p.requireCPU(CPU_65C24T8, "YIELD")
+	if (err != nil) {
+		return err
+	}
+	p.addExprInstruction("thy", modeImplicit, A16, 0)
+	return nil
+}
+
+/*
+ *  Parse the 'wait' keyword
+ */
+func (p *parser) parseWait(token string) error {
+	err := p.requireCPU(CPU_65C24T8, "WAIT")
+	if (err != nil) {
+		return err
+	}
+	p.addExprInstruction("thw", modeImplicit, A16, 0)
+	return nil
+}
+
+/*
+ *  List which thread owns which stack page
+ */
+func (p *parser) outputThreads(listing *os.File) {
+	for t := p.code; t != nil; t = t.next {
+		if (t.kind == BLK_THREAD) {
+			line := fmt.Sprintf("%06x-%06x   ; STACK of THREAD %s (thread %d)\n", t.stack, t.stack | 0xFF, t.name, t.thread)
+			listing.WriteString(line)
+		}
+	}
+}
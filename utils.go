@@ -239,50 +239,128 @@ func (p *parser) nextAZ_az_09() string {
 }
 
 /*
- *  Return the next number (w/ or w/out a $ or 0x prefix)
- *  (returning the string and index)
+ *  Return the next number, e.g. 123 or -5 or $FF or 0xFF or %0101 or 'A' or 'A'h or 1_000_000
+ *  (returning the value or an error if there isn't a valid number)
  */
 func (p *parser) nextValue() (int, error) {
 	// skip past whitespace
 	p.skipWhitespace()
+	start := p.i
+
+	// Negative?
+	negative := false
+	if (p.peekChar() == '-') {
+		negative = true
+		p.skip(1)
+	}
 
-	// Hexidecimal or decimal?
-	if p.b[p.i] == '$' {
+	// Hexidecimal, binary, character, or decimal?
+	var value int
+	var err error
+	sym := p.peekChar()
+	sym1 := p.peekAhead(1)
+	if (sym == '$') {
 		p.skip(1)
-		return p.nextHexidecimal(), nil
-	} else if (p.i+1 < p.end) && (p.b[p.i] == '0') && (p.b[p.i+1] == 'x') {
+		value, err = p.nextDigits(16)
+	} else if (sym == '0') && ((sym1 == 'x') || (sym1 == 'X')) {
 		p.skip(2)
-		return p.nextHexidecimal(), nil
+		value, err = p.nextDigits(16)
+	} else if (sym == '%') && ((sym1 == '0') || (sym1 == '1')) {
+		p.skip(1)
+		value, err = p.nextDigits(2)
+	} else if (sym == '\'') {
+		value, err = p.nextCharLiteral()
+	} else if (sym >= '0') && (sym <= '9') {
+		value, err = p.nextDigits(10)
+	} else if (sym == 0) || (sym == CR) || (sym == LF) {
+		return 0, errors.New("the expected value is missing")
 	} else {
-		return p.nextDecimal(), nil
+		return 0, fmt.Errorf("the expected value is not a number, found '%c' (column %d)", sym, p.column(p.i))
+	}
+	if (err != nil) {
+		return 0, err
 	}
 
-	return 0, errors.New("the expected value is not a number")
+	// Nothing above 24-bits
+	if (value > 0x0FFFFFF) {
+		return 0, fmt.Errorf("the value '%s' is bigger than 24-bits (column %d)", string(p.b[start:p.i]), p.column(start))
+	}
+	if (negative) {
+		value = -value
+	}
+
+	return value, nil
 }
 
 /*
- *  Parse the next 0-9A-Fa-f characdters as a hexideimal value
- *  (returning the value and index)
+ *  Parse the digits of a number in the base, allowing _ between digits, e.g. 1_000_000
+ *  (returning an error if there are no digits, or a letter or digit that isn't in the base)
  */
-func (p *parser) nextHexidecimal() int {
-	// find the next non AZ09 character
+func (p *parser) nextDigits(base int) (int, error) {
+	start := p.i
 	value := 0
-	for p.i < p.end {
-		if (p.b[p.i] >= '0') && (p.b[p.i] <= '9') {
-			value = (value * 16) + int(p.b[p.i] - '0')
-			p.i += 1
-		} else if (p.b[p.i] >= 'A') && (p.b[p.i] <= 'F') {
-			value = (value * 16) + int(p.b[p.i] - 'A' + 10)
-			p.i += 1
-		} else if (p.b[p.i] >= 'a') && (p.b[p.i] <= 'f') {
-			value = (value * 16) + int(p.b[p.i] - 'a' + 10)
+	digits := 0
+	for p.i <= p.end {
+		c := p.b[p.i]
+		d, ok := hexDigit(c)
+		if (c == '_') && (digits > 0) {
 			p.i += 1
-		} else {
+			continue
+		} else if (!ok) || (d >= base) {
+			// A letter or digit right after the number isn't part of any valid syntax
+			if ((c >= '0') && (c <= '9')) || ((c >= 'A') && (c <= 'Z')) || ((c >= 'a') && (c <= 'z')) || (c == '_') {
+				return 0, fmt.Errorf("'%c' is not a valid digit in '%s' (column %d)", c, string(p.b[start:p.i+1]), p.column(p.i))
+			}
 			break
 		}
+
+		value = (value * base) + d
+		if (value > 0x0FFFFFFF) {
+			value = 0x0FFFFFFF // big enough to be reported as too big, without overflowing
+		}
+		digits += 1
+		p.i += 1
+	}
+	if (digits == 0) {
+		return 0, fmt.Errorf("missing the digits of the number (column %d)", p.column(start))
 	}
 
-	return value
+	return value, nil
+}
+
+/*
+ *  Parse a character, e.g. 'A' or 'A'h for the high-bit ASCII (with the index on the opening quote)
+ */
+func (p *parser) nextCharLiteral() (int, error) {
+	p.skip(1)
+	c := p.nextChar()
+	if (c == '\\') {
+		c = p.nextChar()
+	}
+	if (p.peekChar() != '\'') {
+		return 0, fmt.Errorf("no matching single quote after '%c'", c)
+	}
+	p.skip(1)
+
+	value := int(c)
+	if (p.peekChar() == 'h') || (p.peekChar() == 'H') {
+		p.skip(1)
+		value |= 0x80
+	}
+
+	return value, nil
+}
+
+/*
+ *  The column (starting at 1) of an index in the file
+ */
+func (p *parser) column(index int) int {
+	j := index
+	for (j > 0) && (p.b[j-1] != LF) {
+		j -= 1
+	}
+
+	return index - j + 1
 }
 
 /*
@@ -342,24 +420,36 @@ func (p *parser) isComment() bool {
 /*
  *  Check for any +val or -val suffixes to constants or variables
  */
-func (p *parser) plusOrMinus() int {
+func (p *parser) plusOrMinus() (int, error) {
 	// skip past whitespace
 	j := p.i
 	for p.b[j] <= ' ' {
 		j += 1
 	}
 
-	if (p.b[j] == '+') {
-		p.skip(j-p.i+1)
-		plus, _ := p.nextValue()
-		return plus
+	if (p.b[j] != '+') && (p.b[j] != '-') {
+		return 0, nil
+	}
+
+	// Only an offset if a number follows (e.g. not @a + @b)
+	k := j + 1
+	for (k < p.end) && ((p.b[k] == ' ') || (p.b[k] == TAB)) {
+		k += 1
+	}
+	c := p.b[k]
+	if !(((c >= '0') && (c <= '9')) || (c == '$') || (c == '%') || (c == '\'')) {
+		return 0, nil
+	}
+
+	p.skip(j-p.i+1)
+	value, err := p.nextValue()
+	if (err != nil) {
+		return 0, fmt.Errorf("invalid offset after %c -- %s", p.b[j], err)
 	}
 	if (p.b[j] == '-') {
-		p.skip(j-p.i+1)
-		minus, _ := p.nextValue()
-		return -minus
+		return -value, nil
 	}
-	return 0
+	return value, nil
 }
 
 
@@ -411,6 +501,18 @@ func addressToPrefix(v int) int {
 	}
 }
 func valueToPrefix(v int) int {
+	// Negative values are two's-complement
+	if (v < 0) {
+		if (v >= -0x080) {
+			return R08
+		} else if (v >= -0x08000) {
+			return R16
+		} else if (v >= -0x0800000) {
+			return R24
+		}
+		return R32
+	}
+
 	if (v <= 0x0FF) {
 		return R08
 	} else if (v <= 0x0FFFF) {
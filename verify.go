@@ -0,0 +1,104 @@
+package aCCembler
+
+import (
+	"fmt"
+)
+
+
+/*
+ *  Decode the bytes output for an instruction and check that they are the instruction (-verify)
+ *  (so a wrong length or operand width fails the build, rather than ending up in a ROM)
+ */
+func (p *parser) verifyInstruction(i *instruction, bytes []uint8) error {
+	// The 65C24T8 has every opcode except the WDC bit instructions
+	if (p.verifyTable == nil) {
+		cpu := CPU_65C24T8
+		if (p.cpu == CPU_W65C02) {
+			cpu = CPU_W65C02
+		}
+		p.verifyTable = disasmTable(cpu)
+	}
+
+	d := new(disassembler)
+	parsed := d.instructionStr(instructionItem(i), nil)
+	mismatch := func(format string, a ...interface{}) error {
+		return i.errorf("-verify: %s @$%06x is output as %s, but %s",
+			parsed, i.address, disasmBytesStr(bytes), fmt.Sprintf(format, a...))
+	}
+
+	// The opcode and length have to match the opcode table (e.g. after the instruction was changed)
+	o, found := lookupOpcode(i.mnemonic, i.addressMode, i.prefix)
+	if (!found) {
+		return mismatch("%s isn't in the opcode table", addressModeStr(i.addressMode))
+	} else if (o.opcode != i.opcode) || (o.len != i.len) {
+		return mismatch("the opcode table has $%02x and %d bytes, not $%02x and %d bytes", o.opcode, o.len, i.opcode, i.len)
+	} else if (len(bytes) != i.len) {
+		return mismatch("the instruction is %d bytes", i.len)
+	}
+
+	// Decode it
+	item, _ := decodeInstruction(p.verifyTable, bytes, i.address)
+	if (item.mnemonic == 0) {
+		return mismatch("that isn't an instruction")
+	} else if (len(item.bytes) != len(bytes)) {
+		return mismatch("that decodes as the %d bytes of %s", len(item.bytes), d.instructionStr(item, nil))
+	}
+	decoded := d.instructionStr(item, nil)
+
+	// The same opcode and width (where two mnemonics share an opcode, e.g. BGE and BCS, either will do)
+	o, found = lookupOpcode(i.mnemonic, item.addressMode, item.prefix)
+	if (item.prefix != i.prefix) || (!found) || (o.opcode != i.opcode) || (o.len != i.len) {
+		return mismatch("that decodes as %s", decoded)
+	}
+
+	// The same operand
+	switch (i.addressMode) {
+	case modeImplicit, modeX, modeXY:
+	case modeRelative:
+		if (item.value != i.value) {
+			return mismatch("that decodes as %s (the branch is too far)", decoded)
+		}
+	case modeZeroPageRelative:
+		if (item.zeroPage != i.zeroPage) || (item.value != i.value) {
+			return mismatch("that decodes as %s", decoded)
+		}
+	default:
+		// A negative value is fine, as long as it fits
+		bits := uint(8 * (i.len - 1))
+		if (i.prefix != A16) {
+			bits -= 8
+		}
+		high := i.value >> bits
+		if (i.value & ((1 << bits) - 1) != item.value) || ((high != 0) && (high != -1)) {
+			return mismatch("that decodes as %s ($%x doesn't fit in %d bits)", decoded, i.value, bits)
+		}
+	}
+
+	return nil
+}
+
+/*
+ *  The opcode of a mnemonic for an address mode and prefix
+ */
+func lookupOpcode(m int, addressMode int, prefix int) (opcode, bool) {
+	for _, o := range mnemonics[m].opcode {
+		if (o.mode == addressMode) && (o.size == prefix) {
+			return o, true
+		}
+	}
+	return opcode{}, false
+}
+
+/*
+ *  The instruction as the disassembler sees it (to explain it the same way)
+ */
+func instructionItem(i *instruction) *disasmItem {
+	item := new(disasmItem)
+	item.address = i.address
+	item.mnemonic = i.mnemonic
+	item.addressMode = i.addressMode
+	item.prefix = i.prefix
+	item.value = i.value
+	item.zeroPage = i.zeroPage
+	return item
+}
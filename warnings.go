@@ -0,0 +1,324 @@
+package aCCembler
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Classes of warnings, each one turned on/off (or into an error) by -W and #pragma warning
+const (
+	WARN_WIDTH = iota
+	WARN_TIMING
+	WARN_STACK
+	WARN_RECURSION
+	WARN_VECTORS
+	WARN_UNUSED_CONST
+	WARN_UNUSED_GLOBAL
+	WARN_VAR_OVERLAP
+	WARN_UNUSED_LABEL
+	WARN_UNREACHABLE
+)
+
+// Name, default, and description of each class of warning
+type warningClass struct {
+	name		string
+	on			bool			// on unless turned off with -W no-name
+	about		string
+}
+var warningClasses = []warningClass {
+	{"width",			true,	"an instruction narrower than the value in its register"},
+	{"timing",			true,	"a branch in a TIMED block that crosses a page"},
+	{"stack",			true,	"a path that returns with an unbalanced stack"},
+	{"recursion",		true,	"a SUB that calls itself, so its stack is unbounded"},
+	{"vectors",			true,	"VECTORS without an nmi or irq, so that vector is $0000"},
+	{"unused-const",	false,	"a CONST that is never read"},
+	{"unused-global",	false,	"a GLOBAL that is never touched"},
+	{"var-overlap",		false,	"a VAR whose address overlaps another VAR in the same block"},
+	{"unused-label",	false,	"a label that nothing branches to"},
+	{"unreachable",		false,	"code after an RTS, RTI, JMP, or BRA that nothing branches to"},
+}
+
+// A region of a file where #pragma warning off silences a class of warning
+type warnRegion struct {
+	class		int				// -1 for every class
+	filename	string
+	from		int				// the line of the #pragma warning off
+	to			int				//   and of the #pragma warning on (0 until then)
+}
+
+// A warning that wasn't printed (when quiet), e.g. for aCCemble lsp
+type warningMessage struct {
+	class		int
+	filename	string
+	line		int
+	msg			string
+}
+
+// Every -W, e.g. -W unused-label -W error=stack
+type warningFlags []string
+
+func (w *warningFlags) String() string {
+	return strings.Join(*w, ",")
+}
+
+func (w *warningFlags) Set(value string) error {
+	*w = append(*w, value)
+	return nil
+}
+
+
+/*
+ *  Lookup the class of warning by name, e.g. unused-label
+ */
+func lookupWarningClass(name string) (int, error) {
+	nameLC := strings.ToLower(name)
+	for c := range warningClasses {
+		if (warningClasses[c].name == nameLC) {
+			return c, nil
+		}
+	}
+
+	names := []string{}
+	for c := range warningClasses {
+		names = append(names, warningClasses[c].name)
+	}
+	return 0, fmt.Errorf("unknown warning '%s', must be one of %s", name, strings.Join(names, ", "))
+}
+
+/*
+ *  Turn the classes of warnings on/off or into errors, from each -W
+ *  i.e. all, error, name, no-name, or error=name (or a comma-separated list of them)
+ */
+func (p *parser) setWarnings(flags []string) error {
+	p.warnOn = make([]bool, len(warningClasses))
+	p.warnError = make([]bool, len(warningClasses))
+	for c := range warningClasses {
+		p.warnOn[c] = warningClasses[c].on
+	}
+
+	for _, f := range flags {
+		for _, w := range strings.Split(f, ",") {
+			w = strings.TrimSpace(strings.ToLower(w))
+			switch {
+			case (w == "all"):
+				for c := range warningClasses {
+					p.warnOn[c] = true
+				}
+			case (w == "error"):
+				for c := range warningClasses {
+					p.warnError[c] = true
+				}
+			case strings.HasPrefix(w, "error="):
+				c, err := lookupWarningClass(w[6:])
+				if (err != nil) {
+					return err
+				}
+				p.warnOn[c] = true
+				p.warnError[c] = true
+			case strings.HasPrefix(w, "no-"):
+				c, err := lookupWarningClass(w[3:])
+				if (err != nil) {
+					return err
+				}
+				p.warnOn[c] = false
+				p.warnError[c] = false
+			default:
+				c, err := lookupWarningClass(w)
+				if (err != nil) {
+					return err
+				}
+				p.warnOn[c] = true
+			}
+		}
+	}
+
+	return nil
+}
+
+/*
+ *  Parse #pragma warning off [name, ...] or #pragma warning on [name, ...]
+ *  (without any names, every class of warning)
+ */
+func (p *parser) parsePragmaWarning() error {
+	p.skipWhitespace()
+	onOff := strings.ToLower(p.nextAZ_az_09())
+	if (onOff != "on") && (onOff != "off") {
+		return fmt.Errorf("#pragma warning must be followed by on or off, not '%s'", onOff)
+	}
+
+	classes := []int{}
+	for {
+		p.skipWhitespace()
+		start := p.i
+		for (p.i < p.end) && (((p.b[p.i] >= 'a') && (p.b[p.i] <= 'z')) || ((p.b[p.i] >= 'A') && (p.b[p.i] <= 'Z')) || (p.b[p.i] == '-')) {
+			p.i += 1
+		}
+		if (p.i == start) {
+			break
+		}
+		c, err := lookupWarningClass(string(p.b[start:p.i]))
+		if (err != nil) {
+			return fmt.Errorf("#pragma warning %s: %s", onOff, err)
+		}
+		classes = append(classes, c)
+
+		p.skipWhitespace()
+		if (p.peekChar() != ',') {
+			break
+		}
+		p.skip(1)
+	}
+	if (len(classes) == 0) {
+		classes = append(classes, -1)
+	}
+
+	for _, c := range classes {
+		if (onOff == "off") {
+			p.warnOff = append(p.warnOff, warnRegion{c, p.filename, p.n, 0})
+			continue
+		}
+		for k := range p.warnOff {
+			r := &p.warnOff[k]
+			if (r.filename == p.filename) && (r.to == 0) && ((c == -1) || (r.class == c)) {
+				r.to = p.n
+			}
+		}
+	}
+
+	p.skipWhitespaceAndEOL()
+	return nil
+}
+
+/*
+ *  Print a warning about the instruction on the line (unless that class is off), or an error if -W error
+ */
+func (p *parser) warning(class int, line int, msg string) {
+	p.warningIn(class, p.filename, line, msg)
+}
+
+func (p *parser) warningIn(class int, filename string, line int, msg string) {
+	if (p.warnOn != nil) && (!p.warnOn[class]) {
+		return
+	}
+	for _, r := range p.warnOff {
+		if (r.filename == filename) && ((r.class == -1) || (r.class == class)) && (line >= r.from) && ((r.to == 0) || (line < r.to)) {
+			return
+		}
+	}
+	if (p.quiet) {
+		p.warnings = append(p.warnings, warningMessage{class, filename, line, msg})
+		return
+	}
+
+	if (p.warnError != nil) && (p.warnError[class]) {
+		p.warnErrors += 1
+		fmt.Printf("ERROR in %s [line %d] -- %s [-W error=%s]\n", filename, line, msg, warningClasses[class].name)
+	} else {
+		fmt.Printf("WARNING in %s [line %d] -- %s [-W %s]\n", filename, line, msg, warningClasses[class].name)
+	}
+}
+
+/*
+ *  Warn about the labels nothing branches to, the code after an RTS, RTI, JMP, or BRA
+ *  that nothing branches to, and VARs that overlap (in the block and its sub-blocks)
+ */
+func (p *parser) checkBlockWarnings(b *codeBlock) {
+	items := flattenCodeBlock(b, nil)
+	labels := labelIndexes(items)
+
+	// Labels that nothing uses
+	used := make(map[string]bool)
+	for _, it := range items {
+		if (it.i.mnemonic != 0) && (it.i.symbolLC != "") {
+			used[it.i.symbolLC] = true
+		}
+	}
+	for _, it := range items {
+		if (it.i.mnemonic == 0) && (it.i.source) && (!used[it.i.symbolLC]) {
+			p.warning(WARN_UNUSED_LABEL, it.i.line, fmt.Sprintf("nothing branches to the label '%s' in %s %s",
+				it.i.symbol, strings.ToUpper(blockKindStr(b.kind)), b.name))
+		}
+	}
+
+	// Code that can't be reached from the start of the block (warning once per stretch of it)
+	if (len(items) > 0) {
+		reached := make([]bool, len(items))
+		reached[0] = true
+		work := []int{0}
+		for len(work) > 0 {
+			k := work[len(work)-1]
+			work = work[:len(work)-1]
+			for _, n := range successors(items, k, labels) {
+				if (!reached[n]) {
+					reached[n] = true
+					work = append(work, n)
+				}
+			}
+		}
+		warned := false
+		for k, it := range items {
+			if (reached[k]) {
+				warned = false
+			} else if (it.i.mnemonic != 0) && (it.i.source) && (!warned) {
+				warned = true
+				p.warning(WARN_UNREACHABLE, it.i.line, fmt.Sprintf("the code in %s %s from here can never be reached",
+					strings.ToUpper(blockKindStr(b.kind)), b.name))
+			}
+		}
+	}
+
+	p.checkVarOverlap(b)
+}
+
+/*
+ *  Mark the instructions parsed since the one before as written in the source
+ *  (the code of a mnemonic, expression, or register statement, but not its generated labels)
+ */
+func (p *parser) markSource(before *instruction) {
+	i := p.currentCode.instr
+	if (before != nil) {
+		i = before.next
+	}
+	for ; i != nil; i = i.next {
+		if (i.mnemonic != 0) {
+			i.source = true
+		}
+	}
+}
+
+/*
+ *  Warn about the VARs whose bytes overlap another VAR in the same block (and in each sub-block)
+ */
+func (p *parser) checkVarOverlap(b *codeBlock) {
+	for v := b.vrbl; v != nil; v = v.next {
+		for w := v.next; w != nil; w = w.next {
+			vEnd := v.address + prefixToWidth(v.size)/8
+			wEnd := w.address + prefixToWidth(w.size)/8
+			if (v.address < wEnd) && (w.address < vEnd) {
+				p.warningIn(WARN_VAR_OVERLAP, w.filename, w.line, fmt.Sprintf("'%s' @$%04x overlaps '%s' @$%04x (on line %d)",
+					w.name, w.address, v.name, v.address, v.line))
+			}
+		}
+	}
+	for i := b.instr; i != nil; i = i.next {
+		if (i.subBlock != nil) {
+			p.checkVarOverlap(i.subBlock.block)
+		}
+	}
+}
+
+/*
+ *  Warn about the CONSTs that are never read and the GLOBALs that are never touched
+ */
+func (p *parser) checkUnusedSymbols() {
+	for c := p.cnst; c != nil; c = c.next {
+		if (!c.used) {
+			p.warningIn(WARN_UNUSED_CONST, c.filename, c.line, fmt.Sprintf("CONST '%s' is never used", c.name))
+		}
+	}
+	for v := p.global; v != nil; v = v.next {
+		if (!v.used) {
+			p.warningIn(WARN_UNUSED_GLOBAL, v.filename, v.line, fmt.Sprintf("GLOBAL '%s' is never used", v.name))
+		}
+	}
+}
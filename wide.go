@@ -0,0 +1,276 @@
+package aCCembler
+
+import (
+	"fmt"
+)
+
+
+/*
+ *  Does the expression need 16-bit or 24-bit values?
+ *  (which, without the 65C2402 prefix codes, have to be handled a byte at a time)
+ */
+func isWideExpression(expr *expression) bool {
+	if (expr.src1.location == VALUE) {
+		return prefixToWidth(unionAddressMode(expr.dest.size, expr.src1.size)) > 8
+	}
+	return (prefixToWidth(expr.dest.size) > 8) || (prefixToWidth(expr.src1.size) > 8)
+}
+
+/*
+ *  The number of bytes in an expression argument
+ */
+func eunitBytes(u eunit) int {
+	return prefixToWidth(u.size) / 8
+}
+
+/*
+ *  Is the expression argument one of A, X, or Y?
+ */
+func isRegisterEunit(u eunit) bool {
+	return (u.location == REG_A) || (u.location == REG_X) || (u.location == REG_Y)
+}
+
+/*
+ *  Generate the code for a 16-bit or 24-bit expression a byte at a time
+ *  (for the 6502 and 65C02, which only have 8-bit registers)
+ */
+func (p *parser) generateWideExpression(expr *expression) error {
+	nb := prefixToWidth(unionAddressMode(expr.dest.size, expr.src1.size)) / 8
+	if (expr.src1.location == VALUE) && (nb < eunitBytes(expr.dest)) {
+		nb = eunitBytes(expr.dest)
+	}
+
+	// A, X, and Y are only 8-bit
+	if (isRegisterEunit(expr.dest)) {
+		return fmt.Errorf("the %s only has an 8-bit %s, so it can't be %d-bit", cpuStr(p.cpu), registerEunitStr(expr.dest), nb*8)
+	}
+	if (isRegisterEunit(expr.src1)) && (eunitBytes(expr.src1) > 1) {
+		return fmt.Errorf("the %s only has an 8-bit %s, so it can't be %d-bit", cpuStr(p.cpu), registerEunitStr(expr.src1), eunitBytes(expr.src1)*8)
+	}
+
+	// Only =, +=, and a shift by a constant are handled a byte at a time (the rest need the 65C2402)
+	if (expr.op != NO_OP) {
+		return fmt.Errorf("the %s can't do a %d-bit '%s' in an expression (only =, +=, <<=, and >>=)", cpuStr(p.cpu), nb*8, exprOpStr(expr.op))
+	}
+	switch (expr.equalOp) {
+	case EQUALS:
+		return p.generateWideEquals(expr, nb)
+	case PLUS:
+		return p.generateWidePlusEquals(expr, nb)
+	case SHIFT_LEFT, SHIFT_RIGHT:
+		if (expr.src1.location != VALUE) {
+			return fmt.Errorf("the %s can only do a %d-bit '%s=' by a constant", cpuStr(p.cpu), nb*8, exprOpStr(expr.equalOp))
+		}
+		p.generateWideShift(expr, nb)
+		return nil
+	}
+
+	return fmt.Errorf("the %s can't do a %d-bit '%s=' in an expression (only =, +=, <<=, and >>=)", cpuStr(p.cpu), nb*8, exprOpStr(expr.equalOp))
+}
+
+/*
+ *  The operator as written in an expression, e.g. "-" (without the = of "-=")
+ */
+func exprOpStr(op int) string {
+	switch (op) {
+	case PLUS: return "+"
+	case MINUS: return "-"
+	case AND: return "&"
+	case OR: return "|"
+	case EOR: return "^"
+	case SHIFT_LEFT: return "<<"
+	case SHIFT_RIGHT: return ">>"
+	}
+	return "="
+}
+
+/*
+ *  M = M|V|R, one byte at a time (low byte first)
+ */
+func (p *parser) generateWideEquals(expr *expression, nb int) error {
+	saveRestoreSize := p.lastAsz
+
+	switch (expr.src1.location) {
+	case MEMORY, VARIABLE, VALUE:
+		r0, err := p.scratchAddress(saveRestoreSize)
+		if (err != nil) {
+			return err
+		}
+		p.addExprInstruction("sta", modeZeroPage, saveRestoreSize, r0) // sta R0
+		for k := 0; k < nb; k++ {
+			p.addWideByte("lda", expr.src1, k)
+			p.addByteInstruction("sta", expr.dest.addrval, k)
+		}
+		p.addExprInstruction("lda", modeZeroPage, saveRestoreSize, r0) // lda R0
+	case REG_A, REG_X, REG_Y:
+		mmm := "sta"
+		if (expr.src1.location == REG_X) {
+			mmm = "stx"
+		} else if (expr.src1.location == REG_Y) {
+			mmm = "sty"
+		}
+		p.addByteInstruction(mmm, expr.dest.addrval, 0)
+		return p.addWideZeros(expr.dest.addrval, 1, nb)
+	}
+
+	return nil
+}
+
+/*
+ *  M += M|V|R, one byte at a time (low byte first, carrying into the next byte)
+ */
+func (p *parser) generateWidePlusEquals(expr *expression, nb int) error {
+	saveRestoreSize := p.lastAsz
+	r0, err := p.scratchAddress(saveRestoreSize)
+	if (err != nil) {
+		return err
+	}
+
+	p.addExprInstruction("sta", modeZeroPage, saveRestoreSize, r0) // sta R0
+	switch (expr.src1.location) {
+	case MEMORY, VARIABLE, VALUE:
+		p.addExprInstruction("clc", modeImplicit, 0, 0)
+		for k := 0; k < nb; k++ {
+			p.addByteInstruction("lda", expr.dest.addrval, k)
+			p.addWideByte("adc", expr.src1, k)
+			p.addByteInstruction("sta", expr.dest.addrval, k)
+		}
+	case REG_A, REG_X, REG_Y:
+		if (expr.src1.location == REG_X) {
+			p.addExprInstruction("txa", modeImplicit, R08, 0)
+		} else if (expr.src1.location == REG_Y) {
+			p.addExprInstruction("tya", modeImplicit, R08, 0)
+		}
+		p.addExprInstruction("clc", modeImplicit, 0, 0)
+		p.addByteInstruction("adc", expr.dest.addrval, 0)
+		p.addByteInstruction("sta", expr.dest.addrval, 0)
+		for k := 1; k < nb; k++ {
+			p.addByteInstruction("lda", expr.dest.addrval, k)
+			p.addExprInstruction("adc", modeImmediate, R08, 0)
+			p.addByteInstruction("sta", expr.dest.addrval, k)
+		}
+	}
+	p.addExprInstruction("lda", modeZeroPage, saveRestoreSize, r0) // lda R0
+
+	return nil
+}
+
+/*
+ *  M <<= V or M >>= V, shifting the carry through every byte
+ */
+func (p *parser) generateWideShift(expr *expression, nb int) {
+	for n := 0; n < expr.src1.addrval; n++ {
+		if (expr.equalOp == SHIFT_LEFT) {
+			p.addByteInstruction("asl", expr.dest.addrval, 0)
+			for k := 1; k < nb; k++ {
+				p.addByteInstruction("rol", expr.dest.addrval, k)
+			}
+		} else {
+			p.addByteInstruction("lsr", expr.dest.addrval, nb-1)
+			for k := nb-2; k >= 0; k-- {
+				p.addByteInstruction("ror", expr.dest.addrval, k)
+			}
+		}
+	}
+}
+
+/*
+ *  Step a 16-bit or 24-bit FOR loop variable and compare it to the end, a byte at a time
+ *  (leaving the BNE back to the top of the loop for the last byte)
+ */
+func (p *parser) addWideForStep(name string, address int, nb int, up bool, end int) {
+	if (up) {
+		// INC carries into the next byte when the byte wraps to 0
+		nextLabel := name + "_next"
+		p.addByteInstruction("inc", address, 0)
+		for k := 1; k < nb; k++ {
+			p.addExprInstructionWithSymbol("bne", modeRelative, A16, 0, nextLabel, false)
+			p.addByteInstruction("inc", address, k)
+		}
+		p.addInstructionLabel(nextLabel)
+	} else {
+		// DEC borrows from the next byte when the byte was 0
+		for k := 0; k < nb-1; k++ {
+			p.addByteInstruction("ldx", address, k)
+			p.addExprInstructionWithSymbol("bne", modeRelative, A16, 0, fmt.Sprintf("%s_dec%d", name, k), false)
+		}
+		p.addByteInstruction("dec", address, nb-1)
+		for k := nb-2; k >= 0; k-- {
+			p.addInstructionLabel(fmt.Sprintf("%s_dec%d", name, k))
+			p.addByteInstruction("dec", address, k)
+		}
+	}
+
+	for k := 0; k < nb; k++ {
+		if (k > 0) {
+			p.addExprInstructionWithSymbol("bne", modeRelative, A16, 0, name + "_loop", false)
+		}
+		p.addByteInstruction("ldx", address, k)
+		p.addExprInstruction("cpx", modeImmediate, R08, (end >> uint(8*k)) & 0xFF)
+	}
+}
+
+/*
+ *  Add an 8-bit instruction for byte k of a memory address
+ */
+func (p *parser) addByteInstruction(mmm string, address int, k int) *instruction {
+	if (address+k <= 0x0FF) {
+		return p.addExprInstruction(mmm, modeZeroPage, R08, address+k)
+	}
+	return p.addExprInstruction(mmm, modeAbsolute, A16, address+k)
+}
+
+/*
+ *  Add an 8-bit instruction for byte k of a memory or value argument
+ *  (zero extending an argument narrower than the expression)
+ */
+func (p *parser) addWideByte(mmm string, u eunit, k int) *instruction {
+	if (u.location == VALUE) {
+		return p.addExprInstruction(mmm, modeImmediate, R08, (u.addrval >> uint(8*k)) & 0xFF)
+	} else if (k >= eunitBytes(u)) {
+		return p.addExprInstruction(mmm, modeImmediate, R08, 0)
+	}
+	return p.addByteInstruction(mmm, u.addrval, k)
+}
+
+/*
+ *  Zero bytes first through last-1 of a memory address
+ *  (with STZ on the 65C02, else through A, keeping A as it was)
+ */
+func (p *parser) addWideZeros(address int, first int, last int) error {
+	if (first >= last) {
+		return nil
+	}
+
+	if (p.cpu >= CPU_65C02) {
+		for k := first; k < last; k++ {
+			p.addByteInstruction("stz", address, k)
+		}
+		return nil
+	}
+
+	saveRestoreSize := p.lastAsz
+	r0, err := p.scratchAddress(saveRestoreSize)
+	if (err != nil) {
+		return err
+	}
+	p.addExprInstruction("sta", modeZeroPage, saveRestoreSize, r0) // sta R0
+	p.addExprInstruction("lda", modeImmediate, R08, 0)
+	for k := first; k < last; k++ {
+		p.addByteInstruction("sta", address, k)
+	}
+	p.addExprInstruction("lda", modeZeroPage, saveRestoreSize, r0) // lda R0
+
+	return nil
+}
+
+/*
+ *  Explain the register in a string
+ */
+func registerEunitStr(u eunit) string {
+	switch (u.location) {
+	case REG_X: return "X"
+	case REG_Y: return "Y"
+	}
+	return "A"
+}
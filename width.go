@@ -0,0 +1,317 @@
+package aCCembler
+
+import (
+	"fmt"
+	"strings"
+)
+
+// What an instruction does with the width of A, X, or Y
+const (
+	WD_NONE = iota	// doesn't care (e.g. CMP.b of a 16-bit A is fine)
+	WD_LOAD			// sets the register (and its width)
+	WD_OP			// reads then sets the register, dropping the bits above its width
+	WD_STORE		// reads the register, including bits above the width it was set
+	WD_MOVE			// reads one register, sets another
+	WD_CLOBBER		// sets the register to something unknown
+)
+
+// Width of a register when it is not known
+const (
+	WIDTH_UNSEEN = -1	// this instruction hasn't been reached (yet)
+	WIDTH_UNKNOWN = 0	// could be any width
+)
+
+type widthUse struct {
+	use			int
+	reg			int				// register read (or set by a LOAD/OP)
+	dest		int				// register set by a MOVE
+}
+var widthUses = map[string]widthUse {
+	"lda": {WD_LOAD, REG_A, N_A}, "ldx": {WD_LOAD, REG_X, N_A}, "ldy": {WD_LOAD, REG_Y, N_A},
+	"pla": {WD_LOAD, REG_A, N_A}, "plx": {WD_LOAD, REG_X, N_A}, "ply": {WD_LOAD, REG_Y, N_A},
+	"tta": {WD_LOAD, REG_A, N_A},
+	"ora": {WD_OP, REG_A, N_A}, "and": {WD_OP, REG_A, N_A}, "eor": {WD_OP, REG_A, N_A},
+	"adc": {WD_OP, REG_A, N_A}, "sbc": {WD_OP, REG_A, N_A},
+	"sl8": {WD_OP, REG_A, N_A}, "sr8": {WD_OP, REG_A, N_A},
+	"xsl": {WD_OP, REG_X, N_A}, "ysl": {WD_OP, REG_Y, N_A},
+	"inx": {WD_OP, REG_X, N_A}, "dex": {WD_OP, REG_X, N_A},
+	"iny": {WD_OP, REG_Y, N_A}, "dey": {WD_OP, REG_Y, N_A},
+	"asl": {WD_OP, REG_A, N_A}, "lsr": {WD_OP, REG_A, N_A},		// only when implicit, i.e. ASL A
+	"rol": {WD_OP, REG_A, N_A}, "ror": {WD_OP, REG_A, N_A},		//   ^
+	"inc": {WD_OP, REG_A, N_A}, "dec": {WD_OP, REG_A, N_A},		//   ^
+	"sta": {WD_STORE, REG_A, N_A}, "stx": {WD_STORE, REG_X, N_A}, "sty": {WD_STORE, REG_Y, N_A},
+	"pha": {WD_STORE, REG_A, N_A}, "phx": {WD_STORE, REG_X, N_A}, "phy": {WD_STORE, REG_Y, N_A},
+	"tat": {WD_STORE, REG_A, N_A},
+	"tax": {WD_MOVE, REG_A, REG_X}, "tay": {WD_MOVE, REG_A, REG_Y},
+	"txa": {WD_MOVE, REG_X, REG_A}, "tya": {WD_MOVE, REG_Y, REG_A},
+	"adx": {WD_CLOBBER, REG_A, N_A}, "ady": {WD_CLOBBER, REG_A, N_A}, "axy": {WD_CLOBBER, REG_A, N_A},
+}
+
+// Known width of A, X, and Y (and the instruction that set it)
+type widthState struct {
+	sz			[3]int
+	from		[3]*instruction
+}
+
+
+/*
+ *  Track the width of A, X, and Y through the block (and its sub-blocks),
+ *  warning about (or widening) the instructions that would truncate a wider value
+ */
+func (p *parser) checkRegisterWidths(b *codeBlock) {
+	// Widening an instruction changes the state after it, so widen until nothing changes
+	if (p.widen) {
+		for p.checkRegisterWidthsOnce(b, false) {
+			b.endAddr = relocateCodeBlock(b.instr, b.startAddr)
+		}
+	}
+
+	// Then warn about whatever is left
+	p.checkRegisterWidthsOnce(b, true)
+}
+func (p *parser) checkRegisterWidthsOnce(b *codeBlock, report bool) bool {
+	items := flattenCodeBlock(b, nil)
+	labels := labelIndexes(items)
+	if (len(items) == 0) {
+		return false
+	}
+
+	// The state before each instruction, starting with everything unknown
+	states := make([]widthState, len(items))
+	for k := range states {
+		states[k].sz = [3]int{WIDTH_UNSEEN, WIDTH_UNSEEN, WIDTH_UNSEEN}
+	}
+	states[0].sz = [3]int{WIDTH_UNKNOWN, WIDTH_UNKNOWN, WIDTH_UNKNOWN}
+
+	// Iterate until the state before every instruction settles
+	work := []int{0}
+	for len(work) > 0 {
+		k := work[len(work)-1]
+		work = work[:len(work)-1]
+
+		out := states[k]
+		stepWidth(items[k].i, &out)
+		for _, n := range successors(items, k, labels) {
+			if (mergeWidths(&states[n], &out)) {
+				work = append(work, n)
+			}
+		}
+	}
+
+	// Now check each instruction against the (final) state before it
+	for k := range items {
+		i := items[k].i
+		if (i.mnemonic == 0) || (states[k].sz[0] == WIDTH_UNSEEN) {
+			continue
+		}
+		if (p.checkWidth(i, &states[k], report)) {
+			return true // widened, which changes everything after it
+		}
+	}
+
+	return false
+}
+
+/*
+ *  Lookup what the instruction does with the register widths
+ */
+func lookupWidthUse(i *instruction) (widthUse, bool) {
+	name := mnemonics[i.mnemonic].name
+	use, ok := widthUses[name]
+	if (!ok) {
+		return use, false
+	}
+
+	// INC/DEC/ASL/LSR/ROL/ROR only use A when there is no address
+	switch (name) {
+	case "inc", "dec", "asl", "lsr", "rol", "ror":
+		if (i.addressMode != modeImplicit) {
+			return use, false
+		}
+	}
+
+	return use, true
+}
+
+/*
+ *  Update the state with the effect of the instruction
+ */
+func stepWidth(i *instruction, s *widthState) {
+	if (i.mnemonic == 0) {
+		return
+	}
+
+	// A subroutine can leave anything in the registers
+	if (mnemonics[i.mnemonic].name == "jsr") {
+		for r := range s.sz {
+			s.sz[r] = WIDTH_UNKNOWN
+			s.from[r] = nil
+		}
+		return
+	}
+
+	use, ok := lookupWidthUse(i)
+	if (!ok) {
+		return
+	}
+	switch (use.use) {
+	case WD_LOAD, WD_OP:
+		s.sz[use.reg-REG_A] = prefixToWidth(i.prefix)
+		s.from[use.reg-REG_A] = i
+	case WD_MOVE:
+		s.sz[use.dest-REG_A] = prefixToWidth(i.prefix)
+		s.from[use.dest-REG_A] = i
+	case WD_CLOBBER:
+		s.sz[use.reg-REG_A] = WIDTH_UNKNOWN
+		s.from[use.reg-REG_A] = nil
+	}
+}
+
+/*
+ *  Merge the state from another path into the state before an instruction
+ *  (returning whether it changed)
+ */
+func mergeWidths(s *widthState, in *widthState) bool {
+	changed := false
+	for r := range s.sz {
+		if (s.sz[r] == WIDTH_UNSEEN) {
+			s.sz[r] = in.sz[r]
+			s.from[r] = in.from[r]
+			changed = true
+		} else if (s.sz[r] != WIDTH_UNKNOWN) && (s.sz[r] != in.sz[r]) {
+			// Different widths on different paths, so no longer known
+			s.sz[r] = WIDTH_UNKNOWN
+			s.from[r] = nil
+			changed = true
+		}
+	}
+
+	return changed
+}
+
+/*
+ *  The instructions that can run after items[k]
+ */
+func successors(items []peepItem, k int, labels map[string]int) []int {
+	i := items[k].i
+	next := []int{}
+	if (k+1 < len(items)) {
+		next = append(next, k+1)
+	}
+	if (i.mnemonic == 0) {
+		return next
+	}
+
+	name := mnemonics[i.mnemonic].name
+	switch (name) {
+	case "rts", "rti", "brk", "thr", "stp":
+		return nil
+	case "jmp":
+		if (i.addressMode != modeAbsolute) || (i.hasValue) {
+			return nil // indirect, or to an address outside the block
+		}
+		if target, ok := labels[i.symbolLC]; ok {
+			return []int{target}
+		}
+		return nil
+	}
+
+	if ((i.addressMode == modeRelative) || (i.addressMode == modeZeroPageRelative)) && !i.hasValue {
+		if target, ok := labels[i.symbolLC]; ok {
+			if (name == "bra") {
+				return []int{target}
+			}
+			next = append(next, target)
+		}
+	}
+
+	return next
+}
+
+/*
+ *  Warn about (or widen) an instruction that is narrower than the value in its register
+ *  (returning whether the instruction changed size)
+ */
+func (p *parser) checkWidth(i *instruction, s *widthState, report bool) bool {
+	use, ok := lookupWidthUse(i)
+	if (!ok) {
+		return false
+	}
+
+	r := use.reg - REG_A
+	live := s.sz[r]
+	width := prefixToWidth(i.prefix)
+	if (live == WIDTH_UNKNOWN) || (width == live) {
+		return false
+	}
+
+	name := strings.ToUpper(mnemonics[i.mnemonic].name)
+	reg := "AXY"[r:r+1]
+	switch (use.use) {
+	case WD_OP, WD_MOVE:
+		if (width > live) {
+			return false
+		}
+		if (!report) {
+			return p.widenInstruction(i, live)
+		}
+		p.warning(WARN_WIDTH, i.line, fmt.Sprintf("%s is %d-bit, truncating the %d-bit %s set on line %d (add a .%s suffix)",
+			name, width, live, reg, s.from[r].line, widthSuffix(live)))
+	case WD_STORE:
+		if (!report) || (width < live) {
+			return false
+		}
+		p.warning(WARN_WIDTH, i.line, fmt.Sprintf("%s is %d-bit, but the %s set on line %d is only %d-bit (so the upper bytes are stale or undefined)",
+			name, width, reg, s.from[r].line, live))
+	}
+
+	return false
+}
+
+/*
+ *  Change the instruction to the wider register width (keeping its address width)
+ */
+func (p *parser) widenInstruction(i *instruction, width int) bool {
+	size := R16
+	if (width == 24) {
+		size = R24
+	}
+	if (i.prefix == A24) || (i.prefix == W16) || (i.prefix == W24) {
+		size = size + (W16 - R16)
+	}
+
+	mnemonic, o, err := lookupMnemonic(mnemonics[i.mnemonic].name, i.addressMode, size)
+	if (err != nil) {
+		return false
+	}
+	i.mnemonic = mnemonic
+	i.prefix = o.size
+	i.opcode = o.opcode
+	i.len = o.len
+
+	return true
+}
+
+/*
+ *  The register width (in bits) of the prefix code
+ */
+func prefixToWidth(prefix int) int {
+	switch (prefix & R32) {
+	case R16:
+		return 16
+	case R24, R32:
+		return 24
+	}
+
+	return 8
+}
+func widthSuffix(width int) string {
+	switch (width) {
+	case 16:
+		return "w"
+	case 24:
+		return "t"
+	}
+
+	return "b"
+}